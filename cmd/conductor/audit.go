@@ -0,0 +1,38 @@
+package main
+
+import (
+	"io"
+	"log"
+
+	"github.com/integrii/flaggy"
+
+	"github.com/mildred/conductor.go/src/service_public"
+)
+
+func cmd_audit_log() *flaggy.Subcommand {
+	var service_flag string
+	var json_flag bool
+
+	cmd := flaggy.NewSubcommand("log")
+	cmd.Description = "Show the changes made to services and policies"
+	cmd.String(&service_flag, "s", "service", "Only show the changes of this service")
+	cmd.Bool(&json_flag, "", "json", "Show JSON output")
+
+	cmd.CommandUsed = Hook(func() error {
+		log.Default().SetOutput(io.Discard)
+
+		return service_public.PrintAuditLog(service_public.AuditLogOpts{
+			Service:   service_flag,
+			PrintJson: json_flag,
+		})
+	})
+	return cmd
+}
+
+func cmd_audit() *flaggy.Subcommand {
+	cmd := flaggy.NewSubcommand("audit")
+	cmd.Description = "Audit log commands"
+	cmd.AttachSubcommand(cmd_audit_log(), 1)
+	cmd.RequireSubcommand = true
+	return cmd
+}
@@ -181,7 +181,7 @@ func cmd_deployment_env() *flaggy.Subcommand {
 			return err
 		}
 
-		for _, v := range depl.Vars() {
+		for _, v := range depl.MaskedVars() {
 			fmt.Printf("%s\n", v)
 		}
 
@@ -27,11 +27,24 @@ func cmd_function_caddy_config() *flaggy.Subcommand {
 	return cmd
 }
 
+func cmd_function_stats() *flaggy.Subcommand {
+	var json bool
+
+	cmd := flaggy.NewSubcommand("stats")
+	cmd.Description = "Show the worker pools of the fast function manager"
+	cmd.Bool(&json, "", "json", "Print as JSON")
+	cmd.CommandUsed = Hook(func() error {
+		return deployment_public.PrintFunctionStats(json)
+	})
+	return cmd
+}
+
 func cmd_function() *flaggy.Subcommand {
 	cmd := flaggy.NewSubcommand("function")
 	cmd.ShortName = "f"
 	cmd.Description = "Function commands"
 	cmd.AttachSubcommand(cmd_function_caddy_config(), 1)
+	cmd.AttachSubcommand(cmd_function_stats(), 1)
 	cmd.RequireSubcommand = true
 	return cmd
 }
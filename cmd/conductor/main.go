@@ -13,7 +13,9 @@ import (
 	"github.com/mildred/conductor.go/src/api"
 	"github.com/mildred/conductor.go/src/deployment"
 	"github.com/mildred/conductor.go/src/deployment_public"
+	"github.com/mildred/conductor.go/src/function_manager"
 	"github.com/mildred/conductor.go/src/install"
+	"github.com/mildred/conductor.go/src/lock"
 	"github.com/mildred/conductor.go/src/policies"
 	"github.com/mildred/conductor.go/src/service"
 	"github.com/mildred/conductor.go/src/service_public"
@@ -41,6 +43,16 @@ func cmd_private_policy_server() *flaggy.Subcommand {
 	return cmd
 }
 
+func cmd_private_fast_function_manager() *flaggy.Subcommand {
+	cmd := flaggy.NewSubcommand("fast-function-manager")
+	cmd.Description = "Run the fast function manager"
+
+	cmd.CommandUsed = Hook(func() error {
+		return function_manager.RunServer()
+	})
+	return cmd
+}
+
 func cmd_private() *flaggy.Subcommand {
 	cmd := flaggy.NewSubcommand("_")
 	cmd.Description = "Internal commands"
@@ -48,6 +60,7 @@ func cmd_private() *flaggy.Subcommand {
 	cmd.AttachSubcommand(cmd_private_deployment(), 1)
 	cmd.AttachSubcommand(cmd_private_policy_server(), 1)
 	cmd.AttachSubcommand(cmd_private_api_server(), 1)
+	cmd.AttachSubcommand(cmd_private_fast_function_manager(), 1)
 	cmd.RequireSubcommand = true
 	return cmd
 }
@@ -55,6 +68,7 @@ func cmd_private() *flaggy.Subcommand {
 func cmd_reload() *flaggy.Subcommand {
 	var inclusive bool
 	var verbose bool
+	var plan, json bool
 
 	cmd := flaggy.NewSubcommand("reload")
 	cmd.Description = "Reload and start services in well-known locations"
@@ -65,13 +79,43 @@ func cmd_reload() *flaggy.Subcommand {
 
 	cmd.Bool(&inclusive, "", "inclusive", "Allow services from other directories (do not stop them)")
 	cmd.Bool(&verbose, "v", "verbose", "Be verbose")
+	cmd.Bool(&plan, "", "plan", "Do not reload, show what would be done")
+	cmd.Bool(&json, "", "json", "Show the plan as JSON (implies --plan)")
 
 	cmd.CommandUsed = Hook(func() error {
+		if plan || json {
+			return service_public.PrintPlan(service_public.PlanOpts{
+				Inclusive: inclusive,
+				Verbose:   verbose,
+				PrintJson: json,
+			})
+		}
 		return service_public.ReloadServices(inclusive, verbose)
 	})
 	return cmd
 }
 
+func cmd_plan() *flaggy.Subcommand {
+	var inclusive bool
+	var verbose bool
+	var json bool
+
+	cmd := flaggy.NewSubcommand("plan")
+	cmd.Description = "Show which services reload would start, stop or redeploy"
+	cmd.Bool(&inclusive, "", "inclusive", "Allow services from other directories (do not stop them)")
+	cmd.Bool(&verbose, "v", "verbose", "Be verbose")
+	cmd.Bool(&json, "", "json", "Show JSON output")
+
+	cmd.CommandUsed = Hook(func() error {
+		return service_public.PrintPlan(service_public.PlanOpts{
+			Inclusive: inclusive,
+			Verbose:   verbose,
+			PrintJson: json,
+		})
+	})
+	return cmd
+}
+
 func cmd_system_install() *flaggy.Subcommand {
 	var destdir string
 
@@ -203,15 +247,27 @@ func cmd_run() *flaggy.Subcommand {
 func Main(ctx context.Context) error {
 	log.SetFlags(log.Lmsgprefix)
 
+	var no_wait bool
+
 	f := flaggy.NewParser(os.Args[0])
 	f.Version = version
+	f.Bool(&lock.Wait, "", "wait", "Wait for the service and deployment locks held by other operations (default)")
+	f.Bool(&no_wait, "", "no-wait", "Fail if a service or deployment lock is held by another operation")
+	f.CommandUsed = Hook(func() error {
+		if no_wait {
+			lock.Wait = false
+		}
+		return nil
+	})
 	f.AttachSubcommand(cmd_service(), 1)
 	f.AttachSubcommand(cmd_deployment(), 1)
 	f.AttachSubcommand(cmd_function(), 1)
 	f.AttachSubcommand(cmd_policy(), 1)
 	f.AttachSubcommand(cmd_peer(), 1)
+	f.AttachSubcommand(cmd_audit(), 1)
 	f.AttachSubcommand(cmd_run(), 1)
 	f.AttachSubcommand(cmd_reload(), 1)
+	f.AttachSubcommand(cmd_plan(), 1)
 	f.AttachSubcommand(cmd_system(), 1)
 	f.AttachSubcommand(cmd_private(), 1)
 	f.RequireSubcommand = true
@@ -7,18 +7,21 @@ import (
 	"log"
 	"os"
 	"os/exec"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/integrii/flaggy"
 
+	"github.com/mildred/conductor.go/src/audit"
 	"github.com/mildred/conductor.go/src/deployment"
 	"github.com/mildred/conductor.go/src/deployment_util"
 	"github.com/mildred/conductor.go/src/dirs"
 	"github.com/mildred/conductor.go/src/service"
 	"github.com/mildred/conductor.go/src/service_internal"
 	"github.com/mildred/conductor.go/src/service_public"
+	"github.com/mildred/conductor.go/src/utils"
 )
 
 type strlist []string
@@ -117,6 +120,19 @@ func cmd_service_disable() *flaggy.Subcommand {
 	return cmd
 }
 
+func cmd_service_reset_failed() *flaggy.Subcommand {
+	var service string
+
+	cmd := flaggy.NewSubcommand("reset-failed") // "SERVICE",
+	cmd.Description = "Forget the deployment failures of a degraded service, reload it to deploy again"
+	cmd.AddPositionalValue(&service, "service", 1, true, "The service to act on")
+
+	cmd.CommandUsed = Hook(func() error {
+		return service_public.ResetFailed(service)
+	})
+	return cmd
+}
+
 func cmd_service_start() *flaggy.Subcommand {
 	var service string
 	var background_flag, foreground_flag bool
@@ -231,6 +247,197 @@ func cmd_service_rolling_restart() *flaggy.Subcommand {
 	return cmd
 }
 
+func cmd_service_promote() *flaggy.Subcommand {
+	var service string
+	var stop_timeout, term_timeout time.Duration = 0, 5 * time.Second
+
+	cmd := flaggy.NewSubcommand("promote") // "SERVICE",
+	cmd.Description = "Finish a canary or blue-green rollout, removing the previous deployments"
+	cmd.Duration(&stop_timeout, "", "stop-timeout", "max duration to wait for the stop to complete (0 to disable timeout)")
+	cmd.Duration(&term_timeout, "", "term-timeout", "max duration to wait for the SIGTERM to kill (0 to disable timeout)")
+	cmd.AddPositionalValue(&service, "service", 1, true, "The service to act on")
+
+	cmd.CommandUsed = Hook(func() error {
+		return service_internal.Promote(service, service_internal.StartOrReloadOpts{
+			StopTimeout: stop_timeout,
+			TermTimeout: term_timeout,
+		})
+	})
+	return cmd
+}
+
+func cmd_service_abort() *flaggy.Subcommand {
+	var service string
+	var stop_timeout, term_timeout time.Duration = 0, 5 * time.Second
+
+	cmd := flaggy.NewSubcommand("abort") // "SERVICE",
+	cmd.Description = "Revert a canary or blue-green rollout, removing the new deployments"
+	cmd.Duration(&stop_timeout, "", "stop-timeout", "max duration to wait for the stop to complete (0 to disable timeout)")
+	cmd.Duration(&term_timeout, "", "term-timeout", "max duration to wait for the SIGTERM to kill (0 to disable timeout)")
+	cmd.AddPositionalValue(&service, "service", 1, true, "The service to act on")
+
+	cmd.CommandUsed = Hook(func() error {
+		return service_internal.Abort(service, service_internal.StartOrReloadOpts{
+			StopTimeout: stop_timeout,
+			TermTimeout: term_timeout,
+		})
+	})
+	return cmd
+}
+
+func cmd_service_scale() *flaggy.Subcommand {
+	var service, part, replicas string
+	var stop_timeout, term_timeout time.Duration = 0, 5 * time.Second
+
+	cmd := flaggy.NewSubcommand("scale") // "SERVICE", "REPLICAS"
+	cmd.Description = "Change the number of replicas of a service pod"
+	cmd.String(&part, "", "part", "The pod to scale (defaults to the main pod)")
+	cmd.Duration(&stop_timeout, "", "stop-timeout", "max duration to wait for the stop to complete (0 to disable timeout)")
+	cmd.Duration(&term_timeout, "", "term-timeout", "max duration to wait for the SIGTERM to kill (0 to disable timeout)")
+	cmd.AddPositionalValue(&service, "service", 1, true, "The service to act on")
+	cmd.AddPositionalValue(&replicas, "replicas", 2, true, "The number of replicas")
+
+	cmd.CommandUsed = Hook(func() error {
+		num, err := strconv.Atoi(replicas)
+		if err != nil {
+			return fmt.Errorf("invalid number of replicas %q, %v", replicas, err)
+		}
+
+		return service_public.Scale(service, part, num, service_internal.StartOrReloadOpts{
+			StopTimeout: stop_timeout,
+			TermTimeout: term_timeout,
+		})
+	})
+	return cmd
+}
+
+func cmd_service_history() *flaggy.Subcommand {
+	var service string
+
+	cmd := flaggy.NewSubcommand("history") // "SERVICE",
+	cmd.Description = "List the past revisions of a service"
+	cmd.AddPositionalValue(&service, "service", 1, true, "The service to act on")
+
+	cmd.CommandUsed = Hook(func() error {
+		return service_public.PrintHistory(service)
+	})
+	return cmd
+}
+
+func cmd_service_rollback() *flaggy.Subcommand {
+	var service, rev string
+	var clear, no_block bool
+	var background_flag, foreground_flag bool
+
+	cmd := flaggy.NewSubcommand("rollback") // "SERVICE", "REV"
+	cmd.Description = "Redeploy a past revision of a service (defaults to the previous one)"
+	cmd.Bool(&clear, "", "clear", "Stop using a past revision and redeploy the current service")
+	cmd.Bool(&background_flag, "", "background", "Perform the reload in background (via systemd, default when auto_restart)")
+	cmd.Bool(&foreground_flag, "", "foreground", "Perform the reload in foreground (does not involves systemd)")
+	cmd.Bool(&no_block, "n", "no-block", "Do not block while restarting")
+	cmd.AddPositionalValue(&service, "service", 1, true, "The service to act on")
+	cmd.AddPositionalValue(&rev, "rev", 2, false, "The revision number or service id (see history)")
+
+	cmd.CommandUsed = Hook(func() error {
+		if background_flag && foreground_flag {
+			return fmt.Errorf("Cannot specify both --background and --foreground flags")
+		}
+		if clear && rev != "" {
+			return fmt.Errorf("Cannot specify a revision with --clear")
+		}
+
+		return service_public.Rollback(service, rev, service_public.RollbackOpts{
+			Clear: clear,
+			Reload: service_public.ReloadOpts{
+				Foreground: foreground_flag,
+				Background: background_flag,
+				NoBlock:    no_block,
+			},
+		})
+	})
+	return cmd
+}
+
+func cmd_service_diff() *flaggy.Subcommand {
+	var service, depl string
+	var json_flag bool
+
+	cmd := flaggy.NewSubcommand("diff") // "SERVICE", "DEPLOYMENT"
+	cmd.Description = "Show what changed in the service since its deployments were created"
+	cmd.Bool(&json_flag, "", "json", "Show JSON output")
+	cmd.AddPositionalValue(&service, "service", 1, true, "The service to act on")
+	cmd.AddPositionalValue(&depl, "deployment", 2, false, "The deployment to compare (defaults to all the service deployments)")
+
+	cmd.CommandUsed = Hook(func() error {
+		return service_public.PrintDiff(service, service_public.DiffOpts{
+			Deployment: depl,
+			PrintJson:  json_flag,
+		})
+	})
+	return cmd
+}
+
+func cmd_service_validate() *flaggy.Subcommand {
+	var services []string
+	var json_flag bool
+
+	cmd := flaggy.NewSubcommand("validate") // "DIR..."
+	cmd.Description = "Validate service files (all services if none is specified)"
+	cmd.Bool(&json_flag, "", "json", "Show JSON output")
+	cmd.AddExtraValues(&services, "service", "The service directories, files or names to validate")
+
+	cmd.CommandUsed = Hook(func() error {
+		// Problems are reported on stdout
+		log.Default().SetOutput(io.Discard)
+
+		return service_public.ValidateServices(services, service_public.ValidateOpts{
+			PrintJson: json_flag,
+		})
+	})
+	return cmd
+}
+
+func cmd_service_schema() *flaggy.Subcommand {
+	cmd := flaggy.NewSubcommand("schema")
+	cmd.Description = "Print the JSON Schema of the service file"
+
+	cmd.CommandUsed = Hook(func() error {
+		return service_public.PrintSchema()
+	})
+	return cmd
+}
+
+func cmd_service_explain() *flaggy.Subcommand {
+	var service, key string
+	var json_flag bool
+
+	cmd := flaggy.NewSubcommand("explain") // "SERVICE", "KEY"
+	cmd.Description = "Show which file sets each setting of the service"
+	cmd.Bool(&json_flag, "", "json", "Show JSON output")
+	cmd.AddPositionalValue(&service, "service", 1, true, "The service to act on")
+	cmd.AddPositionalValue(&key, "key", 2, false, "The key to explain such as config.VAR or pods[NAME] (defaults to all keys)")
+
+	cmd.CommandUsed = Hook(func() error {
+		return service_public.Explain(service, key, service_public.ExplainOpts{
+			PrintJson: json_flag,
+		})
+	})
+	return cmd
+}
+
+func cmd_service_render() *flaggy.Subcommand {
+	var service string
+
+	cmd := flaggy.NewSubcommand("render") // "SERVICE"
+	cmd.Description = "Print the fully merged service configuration"
+	cmd.AddPositionalValue(&service, "service", 1, true, "The service to act on")
+
+	cmd.CommandUsed = Hook(func() error {
+		return service_public.Render(service)
+	})
+	return cmd
+}
+
 func cmd_service_restart() *flaggy.Subcommand {
 	var service string
 	var no_block bool
@@ -263,6 +470,12 @@ func cmd_service_deploy() *flaggy.Subcommand {
 	cmd.AddPositionalValue(&depl_name, "deployment-name", 2, false, "A deployment name")
 
 	cmd.CommandUsed = Hook(func() error {
+		l, err := service.LockServiceByName(service_def, "deploy")
+		if err != nil {
+			return err
+		}
+		defer func() { l.Unlock() }()
+
 		service, err := service.LoadServiceByName(service_def)
 		if err != nil {
 			return err
@@ -294,6 +507,9 @@ func cmd_service_deploy() *flaggy.Subcommand {
 			fmt.Printf("Deployment created in: %s\n", dir)
 		}
 
+		l.Unlock()
+		l = nil
+
 		if start {
 			fmt.Fprintf(os.Stderr, "+ systemctl %s start %s\n", dirs.SystemdModeFlag(), deployment.DeploymentUnit(depl_name))
 			cmd := exec.Command("systemctl", dirs.SystemdModeFlag(), "start", deployment.DeploymentUnit(depl_name))
@@ -312,6 +528,19 @@ func cmd_service_deploy() *flaggy.Subcommand {
 	return cmd
 }
 
+func cmd_service_lock_status() *flaggy.Subcommand {
+	var service_def string
+
+	cmd := flaggy.NewSubcommand("lock-status")
+	cmd.Description = "Show who holds the locks of the service and its deployments"
+	cmd.AddPositionalValue(&service_def, "service", 1, true, "The service to act on")
+
+	cmd.CommandUsed = Hook(func() error {
+		return service_public.PrintLockStatus(service_def)
+	})
+	return cmd
+}
+
 func cmd_service_inspect() *flaggy.Subcommand {
 	var args []string
 
@@ -533,48 +762,132 @@ func cmd_service_config_get() *flaggy.Subcommand {
 	return cmd
 }
 
+// Flags of the commands changing the service configuration
+type config_reload_flags struct {
+	no_reload, no_block, foreground, background bool
+}
+
+func (f *config_reload_flags) add(cmd *flaggy.Subcommand) {
+	cmd.Bool(&f.background, "", "background", "Perform the reload in background (via systemd, default when auto_restart)")
+	cmd.Bool(&f.foreground, "", "foreground", "Perform the reload in foreground (does not involves systemd)")
+	cmd.Bool(&f.no_reload, "n", "no-reload", "Do not reload service")
+	cmd.Bool(&f.no_block, "", "no-block", "Do not block while reloading")
+}
+
+func (f *config_reload_flags) check() error {
+	if f.background && f.foreground {
+		return fmt.Errorf("Cannot specify both --background and --foreground flags")
+	}
+	return nil
+}
+
+func (f *config_reload_flags) reload(service_descr string) error {
+	if f.no_reload {
+		return nil
+	}
+
+	return service_public.Reload(service_descr, service_public.ReloadOpts{
+		Foreground: f.foreground,
+		Background: f.background,
+		NoBlock:    f.no_block,
+	})
+}
+
+func parse_config_value(kind, value string) (*service.ConfigValue, error) {
+	switch kind {
+	case "", "string":
+		return &service.ConfigValue{Kind: service.ConfigValueString, Str: value}, nil
+	case "bool":
+		switch strings.ToLower(value) {
+		case "yes", "on":
+			value = "true"
+		case "no", "off":
+			value = "false"
+		}
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid boolean %q", value)
+		} else if b {
+			return &service.ConfigValue{Kind: service.ConfigValueTrue, Str: "true"}, nil
+		} else {
+			return &service.ConfigValue{Kind: service.ConfigValueFalse, Str: "false"}, nil
+		}
+	case "null":
+		if value != "" {
+			return nil, fmt.Errorf("null values cannot have a value, got %q", value)
+		}
+		return &service.ConfigValue{Kind: service.ConfigValueNull}, nil
+	default:
+		return nil, fmt.Errorf("invalid type %q, must be bool, null or string", kind)
+	}
+}
+
+func config_value_is(serv *service.Service, key string, value *service.ConfigValue) bool {
+	cur, ok := serv.Config[key]
+	if !ok {
+		return false
+	} else if cur == nil {
+		return value.Kind == service.ConfigValueNull
+	} else if cur.Kind != value.Kind {
+		return false
+	}
+	return serv.RawConfigValue(key) == value.Str
+}
+
 func cmd_service_config_set() *flaggy.Subcommand {
-	var service_descr, file_flag string
-	var no_reload_flag, no_block_flag, foreground_flag, background_flag bool
+	var service_descr, file_flag, type_flag string
+	var reload_flags config_reload_flags
 	var vars []string
 
 	cmd := flaggy.NewSubcommand("set") // "SERVICE [VAR=VAL...]",
 	cmd.Description = "Set service configuration variable"
 	cmd.String(&file_flag, "f", "file", "Write in this file instead of the service file")
-	cmd.Bool(&background_flag, "", "background", "Perform the reload in background (via systemd, default when auto_restart)")
-	cmd.Bool(&foreground_flag, "", "foreground", "Perform the reload in foreground (does not involves systemd)")
-	cmd.Bool(&no_reload_flag, "n", "no-reload", "Do not reload service")
-	cmd.Bool(&no_block_flag, "", "no-block", "Do not block while reloading")
+	cmd.String(&type_flag, "t", "type", "Type of the values: string (default), bool or null")
+	reload_flags.add(cmd)
 	cmd.AddPositionalValue(&service_descr, "service", 1, true, "The service to act on")
 	cmd.AddExtraValues(&vars, "VAR=VAL", "Variables to set")
 
 	cmd.CommandUsed = Hook(func() error {
-		if background_flag && foreground_flag {
-			return fmt.Errorf("Cannot specify both --background and --foreground flags")
+		if err := reload_flags.check(); err != nil {
+			return err
 		}
 
+		l, err := service.LockServiceByName(service_descr, "config set")
+		if err != nil {
+			return err
+		}
+		defer func() { l.Unlock() }()
+
 		serv, err := service.LoadServiceByName(service_descr)
 		if err != nil {
 			return err
 		}
 
+		if serv.Pin != nil {
+			return fmt.Errorf("service %s is pinned to revision %s, the configuration would not apply until the pin is removed with conductor service rollback --clear", serv.Name, serv.Pin.ServiceId)
+		}
+
 		filename := file_flag
 		if filename == "" {
 			filename = serv.ConfigSetFile
 		}
 
-		changed_args := map[string]string{}
+		changed_args := map[string]*service.ConfigValue{}
 		for i := 0; i < len(vars); i++ {
-			splits := strings.SplitN(vars[i], "=", 2)
-			if len(splits) < 2 {
+			key, value, found := strings.Cut(vars[i], "=")
+			if !found && type_flag != "null" {
 				continue
 			}
 
-			key, value := splits[0], splits[1]
-			if serv.Config[key].String() != value {
-				changed_args[key] = value
+			config_value, err := parse_config_value(type_flag, value)
+			if err != nil {
+				return fmt.Errorf("while setting %s, %v", key, err)
+			}
+
+			if !config_value_is(serv, key, config_value) {
+				changed_args[key] = config_value
 			} else {
-				fmt.Printf("Configuration %q is already at %q\n", key, value)
+				fmt.Printf("Configuration %q is already at %s\n", key, config_value_json(config_value))
 			}
 		}
 
@@ -597,18 +910,20 @@ func cmd_service_config_set() *flaggy.Subcommand {
 		// Check configuration has been applied
 		//
 
+		old_serv := serv
 		serv, err = service.LoadServiceByName(service_descr)
+		service_public.AuditConfig(audit.ActionConfigSet, old_serv, serv, filename, utils.SortedStringKeys(changed_args))
 		if err != nil {
 			return err
 		}
 
 		var failures []string
 		for k, v := range changed_args {
-			cfg, ok := serv.Config[k]
+			_, ok := serv.Config[k]
 			if !ok {
-				failures = append(failures, fmt.Sprintf("%q is unset, should be %q", k, v))
-			} else if cfg.String() != v {
-				failures = append(failures, fmt.Sprintf("%q is %q, should be %q", k, cfg.String(), v))
+				failures = append(failures, fmt.Sprintf("%q is unset, should be %s", k, config_value_json(v)))
+			} else if !config_value_is(serv, k, v) {
+				failures = append(failures, fmt.Sprintf("%q is %q, should be %s", k, serv.RawConfigValue(k), config_value_json(v)))
 			}
 		}
 		if len(failures) > 0 {
@@ -619,15 +934,183 @@ func cmd_service_config_set() *flaggy.Subcommand {
 		// reload service
 		//
 
-		if !no_reload_flag {
-			return service_public.Reload(service_descr, service_public.ReloadOpts{
-				Foreground: foreground_flag,
-				Background: background_flag,
-				NoBlock:    no_block_flag,
-			})
+		l.Unlock()
+		l = nil
+		return reload_flags.reload(service_descr)
+	})
+	return cmd
+}
+
+func config_value_json(value *service.ConfigValue) string {
+	data, err := value.MarshalJSON()
+	if err != nil {
+		return value.String()
+	}
+	return string(data)
+}
+
+func cmd_service_config_unset() *flaggy.Subcommand {
+	var service_descr, file_flag string
+	var reload_flags config_reload_flags
+	var vars []string
+
+	cmd := flaggy.NewSubcommand("unset") // "SERVICE [VAR...]",
+	cmd.Description = "Unset service configuration variable"
+	cmd.String(&file_flag, "f", "file", "Remove from this file instead of the service file")
+	reload_flags.add(cmd)
+	cmd.AddPositionalValue(&service_descr, "service", 1, true, "The service to act on")
+	cmd.AddExtraValues(&vars, "VAR", "Variables to unset")
+
+	cmd.CommandUsed = Hook(func() error {
+		if err := reload_flags.check(); err != nil {
+			return err
 		}
 
-		return nil
+		l, err := service.LockServiceByName(service_descr, "config unset")
+		if err != nil {
+			return err
+		}
+		defer func() { l.Unlock() }()
+
+		serv, err := service.LoadServiceByName(service_descr)
+		if err != nil {
+			return err
+		}
+
+		if serv.Pin != nil {
+			return fmt.Errorf("service %s is pinned to revision %s, the configuration would not apply until the pin is removed with conductor service rollback --clear", serv.Name, serv.Pin.ServiceId)
+		}
+
+		filename := file_flag
+		if filename == "" {
+			filename = serv.ConfigSetFile
+		}
+
+		var unset_vars []string
+		for _, key := range vars {
+			if _, ok := serv.Config[key]; ok {
+				unset_vars = append(unset_vars, key)
+			} else {
+				fmt.Printf("Configuration %q is not set\n", key)
+			}
+		}
+
+		if len(unset_vars) == 0 {
+			fmt.Printf("No configuration change detected. Do nothing.\n")
+			return nil
+		}
+
+		//
+		// Remove config
+		//
+
+		fmt.Printf("Update config in: %s\n", filename)
+		missing, err := service_public.ServiceUnsetConfig(filename, unset_vars)
+		if err != nil {
+			return err
+		}
+
+		for _, key := range missing {
+			if prov, ok := serv.Provenance["config."+key]; ok {
+				fmt.Printf("Configuration %q is not set in %s but at %s\n", key, filename, prov)
+			} else {
+				fmt.Printf("Configuration %q is not set in %s\n", key, filename)
+			}
+		}
+
+		removed := slices.DeleteFunc(slices.Clone(unset_vars), func(k string) bool {
+			return slices.Contains(missing, k)
+		})
+		if len(removed) == 0 {
+			return fmt.Errorf("Configuration update failed: no variable to unset in %s", filename)
+		}
+
+		//
+		// Check configuration has been applied
+		//
+
+		old_serv := serv
+		serv, err = service.LoadServiceByName(service_descr)
+		service_public.AuditConfig(audit.ActionConfigUnset, old_serv, serv, filename, removed)
+		if err != nil {
+			return err
+		}
+
+		var failures []string
+		for _, k := range removed {
+			if _, ok := serv.Config[k]; !ok {
+				continue
+			} else if prov, ok := serv.Provenance["config."+k]; ok {
+				failures = append(failures, fmt.Sprintf("%q is still set at %s", k, prov))
+			} else {
+				failures = append(failures, fmt.Sprintf("%q is still set", k))
+			}
+		}
+		if len(failures) > 0 {
+			return fmt.Errorf("Configuration update failed: %v (set it to null to hide an inherited value)", strings.Join(failures, ", "))
+		}
+
+		//
+		// reload service
+		//
+
+		l.Unlock()
+		l = nil
+		return reload_flags.reload(service_descr)
+	})
+	return cmd
+}
+
+func cmd_service_config_edit() *flaggy.Subcommand {
+	var service_descr, file_flag string
+	var reload_flags config_reload_flags
+
+	cmd := flaggy.NewSubcommand("edit") // "SERVICE",
+	cmd.Description = "Edit service configuration with $EDITOR, validated before it is saved"
+	cmd.String(&file_flag, "f", "file", "Edit this file instead of the service file")
+	reload_flags.add(cmd)
+	cmd.AddPositionalValue(&service_descr, "service", 1, true, "The service to act on")
+
+	cmd.CommandUsed = Hook(func() error {
+		if err := reload_flags.check(); err != nil {
+			return err
+		}
+
+		l, err := service.LockServiceByName(service_descr, "config edit")
+		if err != nil {
+			return err
+		}
+		defer func() { l.Unlock() }()
+
+		serv, err := service.LoadServiceByName(service_descr)
+		if err != nil {
+			return err
+		}
+
+		filename := file_flag
+		if filename == "" {
+			filename = serv.ConfigSetFile
+		}
+
+		changed, err := service_public.ServiceEditConfig(context.Background(), serv.FileName, filename)
+		if err != nil {
+			return err
+		} else if !changed {
+			fmt.Printf("No configuration change detected. Do nothing.\n")
+			return nil
+		}
+
+		fmt.Printf("Updated config in: %s\n", filename)
+
+		new_serv, err := service.LoadServiceByName(service_descr)
+		service_public.AuditConfig(audit.ActionConfigEdit, serv, new_serv, filename, nil)
+		if err != nil {
+			return err
+		}
+
+		l.Unlock()
+		l = nil
+		return reload_flags.reload(service_descr)
 	})
 	return cmd
 }
@@ -638,6 +1121,8 @@ func cmd_service_config() *flaggy.Subcommand {
 	cmd.AttachSubcommand(cmd_service_config_ls(), 1)
 	cmd.AttachSubcommand(cmd_service_config_get(), 1)
 	cmd.AttachSubcommand(cmd_service_config_set(), 1)
+	cmd.AttachSubcommand(cmd_service_config_unset(), 1)
+	cmd.AttachSubcommand(cmd_service_config_edit(), 1)
 	cmd.RequireSubcommand = true
 	return cmd
 }
@@ -655,7 +1140,7 @@ func cmd_service_env() *flaggy.Subcommand {
 			return err
 		}
 
-		for _, v := range service.Vars() {
+		for _, v := range service.MaskedVars() {
 			fmt.Printf("%s\n", v)
 		}
 
@@ -674,8 +1159,20 @@ func cmd_service() *flaggy.Subcommand {
 	cmd.AttachSubcommand(cmd_service_disable(), 1)
 	cmd.AttachSubcommand(cmd_service_reload(), 1)
 	cmd.AttachSubcommand(cmd_service_rolling_restart(), 1)
+	cmd.AttachSubcommand(cmd_service_promote(), 1)
+	cmd.AttachSubcommand(cmd_service_abort(), 1)
+	cmd.AttachSubcommand(cmd_service_scale(), 1)
+	cmd.AttachSubcommand(cmd_service_reset_failed(), 1)
+	cmd.AttachSubcommand(cmd_service_history(), 1)
+	cmd.AttachSubcommand(cmd_service_rollback(), 1)
+	cmd.AttachSubcommand(cmd_service_diff(), 1)
+	cmd.AttachSubcommand(cmd_service_validate(), 1)
+	cmd.AttachSubcommand(cmd_service_schema(), 1)
+	cmd.AttachSubcommand(cmd_service_explain(), 1)
+	cmd.AttachSubcommand(cmd_service_render(), 1)
 	cmd.AttachSubcommand(cmd_service_restart(), 1)
 	cmd.AttachSubcommand(cmd_service_deploy(), 1)
+	cmd.AttachSubcommand(cmd_service_lock_status(), 1)
 	cmd.AttachSubcommand(cmd_service_inspect(), 1)
 	cmd.AttachSubcommand(cmd_service_ls(), 1)
 	cmd.AttachSubcommand(cmd_service_show("show"), 1)
@@ -0,0 +1,282 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mildred/conductor.go/src/deployment"
+	"github.com/mildred/conductor.go/src/deployment_util"
+	"github.com/mildred/conductor.go/src/service_public"
+	"github.com/mildred/conductor.go/src/service_util"
+	"github.com/mildred/conductor.go/src/utils"
+
+	. "github.com/mildred/conductor.go/src/service"
+)
+
+const ExitStatusTrailer = "Conductor-Exit-Status"
+
+// Body of a command request
+type CommandRequest struct {
+	Args       []string `json:"args"`
+	Deployment string   `json:"deployment,omitempty"`
+}
+
+type httpError struct {
+	status int
+	err    error
+}
+
+func (e *httpError) Error() string {
+	return e.err.Error()
+}
+
+func httpErrorf(status int, format string, args ...interface{}) error {
+	return &httpError{status, fmt.Errorf(format, args...)}
+}
+
+// Find the running service from its APP.INSTANCE name
+func findService(ctx context.Context, app_instance string) (*Service, error) {
+	sd, err := utils.NewSystemdClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer sd.Close()
+
+	units, err := sd.ListUnitsByPatternsContext(ctx, nil, []string{"conductor-service@*.service"})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, u := range units {
+		service_dir := ServiceDirFromUnit(u.Name)
+		if service_dir == "" {
+			continue
+		}
+
+		service, err := LoadServiceDir(service_dir)
+		if err != nil {
+			log.Printf("Cannot load %s: %v", service_dir, err)
+			continue
+		}
+
+		if service.AppName+"."+service.InstanceName == app_instance {
+			return service, nil
+		}
+	}
+
+	return nil, httpErrorf(http.StatusNotFound, "service %s not found", app_instance)
+}
+
+func samePolicies(a, b []string) bool {
+	a = slices.Clone(a)
+	b = slices.Clone(b)
+	slices.Sort(a)
+	slices.Sort(b)
+	return slices.Equal(slices.Compact(a), slices.Compact(b))
+}
+
+// Prepare the command for the service, deployment or any active deployment
+// depending on the command scope
+func prepareCommand(ctx context.Context, app_instance, cmd_name string, body *CommandRequest) (*exec.Cmd, error) {
+	service, err := findService(ctx, app_instance)
+	if err != nil {
+		return nil, err
+	}
+
+	command := service.Commands[cmd_name]
+	if command == nil || command.HTTP == nil {
+		return nil, httpErrorf(http.StatusNotFound, "command %s is not exposed over HTTP", cmd_name)
+	}
+
+	switch {
+	case body.Deployment != "":
+		deployments, err := deployment_util.List(deployment_util.ListOpts{
+			FilterServiceDir:     service.BasePath,
+			FilterDeploymentName: body.Deployment,
+		})
+		if err != nil {
+			return nil, err
+		} else if len(deployments) == 0 {
+			return nil, httpErrorf(http.StatusNotFound, "deployment %s not found for %s", body.Deployment, app_instance)
+		}
+
+		depl := deployments[0]
+		depl_command := depl.Commands[cmd_name]
+		if depl_command == nil || !depl_command.Deployment {
+			return nil, httpErrorf(http.StatusBadRequest, "command %s does not run on deployments", cmd_name)
+		} else if depl_command.HTTP == nil || !samePolicies(depl_command.HTTP.Policies, command.HTTP.Policies) {
+			// The request was authorised by the policies of the service
+			// command, the deployment command must be exposed the same way
+			return nil, httpErrorf(http.StatusForbidden, "command %s is not exposed over HTTP with the same policies on deployment %s", cmd_name, depl.DeploymentName)
+		}
+
+		return service_util.PrepareCommand(depl_command, depl.Service, deployment.DeploymentDirByNameOnly(depl.DeploymentName), depl.Vars(), cmd_name, body.Args...)
+
+	case command.Service:
+		return service_util.PrepareCommand(command, service, service.BasePath, service.Vars(), cmd_name, body.Args...)
+
+	case command.ServiceAnyDeployment:
+		depl, err := service_public.FindActiveDeployment(service, false)
+		if err != nil {
+			return nil, httpErrorf(http.StatusServiceUnavailable, "%v", err)
+		}
+
+		return service_util.PrepareCommand(command, depl.Service, deployment.DeploymentDirByNameOnly(depl.DeploymentName), depl.Vars(), cmd_name, body.Args...)
+
+	default:
+		return nil, httpErrorf(http.StatusBadRequest, "command %s requires a deployment", cmd_name)
+	}
+}
+
+// Run a command for a request on /cmd/APP.INSTANCE/NAME and stream its output
+func handleCommand(w http.ResponseWriter, req *http.Request) error {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		return httpErrorf(http.StatusMethodNotAllowed, "method %s not allowed", req.Method)
+	}
+
+	path, _ := strings.CutPrefix(req.URL.Path, "/cmd/")
+	app_instance, cmd_name, found := strings.Cut(path, "/")
+	if !found || app_instance == "" || cmd_name == "" || strings.Contains(cmd_name, "/") {
+		return httpErrorf(http.StatusNotFound, "invalid command path %s", req.URL.Path)
+	}
+
+	var body CommandRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 1024*1024)).Decode(&body)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return httpErrorf(http.StatusBadRequest, "while decoding the request body, %v", err)
+	}
+
+	cmd, err := prepareCommand(req.Context(), app_instance, cmd_name, &body)
+	if err != nil {
+		return err
+	}
+
+	sse := strings.Contains(req.Header.Get("Accept"), "text/event-stream")
+	out := &streamWriter{w: w, sse: sse}
+	cmd.Stdin = nil
+	cmd.Stdout = out.Stream("stdout")
+	cmd.Stderr = out.Stream("stderr")
+
+	// Set the headers before the output can be written
+	w.Header().Set("Trailer", ExitStatusTrailer)
+	if sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	err = cmd.Start()
+	if err != nil {
+		return fmt.Errorf("while starting command %s, %v", cmd_name, err)
+	}
+
+	log.Printf("Running command %s for %s (pid %d)", cmd_name, app_instance, cmd.Process.Pid)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-req.Context().Done():
+			cmd.Process.Kill()
+		case <-done:
+		}
+	}()
+
+	out.Start()
+
+	status := 0
+	err = cmd.Wait()
+	if exit_err, ok := err.(*exec.ExitError); ok {
+		status = exit_err.ExitCode()
+	} else if err != nil {
+		log.Printf("ERROR running command %s for %s: %v", cmd_name, app_instance, err)
+		status = -1
+	}
+
+	log.Printf("Command %s for %s exited with status %d", cmd_name, app_instance, status)
+
+	if sse {
+		out.Event("exit", []byte(strconv.Itoa(status)))
+	}
+	w.Header().Set(ExitStatusTrailer, strconv.Itoa(status))
+	return nil
+}
+
+// Write the command output to the response, either as is or as server-sent
+// events named after the stream
+type streamWriter struct {
+	mu      sync.Mutex
+	w       http.ResponseWriter
+	sse     bool
+	started bool
+}
+
+func (s *streamWriter) flush() {
+	if flusher, ok := s.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Send the headers unless the command already wrote some output
+func (s *streamWriter) Start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.started {
+		s.w.WriteHeader(http.StatusOK)
+		s.started = true
+	}
+	s.flush()
+}
+
+func (s *streamWriter) Event(event string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var err error
+	if s.sse {
+		var buf strings.Builder
+		fmt.Fprintf(&buf, "event: %s\n", event)
+		for _, line := range strings.Split(string(data), "\n") {
+			fmt.Fprintf(&buf, "data: %s\n", line)
+		}
+		buf.WriteString("\n")
+		_, err = io.WriteString(s.w, buf.String())
+	} else {
+		_, err = s.w.Write(data)
+	}
+
+	s.started = true
+	s.flush()
+	return err
+}
+
+func (s *streamWriter) Stream(event string) io.Writer {
+	return streamEvent{s, event}
+}
+
+type streamEvent struct {
+	s     *streamWriter
+	event string
+}
+
+func (e streamEvent) Write(p []byte) (int, error) {
+	err := e.s.Event(e.event, p)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
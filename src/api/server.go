@@ -2,11 +2,12 @@ package api
 
 import (
 	"context"
-	"fmt"
+	"errors"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -26,11 +27,26 @@ func RunServer() error {
 		},
 	}
 
-	return server.ServeIdle(0)
+	err := server.ServeIdle(0)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
 }
 
-func handleRequest(w http.ResponseWriter, r *http.Request) {
-	log.Printf("Request handled")
-	w.Header().Set("X-Hello", "World")
-	fmt.Fprintf(w, "Hello, World! (sdactivated)")
+func handleRequest(w http.ResponseWriter, req *http.Request) {
+	var err error
+	if strings.HasPrefix(req.URL.Path, "/cmd/") {
+		err = handleCommand(w, req)
+	} else {
+		err = httpErrorf(http.StatusNotFound, "Not Found")
+	}
+
+	var http_err *httpError
+	if errors.As(err, &http_err) {
+		http.Error(w, http_err.Error(), http_err.status)
+	} else if err != nil {
+		log.Printf("ERROR %s %s: %v", req.Method, req.URL.Path, err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+	}
 }
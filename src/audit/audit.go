@@ -0,0 +1,147 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"path"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/mildred/conductor.go/src/dirs"
+)
+
+// The audit log is an append-only JSON-lines file recording the changes made
+// to service files and policies. Writers hold an exclusive lock on the file so
+// that concurrent entries do not interleave.
+
+var LogFile = dirs.Join(dirs.SelfStateHome, "audit.jsonl")
+
+const (
+	ActionConfigSet    = "config-set"
+	ActionConfigUnset  = "config-unset"
+	ActionConfigEdit   = "config-edit"
+	ActionEnable       = "enable"
+	ActionDisable      = "disable"
+	ActionScale        = "scale"
+	ActionPolicyCreate = "policy-create"
+	ActionPolicyUpdate = "policy-update"
+)
+
+type Change struct {
+	Key string          `json:"key"`
+	Old json.RawMessage `json:"old"` // null if unset
+	New json.RawMessage `json:"new"` // null if unset
+}
+
+type Entry struct {
+	Time       time.Time `json:"time"`
+	Uid        int       `json:"uid"`
+	User       string    `json:"user"`
+	SudoUser   string    `json:"sudo_user,omitempty"`
+	Action     string    `json:"action"`
+	Service    string    `json:"service,omitempty"`
+	ServiceDir string    `json:"service_dir,omitempty"`
+	Policy     string    `json:"policy,omitempty"`
+	File       string    `json:"file"`
+	Changes    []*Change `json:"changes,omitempty"`
+	ServiceId  string    `json:"service_id,omitempty"` // Service id after the change
+}
+
+// Return the JSON value, or null for nil
+func Value(v interface{}) json.RawMessage {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return json.RawMessage(strconv.Quote(err.Error()))
+	}
+	return data
+}
+
+func (c *Change) String() string {
+	var old, new = string(c.Old), string(c.New)
+	if old == "" {
+		old = "null"
+	}
+	if new == "" {
+		new = "null"
+	}
+	return fmt.Sprintf("%s: %s -> %s", c.Key, old, new)
+}
+
+// Return who is making the change
+func (e *Entry) Who() string {
+	if e.SudoUser != "" {
+		return fmt.Sprintf("%s (%s)", e.SudoUser, e.User)
+	}
+	return e.User
+}
+
+// Append the entry to the audit log, the time and user are filled in
+func Record(entry *Entry) error {
+	entry.Time = time.Now()
+	entry.Uid = os.Getuid()
+	entry.User = strconv.Itoa(entry.Uid)
+	if u, err := user.LookupId(entry.User); err == nil {
+		entry.User = u.Username
+	}
+	entry.SudoUser = os.Getenv("SUDO_USER")
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(path.Dir(LogFile), 0755)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(LogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		return fmt.Errorf("while locking %s, %v", LogFile, err)
+	}
+	defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+// Read the audit log entries, oldest first
+func Read() ([]*Entry, error) {
+	f, err := os.Open(LogFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_SH)
+	if err != nil {
+		return nil, fmt.Errorf("while locking %s, %v", LogFile, err)
+	}
+	defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+
+	var entries []*Entry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var entry Entry
+		err = json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", LogFile, line, err)
+		}
+		entries = append(entries, &entry)
+	}
+
+	return entries, scanner.Err()
+}
@@ -0,0 +1,127 @@
+package caddy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+)
+
+// Return the location of the reverse_proxy handler owning the upstreams
+func handlerPath(upstreams_path string) (string, error) {
+	handler, found := strings.CutSuffix(strings.TrimSuffix(upstreams_path, "/"), "/upstreams")
+	if !found {
+		return "", fmt.Errorf("cannot find reverse_proxy handler for upstreams %s, must end with /upstreams", upstreams_path)
+	}
+	return handler, nil
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// Set the weighted_round_robin selection policy on the reverse_proxy handler
+// owning the upstreams at upstreams_path. The upstreams matching the dial
+// addresses get percent of the traffic in total and the other upstreams the
+// remaining traffic, evenly split within each group.
+func (client *CaddyClient) SetUpstreamWeights(ctx context.Context, upstreams_path string, dials []string, percent int) error {
+	handler, err := handlerPath(upstreams_path)
+	if err != nil {
+		return err
+	}
+
+	res, data, present, _, err := client.getConfig(ctx, handler+"/upstreams")
+	if err != nil {
+		return err
+	} else if !present {
+		return fmt.Errorf("cannot find upstreams at %s: %s", upstreams_path, res.Status)
+	}
+
+	var upstreams []struct {
+		Dial string `json:"dial"`
+	}
+	err = json.Unmarshal(data, &upstreams)
+	if err != nil {
+		return fmt.Errorf("cannot unmarshal upstreams at %s, %v", upstreams_path, err)
+	}
+
+	var num_selected = 0
+	for _, upstream := range upstreams {
+		if slices.Contains(dials, upstream.Dial) {
+			num_selected++
+		}
+	}
+	num_others := len(upstreams) - num_selected
+
+	// Each group weight is divided by the number of upstreams in the group by
+	// multiplying it by the number of upstreams in the other group
+	selected_weight, others_weight := percent, 100-percent
+	if num_selected > 0 && num_others > 0 {
+		selected_weight *= num_others
+		others_weight *= num_selected
+		if d := gcd(selected_weight, others_weight); d > 1 {
+			selected_weight /= d
+			others_weight /= d
+		}
+	}
+
+	var upstream_weights []int
+	for _, upstream := range upstreams {
+		if slices.Contains(dials, upstream.Dial) {
+			upstream_weights = append(upstream_weights, selected_weight)
+		} else {
+			upstream_weights = append(upstream_weights, others_weight)
+		}
+	}
+
+	policy, err := json.Marshal(map[string]interface{}{
+		"policy":  "weighted_round_robin",
+		"weights": upstream_weights,
+	})
+	if err != nil {
+		return err
+	}
+
+	for {
+		_, lb, present, etag, err := client.getConfig(ctx, handler+"/load_balancing")
+		if err != nil {
+			return err
+		}
+
+		var retry bool
+		if present && string(lb) != "null\n" && string(lb) != "null" {
+			res, retry, err = client.postConfig(ctx, etag, handler+"/load_balancing/selection_policy", policy)
+		} else {
+			res, retry, err = client.postConfig(ctx, etag, handler+"/load_balancing", json.RawMessage(`{"selection_policy":`+string(policy)+`}`))
+		}
+		if res != nil {
+			log.Printf("caddy: POST /id/%s/load_balancing (weights %v): %v\n", handler, upstream_weights, res.Status)
+		}
+		if err != nil {
+			return err
+		}
+		if retry {
+			continue
+		}
+		return nil
+	}
+}
+
+// Remove the selection policy set by SetUpstreamWeights
+func (client *CaddyClient) ResetUpstreamWeights(ctx context.Context, upstreams_path string) error {
+	handler, err := handlerPath(upstreams_path)
+	if err != nil {
+		return err
+	}
+
+	res, _, err := client.deleteConfig(ctx, "", handler+"/load_balancing/selection_policy")
+	if res != nil {
+		log.Printf("caddy: DELETE /id/%s/load_balancing/selection_policy: %v\n", handler, res.Status)
+	}
+	return err
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"os/exec"
 
 	"github.com/mildred/conductor.go/src/caddy"
 	"github.com/mildred/conductor.go/src/service"
@@ -42,3 +43,14 @@ func (f *DeploymentFunction) ProxyConfig(ctx context.Context, depl *Deployment)
 
 	return result, nil
 }
+
+// Return the command executing the function with the deployment variables
+func (f *DeploymentFunction) Command(ctx context.Context, depl *Deployment) (*exec.Cmd, error) {
+	if len(f.Exec) < 1 {
+		return nil, fmt.Errorf("Missing executable")
+	}
+
+	cmd := exec.CommandContext(ctx, f.Exec[0], f.Exec[1:]...)
+	cmd.Env = append(cmd.Environ(), depl.Vars()...)
+	return cmd, nil
+}
@@ -0,0 +1,107 @@
+package deployment
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/mildred/conductor.go/src/service"
+)
+
+// Run a single probe of the health check against the deployment pod
+func (pod *DeploymentPod) Probe(ctx context.Context, depl *Deployment, check *service.HealthCheck) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(check.Timeout))
+	defer cancel()
+
+	// Pods reached by their sockets may have no IP address, do not probe the
+	// port on the host instead
+	if (check.HTTP != nil || check.TCP != nil) && pod.IPAddress == "" {
+		return fmt.Errorf("%s health check requires the pod IP address, the pod has none: use an exec health check", check)
+	}
+
+	if check.HTTP != nil {
+		url := fmt.Sprintf("%s://%s:%d%s", check.HTTP.Scheme, pod.IPAddress, check.HTTP.Port, check.HTTP.Path)
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return err
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		io.Copy(io.Discard, res.Body)
+
+		if res.StatusCode < 200 || res.StatusCode >= 400 {
+			return fmt.Errorf("GET %s returned %s", url, res.Status)
+		}
+		return nil
+
+	} else if check.TCP != nil {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", fmt.Sprintf("%s:%d", pod.IPAddress, check.TCP.Port))
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+
+	} else if check.Exec != nil {
+		container := depl.PodName
+		if check.Exec.Container != "" {
+			container = fmt.Sprintf("%s-%s", depl.PodName, check.Exec.Container)
+		}
+		args := append([]string{"exec", container}, check.Exec.Command...)
+		out, err := exec.CommandContext(ctx, "podman", args...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("podman exec %s %q failed: %v (%s)", container, check.Exec.Command, err, strings.TrimSpace(string(out)))
+		}
+		return nil
+
+	} else {
+		return fmt.Errorf("empty health check")
+	}
+}
+
+// Wait until the health check passes for the required number of consecutive
+// times, or until the start timeout is reached. The returned error contains a
+// diagnostic of the last failures.
+func (pod *DeploymentPod) WaitHealthy(ctx context.Context, depl *Deployment, check *service.HealthCheck) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(check.StartTimeout))
+	defer cancel()
+
+	var successes = 0
+	var attempts = 0
+	var last_errors []string
+
+	for {
+		attempts += 1
+		err := pod.Probe(ctx, depl, check)
+		if err == nil {
+			successes += 1
+			log.Printf("health: %s passed (%d/%d)", check, successes, check.SuccessThreshold)
+			if successes >= check.SuccessThreshold {
+				return nil
+			}
+		} else {
+			successes = 0
+			log.Printf("health: %s failed: %v", check, err)
+			last_errors = append(last_errors, err.Error())
+			if len(last_errors) > 3 {
+				last_errors = last_errors[len(last_errors)-3:]
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("health check %s did not pass after %d attempts in %v, last errors: %s", check, attempts, time.Duration(check.StartTimeout), strings.Join(last_errors, "; "))
+		case <-time.After(time.Duration(check.Interval)):
+		}
+	}
+}
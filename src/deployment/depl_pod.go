@@ -18,13 +18,13 @@ type DeploymentPod struct {
 
 func (pod *DeploymentPod) TemplatePod(ctx context.Context, depl *Deployment) error {
 	log.Printf("prepare: Templating the pod\n")
-	res, err := tmpl.RunTemplate(ctx, pod.PodTemplate, depl.Vars())
+	res, err := tmpl.RunTemplate(ctx, pod.PodTemplate, depl.Vars(), depl.TemplateOptions())
 	if err != nil {
 		return err
 	}
 	depl.TemplatedPod = res
 
-	res, err = tmpl.RunTemplate(ctx, pod.ConfigMapTemplate, depl.Vars())
+	res, err = tmpl.RunTemplate(ctx, pod.ConfigMapTemplate, depl.Vars(), depl.TemplateOptions())
 	if err != nil {
 		return err
 	}
@@ -45,10 +45,9 @@ func (pod *DeploymentPod) ProxyConfig(depl *Deployment) (caddy.ConfigItems, erro
 			continue
 		}
 
-		config_id := pod.CaddyConfigName(depl.Service, reverse.Name)
 		config, err := json.Marshal(map[string]interface{}{
-			"@id":  config_id + ".upstream",
-			"dial": fmt.Sprintf("%s:%d", pod.IPAddress, reverse.Port),
+			"@id":  pod.UpstreamId(depl.Service, reverse.Name, depl.DeploymentName),
+			"dial": pod.Dial(depl, reverse),
 		})
 		if err != nil {
 			return nil, err
@@ -62,3 +61,29 @@ func (pod *DeploymentPod) ProxyConfig(depl *Deployment) (caddy.ConfigItems, erro
 
 	return result, nil
 }
+
+// Return the upstream dial address of a reverse proxy: the activator socket for
+// scale-to-zero pods, the pod socket if the proxy names one or else the pod IP
+// address and port
+func (pod *DeploymentPod) Dial(depl *Deployment, proxy service.ServicePodProxyConfig) string {
+	if pod.IdleTimeout > 0 {
+		return "unix/" + DeploymentActivatorSocketPath(depl.DeploymentName, proxy.Name)
+	} else if socket := pod.FindSocket(proxy.Socket); proxy.Socket != "" && socket != nil {
+		return DeploymentPodSocketDial(depl.DeploymentName, socket)
+	}
+	return fmt.Sprintf("%s:%d", pod.IPAddress, proxy.Port)
+}
+
+// Return true if all the reverse proxies dial pod sockets and the pod IP
+// address is not needed to reach the pod
+func (pod *DeploymentPod) ReachedBySockets() bool {
+	if len(pod.Sockets) == 0 {
+		return false
+	}
+	for _, proxy := range pod.ProvidedReverseProxy {
+		if proxy.UpstreamsPath != "" && proxy.Socket == "" {
+			return false
+		}
+	}
+	return true
+}
@@ -6,10 +6,12 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
+	"slices"
 	"strings"
 	"time"
 
@@ -21,6 +23,7 @@ import (
 )
 
 const ConfigName = "conductor-deployment.json"
+const FailedName = "conductor-deployment.failed"
 
 var DeploymentRunDir = dirs.Join(dirs.SelfRuntimeDir, "deployments")
 
@@ -48,6 +51,61 @@ func DeploymentSocketPath(name string) string {
 	return path.Join(DeploymentRunDir, name, "stream.socket")
 }
 
+func DeploymentPodSocketUnit(name, socket string) string {
+	return fmt.Sprintf("conductor-deployment-%s.%s.socket", name, socket)
+}
+
+// Return the pod socket units written for a deployment, found from the unit
+// files so that it works without the deployment configuration
+func DeploymentPodSocketUnits(name string) ([]string, error) {
+	prefix := fmt.Sprintf("conductor-deployment-%s.", name)
+	files, err := filepath.Glob(dirs.Join(dirs.RuntimeDir, "systemd", dirs.SystemdMode(), prefix+"*.socket"))
+	if err != nil {
+		return nil, err
+	}
+
+	var units []string
+	for _, file := range files {
+		unit := filepath.Base(file)
+		socket := strings.TrimSuffix(strings.TrimPrefix(unit, prefix), ".socket")
+		if !strings.Contains(socket, ".") {
+			units = append(units, unit)
+		}
+	}
+	return units, nil
+}
+
+// Return the socket the activator of a scale-to-zero pod listens to for a
+// reverse proxy
+func DeploymentActivatorSocketPath(name, proxy string) string {
+	return path.Join(DeploymentRunDir, name, "activator-"+proxy+".sock")
+}
+
+// Return the ListenStream address of a pod socket
+func DeploymentPodSocketListen(name string, socket *service.PodSocket) string {
+	if socket.Listen == "" {
+		return path.Join(DeploymentRunDir, name, socket.Name+".sock")
+	}
+	return socket.Listen
+}
+
+// Return the Caddy dial address of a pod socket
+func DeploymentPodSocketDial(name string, socket *service.PodSocket) string {
+	listen := DeploymentPodSocketListen(name, socket)
+	if socket.IsUnix() {
+		return "unix/" + listen
+	}
+
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		host, port = "", listen
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port)
+}
+
 func DeploymentDirByName(name string, allow_dir bool) (string, string, error) {
 	if allow_dir && (strings.Contains(name, "/") || name == ".") {
 		depl_dir, err := filepath.Abs(name)
@@ -70,6 +128,7 @@ type Deployment struct {
 	PartName             string              `json:"part_name"`
 	PartId               string              `json:"part_id"`
 	PodName              string              `json:"pod_name"`
+	SecretHashes         map[string]string   `json:"secret_hashes,omitempty"` // Keyed hashes of the secrets when the deployment was created
 	TemplatedPod         string              `json:"templated_pod"`
 	TemplatedConfigMap   string              `json:"templated_config_map"`
 	TemplatedProxyConfig json.RawMessage     `json:"templated_proxy_config"`
@@ -151,6 +210,11 @@ func ReadDeployment(dir, deployment_id string) (*Deployment, error) {
 
 		depl := NewDeploymentFromService(service, deployment_id, seed)
 
+		depl.SecretHashes, err = service.ComputeSecretHashes()
+		if err != nil {
+			return nil, err
+		}
+
 		return depl, nil
 	} else {
 		return LoadDeployment(path.Join(dir, ConfigName))
@@ -164,7 +228,7 @@ func (depl *Deployment) TemplateProxyConfig(ctx context.Context) error {
 	}
 
 	log.Printf("prepare: Templating the proxy config\n")
-	res, err := tmpl.RunTemplate(ctx, depl.ProxyConfigTemplate, depl.Vars())
+	res, err := tmpl.RunTemplate(ctx, depl.ProxyConfigTemplate, depl.Vars(), depl.TemplateOptions())
 	if err != nil {
 		return err
 	}
@@ -216,7 +280,7 @@ func (depl *Deployment) ProxyConfig(ctx context.Context) (caddy.ConfigItems, err
 
 	if depl.ProxyConfigTemplate != "" {
 		var c caddy.ConfigItems
-		err := tmpl.RunTemplateJSON(ctx, depl.ProxyConfigTemplate, depl.Vars(), &c)
+		err := tmpl.RunTemplateJSON(ctx, depl.ProxyConfigTemplate, depl.Vars(), depl.TemplateOptions(), &c)
 		if err != nil {
 			return nil, fmt.Errorf("while running the proxy-config template, %v", err)
 		}
@@ -232,7 +296,26 @@ func (depl *Deployment) ProxyConfig(ctx context.Context) (caddy.ConfigItems, err
 	return configs, nil
 }
 
+// Options for templates run in the context of the deployment
+func (depl *Deployment) TemplateOptions() *tmpl.Options {
+	opts := depl.Service.PartTemplateOptions(depl.PartName)
+	opts.Data["Deployment"] = depl
+	opts.Data["Pod"] = depl.Pod
+	opts.Data["Function"] = depl.Function
+	return opts
+}
+
+// Variables for templates, hooks and commands, secrets are read
 func (depl *Deployment) Vars() []string {
+	return depl.vars(false)
+}
+
+// Variables for display, secrets are masked
+func (depl *Deployment) MaskedVars() []string {
+	return depl.vars(true)
+}
+
+func (depl *Deployment) vars(masked bool) []string {
 	var excluded []string = nil
 	if depl.Pod != nil {
 		excluded = depl.Pod.ExcludeVars
@@ -240,7 +323,14 @@ func (depl *Deployment) Vars() []string {
 		excluded = depl.Function.ExcludeVars
 	}
 
-	var vars []string = append(depl.Service.VarsExcluding(excluded),
+	var service_vars []string
+	if masked {
+		service_vars = depl.Service.MaskedVarsExcluding(excluded)
+	} else {
+		service_vars = depl.Service.VarsExcluding(excluded)
+	}
+
+	var vars []string = append(service_vars,
 		"CONDUCTOR_SERVICE_PART="+depl.PartName,
 		"CONDUCTOR_DEPLOYMENT="+depl.DeploymentName,
 		"CONDUCTOR_DEPLOYMENT_SERVICE_ID="+depl.ServiceId,
@@ -322,7 +412,11 @@ func LoadDeployment(fname string) (*Deployment, error) {
 	return res, err
 }
 
-func (depl *Deployment) StartStopPod(start bool, dir string) error {
+// Start or stop the pod. When starting, the listeners are passed to podman
+// kube play using the LISTEN_FDS protocol. Podman documents the socket
+// activation passthrough for podman run only, CheckPodListenFds tells if the
+// fds reached a container.
+func (depl *Deployment) StartStopPod(start bool, dir string, listeners []*os.File) error {
 	var configmap_flag string
 	if depl.TemplatedConfigMap != "" {
 		err := os.WriteFile(path.Join(dir, "configmap.yml"), []byte(depl.TemplatedConfigMap), 0644)
@@ -351,17 +445,89 @@ func (depl *Deployment) StartStopPod(start bool, dir string) error {
 		args = utils.Compact("kube", "down",
 			path.Join(dir, "pod.yml"))
 	}
-	fmt.Fprintf(os.Stderr, "+ podman %q\n", args)
-	cmd := exec.Command("podman", args...)
+	var cmd *exec.Cmd
+	if start && len(listeners) > 0 {
+		var names []string
+		for _, f := range listeners {
+			names = append(names, f.Name())
+		}
+
+		// LISTEN_PID must be the pid of podman, set it from a shell that
+		// execs podman
+		fmt.Fprintf(os.Stderr, "+ LISTEN_FDS=%d LISTEN_FDNAMES=%s podman %q\n", len(listeners), strings.Join(names, ":"), args)
+		cmd = exec.Command("/bin/sh", append([]string{"-c", `LISTEN_PID=$$ exec podman "$@"`, "podman"}, args...)...)
+		cmd.Env = append(os.Environ(),
+			fmt.Sprintf("LISTEN_FDS=%d", len(listeners)),
+			"LISTEN_FDNAMES="+strings.Join(names, ":"))
+		cmd.ExtraFiles = listeners
+	} else {
+		fmt.Fprintf(os.Stderr, "+ podman %q\n", args)
+		cmd = exec.Command("podman", args...)
+	}
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	return cmd.Run()
 }
 
+// Return the containers of the pod that received the socket activation fds,
+// or an error if none did: podman kube play does not forward them with all
+// podman versions and nobody would accept on the pod sockets.
+func (depl *Deployment) CheckPodListenFds(num int) ([]string, error) {
+	data, err := exec.Command("podman", "pod", "inspect", depl.PodName).Output()
+	if ee, ok := err.(*exec.ExitError); ok {
+		return nil, fmt.Errorf("could not execute podman pod inspect %s: %v (%s)", depl.PodName, err, string(ee.Stderr))
+	} else if err != nil {
+		return nil, fmt.Errorf("could not execute podman pod inspect %s: %v", depl.PodName, err)
+	}
+
+	var pod struct {
+		Containers []struct {
+			Id   string
+			Name string
+		}
+	}
+
+	err = json.Unmarshal(data, &pod)
+	if err != nil {
+		return nil, err
+	}
+
+	var receivers []string
+	for _, cont := range pod.Containers {
+		data, err := exec.Command("podman", "container", "inspect", cont.Id).Output()
+		if err != nil {
+			return nil, fmt.Errorf("could not execute podman container inspect %s: %v", cont.Id, err)
+		}
+
+		var containers []struct {
+			Config struct {
+				Env []string
+			}
+		}
+
+		err = json.Unmarshal(data, &containers)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, c := range containers {
+			if slices.Contains(c.Config.Env, fmt.Sprintf("LISTEN_FDS=%d", num)) {
+				receivers = append(receivers, cont.Name)
+			}
+		}
+	}
+
+	if len(receivers) == 0 {
+		return nil, fmt.Errorf("no container of pod %s received the %d socket activation fds, podman kube play did not forward them", depl.PodName, num)
+	}
+
+	return receivers, nil
+}
+
 func (depl *Deployment) FindPodIPAddressContainer(id string) (string, error) {
 	data, err := exec.Command("podman", "container", "inspect", id).Output()
 	if ee, ok := err.(*exec.ExitError); ok {
-		return "", fmt.Errorf("could not execute podman container inspect %s: %v", id, err, string(ee.Stderr))
+		return "", fmt.Errorf("could not execute podman container inspect %s: %v (%s)", id, err, string(ee.Stderr))
 	} else if err != nil {
 		return "", fmt.Errorf("could not execute podman container inspect %s: %v", id, err)
 	}
@@ -444,3 +610,18 @@ func (depl *Deployment) FindPodIPAddress() (string, error) {
 
 	return address, err
 }
+
+// Mark the deployment as failed, the reason is kept in the deployment
+// directory until the deployment is removed
+func (depl *Deployment) MarkFailed(reason string) error {
+	return os.WriteFile(path.Join(DeploymentDirByNameOnly(depl.DeploymentName), FailedName), []byte(reason+"\n"), 0644)
+}
+
+// Return the reason the deployment was marked failed, or an empty string
+func (depl *Deployment) FailedReason() string {
+	data, err := os.ReadFile(path.Join(DeploymentDirByNameOnly(depl.DeploymentName), FailedName))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
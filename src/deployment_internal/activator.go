@@ -0,0 +1,417 @@
+package deployment_internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/daemon"
+
+	"github.com/mildred/conductor.go/src/dirs"
+	"github.com/mildred/conductor.go/src/service"
+
+	. "github.com/mildred/conductor.go/src/deployment"
+)
+
+// The activator of a scale-to-zero pod is the main process of the deployment
+// unit. The load-balancer dials its sockets, the pod is started on the first
+// connection and stopped after the idle timeout without traffic.
+type activator struct {
+	depl          *Deployment
+	mu            sync.Mutex // held while the pod is starting
+	running       bool
+	stopping      chan struct{} // closed when the pod being stopped is stopped
+	generation    int           // incremented on each cold start
+	failed_at     time.Time     // time of the last failed cold start
+	failure       error
+	last_activity atomic.Int64
+	conns_mu      sync.Mutex
+	conns         map[net.Conn]struct{}
+}
+
+// Connections are rejected for this delay after a failed cold start instead of
+// starting the pod again
+var ColdStartFailureBackoff = 5 * time.Second
+
+func RunActivator(ctx context.Context, depl *Deployment) error {
+	ctx, cancel := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	act := &activator{
+		depl:  depl,
+		conns: map[net.Conn]struct{}{},
+	}
+
+	proxies, err := depl.Pod.ReverseProxy(depl.Service)
+	if err != nil {
+		return err
+	}
+
+	//
+	// Listen on the activator sockets
+	//
+
+	var listeners []net.Listener
+	defer func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}()
+
+	for _, proxy := range proxies {
+		if proxy.UpstreamsPath == "" {
+			continue
+		}
+
+		socket_path := DeploymentActivatorSocketPath(depl.DeploymentName, proxy.Name)
+		err = os.Remove(socket_path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		l, err := net.Listen("unix", socket_path)
+		if err != nil {
+			return fmt.Errorf("while listening on the activator socket, %v", err)
+		}
+		listeners = append(listeners, l)
+
+		err = os.Chmod(socket_path, 0666)
+		if err != nil {
+			return err
+		}
+
+		go act.serve(ctx, l, proxy)
+	}
+
+	//
+	// Add the activator sockets to the load balancer
+	//
+
+	log.Printf("activator: Adding deployment to load-balancer...\n")
+	fmt.Fprintf(os.Stderr, "+ systemctl %s start %q\n", dirs.SystemdModeFlag(), DeploymentConfigUnit(depl.DeploymentName))
+	cmd := exec.Command("systemctl", dirs.SystemdModeFlag(), "start", DeploymentConfigUnit(depl.DeploymentName))
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if err != nil {
+		err = fmt.Errorf("failed to add deployment to load-balancer, %v", err)
+		SdNotifyOrLog(err.Error())
+		return err
+	}
+
+	log.Printf("activator: Waiting for connections, the pod is stopped after %v without traffic\n", time.Duration(depl.Pod.IdleTimeout))
+	_, err = daemon.SdNotify(false, daemon.SdNotifyReady+"\nSTATUS=scaled to zero")
+	if err != nil {
+		return err
+	}
+
+	//
+	// Stop the pod when idle
+	//
+
+	idle_timeout := time.Duration(depl.Pod.IdleTimeout)
+	interval := min(max(idle_timeout/4, time.Second), 10*time.Second)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Printf("activator: Stopping\n")
+			return nil
+		case <-ticker.C:
+			err = act.stopIfIdle(ctx, idle_timeout)
+			if err != nil {
+				log.Printf("activator: ERROR stopping idle pod: %v", err)
+			}
+		}
+	}
+}
+
+func (act *activator) touch() {
+	act.last_activity.Store(time.Now().UnixNano())
+}
+
+func (act *activator) serve(ctx context.Context, l net.Listener, proxy service.ServicePodProxyConfig) {
+	for {
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			log.Printf("activator: ERROR accepting connection: %v", err)
+			continue
+		}
+
+		go func() {
+			err := act.handle(ctx, conn, proxy)
+			if err != nil {
+				log.Printf("activator: ERROR on %s connection: %v", proxy.Name, err)
+			}
+		}()
+	}
+}
+
+// Start the pod if needed and proxy the connection to the pod
+func (act *activator) handle(ctx context.Context, conn net.Conn, proxy service.ServicePodProxyConfig) error {
+	defer conn.Close()
+	defer func() {
+		act.conns_mu.Lock()
+		delete(act.conns, conn)
+		act.conns_mu.Unlock()
+	}()
+
+	var upstream net.Conn
+	for attempt := 0; upstream == nil; attempt++ {
+		generation, started, ip_address, err := act.ensureStarted(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		// A pod that was already running should accept connections without
+		// delay, a pod just started may still be initializing
+		timeout := 5 * time.Second
+		if started {
+			timeout = 30 * time.Second
+		}
+
+		upstream, err = act.dial(ctx, fmt.Sprintf("%s:%d", ip_address, proxy.Port), timeout)
+		if err != nil && attempt > 0 {
+			return err
+		} else if err != nil {
+			// The pod may have died since it was started, start it again
+			log.Printf("activator: %v", err)
+			act.reset(ctx, generation)
+		}
+	}
+	defer upstream.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(activityWriter{upstream, act}, conn)
+		closeWrite(upstream)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(activityWriter{conn, act}, upstream)
+		closeWrite(conn)
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+
+	return nil
+}
+
+func closeWrite(conn net.Conn) {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		c.CloseWrite()
+	} else {
+		conn.Close()
+	}
+}
+
+// Dial the pod, retrying while the pod is not listening yet
+func (act *activator) dial(ctx context.Context, address string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	for {
+		conn, err := dialer.DialContext(ctx, "tcp", address)
+		if err == nil {
+			return conn, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("while connecting to the pod at %s, %v", address, err)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// Start the pod and wait for it to be healthy. Connections arriving in the
+// meantime wait for the pod to be started. The connection is registered before
+// the lock is released so that the pod cannot be stopped before it is dialed.
+// Returns the generation and the IP address of the running pod and true if it
+// was just started.
+func (act *activator) ensureStarted(ctx context.Context, conn net.Conn) (int, bool, string, error) {
+	act.mu.Lock()
+	for act.stopping != nil {
+		stopping := act.stopping
+		act.mu.Unlock()
+		select {
+		case <-stopping:
+		case <-ctx.Done():
+			return 0, false, "", ctx.Err()
+		}
+		act.mu.Lock()
+	}
+	defer act.mu.Unlock()
+
+	act.touch()
+	started := !act.running
+	if started {
+		if since := time.Since(act.failed_at); since < ColdStartFailureBackoff {
+			return 0, false, "", fmt.Errorf("the pod failed to start %v ago, %v", since.Round(time.Millisecond), act.failure)
+		}
+
+		err := act.coldStart(ctx)
+		if err != nil {
+			act.failed_at = time.Now()
+			act.failure = err
+			return 0, false, "", err
+		}
+	}
+
+	act.conns_mu.Lock()
+	act.conns[conn] = struct{}{}
+	act.conns_mu.Unlock()
+
+	return act.generation, started, act.depl.Pod.IPAddress, nil
+}
+
+// Stop the pod that could not be dialed so that the next connection starts it
+// again, unless it was already started again by another connection
+func (act *activator) reset(ctx context.Context, generation int) {
+	act.mu.Lock()
+	defer act.mu.Unlock()
+
+	if !act.running || act.generation != generation {
+		return
+	}
+
+	log.Printf("activator: The pod does not accept connections, stopping it...\n")
+	err := act.stop(ctx, false)
+	if err != nil {
+		log.Printf("activator: ERROR stopping the pod: %v", err)
+	}
+}
+
+// Stop the pod, running the pre-stop hooks first if pre_stop is true. act.mu
+// must be held, it is released while the pod is stopping and held again on
+// return. Connections arriving in the meantime wait for the pod to be stopped
+// before starting it again.
+func (act *activator) stop(ctx context.Context, pre_stop bool) error {
+	stopping := make(chan struct{})
+	act.running = false
+	act.stopping = stopping
+	act.mu.Unlock()
+
+	depl := act.depl
+	if pre_stop {
+		err := depl.RunHooks(ctx, "pre-stop", depl.PartName, depl.Vars(), 60*time.Second)
+		if err != nil {
+			log.Printf("activator: pre-stop hooks failed, continuing...")
+		}
+	}
+
+	err := depl.StartStopPod(false, ".", nil)
+
+	act.mu.Lock()
+	act.stopping = nil
+	close(stopping)
+	return err
+}
+
+// Start the pod, act.mu must be held
+func (act *activator) coldStart(ctx context.Context) error {
+	depl := act.depl
+	start_time := time.Now()
+	log.Printf("activator: Cold start of the pod...\n")
+	SdNotifyOrLog("starting the pod")
+
+	err := depl.StartStopPod(true, ".", nil)
+	if err != nil {
+		return fmt.Errorf("failed to start deployment pod, %v", err)
+	}
+
+	err = func() error {
+		addr, err := depl.FindPodIPAddress()
+		if err != nil {
+			return fmt.Errorf("failed to find pod IP address, %v", err)
+		}
+		depl.Pod.IPAddress = addr
+
+		err = depl.Save(ConfigName)
+		if err != nil {
+			return fmt.Errorf("failed to save pod IP address, %v", err)
+		}
+
+		err = depl.RunHooks(ctx, "post-start", depl.PartName, depl.Vars(), 60*time.Second)
+		if err != nil {
+			log.Printf("activator: post-start hooks failed, continuing...")
+		}
+
+		if check := depl.Pod.HealthCheck; check != nil {
+			log.Printf("activator: Waiting for health check %s...\n", check)
+			err = depl.Pod.WaitHealthy(ctx, depl, check)
+			if err != nil {
+				return fmt.Errorf("failed health check, %v", err)
+			}
+		}
+		return nil
+	}()
+	if err != nil {
+		e := depl.StartStopPod(false, ".", nil)
+		if e != nil {
+			log.Printf("activator: ERROR stopping the pod: %v", e)
+		}
+		SdNotifyOrLog("scaled to zero after start failure")
+		return err
+	}
+
+	act.running = true
+	act.generation++
+	act.touch()
+	log.Printf("activator: Cold start completed in %v, pod IP %s\n", time.Since(start_time).Round(time.Millisecond), depl.Pod.IPAddress)
+	SdNotifyOrLog(fmt.Sprintf("running, cold start in %v", time.Since(start_time).Round(time.Millisecond)))
+	return nil
+}
+
+// Stop the pod if there was no traffic for the idle timeout and no connection
+// is open, a slow response or a quiet stream keeps the pod running
+func (act *activator) stopIfIdle(ctx context.Context, idle_timeout time.Duration) error {
+	act.mu.Lock()
+	defer act.mu.Unlock()
+
+	act.conns_mu.Lock()
+	open_conns := len(act.conns)
+	act.conns_mu.Unlock()
+
+	idle := time.Since(time.Unix(0, act.last_activity.Load()))
+	if !act.running || open_conns > 0 || idle < idle_timeout {
+		return nil
+	}
+
+	log.Printf("activator: No traffic for %v, stopping the pod...\n", idle.Round(time.Second))
+
+	err := act.stop(ctx, true)
+	if err != nil {
+		return err
+	}
+
+	SdNotifyOrLog("scaled to zero")
+	return nil
+}
+
+// Record the activity when data is transferred
+type activityWriter struct {
+	w   io.Writer
+	act *activator
+}
+
+func (w activityWriter) Write(p []byte) (int, error) {
+	w.act.touch()
+	return w.w.Write(p)
+}
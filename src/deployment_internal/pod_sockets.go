@@ -0,0 +1,38 @@
+//go:build dragonfly || freebsd || linux || netbsd
+
+package deployment_internal
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/coreos/go-systemd/v22/activation"
+
+	. "github.com/mildred/conductor.go/src/deployment"
+)
+
+// Return the socket activation fds in the order the pod sockets are declared
+func podListeners(depl *Deployment) ([]*os.File, error) {
+	if len(depl.Pod.Sockets) == 0 {
+		return nil, nil
+	}
+
+	files := activation.Files(true)
+
+	var listeners []*os.File
+	for _, socket := range depl.Pod.Sockets {
+		var found *os.File
+		for _, f := range files {
+			if f.Name() == socket.Name {
+				found = f
+				break
+			}
+		}
+		if found == nil {
+			return nil, fmt.Errorf("socket %q was not passed by systemd (got %d fds)", socket.Name, len(files))
+		}
+		listeners = append(listeners, found)
+	}
+
+	return listeners, nil
+}
@@ -0,0 +1,17 @@
+//go:build !(dragonfly || freebsd || linux || netbsd)
+
+package deployment_internal
+
+import (
+	"fmt"
+	"os"
+
+	. "github.com/mildred/conductor.go/src/deployment"
+)
+
+func podListeners(depl *Deployment) ([]*os.File, error) {
+	if len(depl.Pod.Sockets) == 0 {
+		return nil, nil
+	}
+	return nil, fmt.Errorf("pod sockets not supported on this platform")
+}
@@ -24,6 +24,30 @@ func StartSDActivateFunction(ctx context.Context, depl *Deployment, f *Deploymen
 		return fmt.Errorf("http-stdio function incompatible with response_headers (%v)", f.ResponseHeaders)
 	}
 
+	return execActivated(depl, f)
+}
+
+// FastCGI workers get the listening socket on stdin from the socket unit, it is
+// also passed with socket activation for applications supporting it
+func StartFastCGIFunction(ctx context.Context, depl *Deployment, f *DeploymentFunction) error {
+	if f.NoResponseHeaders {
+		return fmt.Errorf("fastcgi function incompatible with no_response_headers")
+	}
+
+	if len(f.ResponseHeaders) > 0 {
+		return fmt.Errorf("fastcgi function incompatible with response_headers (%v)", f.ResponseHeaders)
+	}
+
+	if f.StderrAsStdout {
+		return fmt.Errorf("fastcgi function incompatible with stderr_as_stdout")
+	}
+
+	return execActivated(depl, f)
+}
+
+// Replace the process with the function, keeping the socket activation file
+// descriptors open
+func execActivated(depl *Deployment, f *DeploymentFunction) error {
 	listeners := activation.Files(false)
 	if len(listeners) < 1 {
 		return fmt.Errorf("unexpected number of socket activation fds: %d < %d", len(listeners), 1)
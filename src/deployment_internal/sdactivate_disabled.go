@@ -12,3 +12,7 @@ import (
 func StartSDActivateFunction(ctx context.Context, depl *Deployment, f *DeploymentFunction) error {
 	return fmt.Errorf("sdactivate not supported on this platform")
 }
+
+func StartFastCGIFunction(ctx context.Context, depl *Deployment, f *DeploymentFunction) error {
+	return fmt.Errorf("fastcgi not supported on this platform")
+}
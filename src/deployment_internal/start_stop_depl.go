@@ -13,6 +13,7 @@ import (
 	"github.com/mildred/conductor.go/src/caddy"
 	"github.com/mildred/conductor.go/src/deployment"
 	"github.com/mildred/conductor.go/src/dirs"
+	"github.com/mildred/conductor.go/src/lock"
 	"github.com/mildred/conductor.go/src/service"
 
 	. "github.com/mildred/conductor.go/src/deployment"
@@ -37,6 +38,12 @@ func Prepare(deployment_name_or_dir string) error {
 
 	log.Printf("prepare: Prepare deployment %s\n", dir)
 
+	l, err := lock.Deployment(deployment_name, "prepare")
+	if err != nil {
+		return err
+	}
+	defer l.Unlock()
+
 	//
 	// Create deployment config from service and run the templates
 	//
@@ -156,6 +163,12 @@ func Cleanup(deployment_name_or_dir string) error {
 
 	log.Printf("cleanup: Cleaning up %s\n", dir)
 
+	l, err := lock.Deployment(deployment_name, "cleanup")
+	if err != nil {
+		return err
+	}
+	defer l.Unlock()
+
 	//
 	// Run the post-stop hooks (via systemd-run specific scope), just in case
 	//
@@ -5,15 +5,23 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"os/exec"
 
 	"github.com/mildred/conductor.go/src/cgi"
+	"github.com/mildred/conductor.go/src/function_manager"
 
 	. "github.com/mildred/conductor.go/src/deployment"
 )
 
 func StartFunction(ctx context.Context, depl *Deployment, function bool) error {
 	var err error
+	if depl.Function.IsManaged() && !function {
+		err = function_manager.Register(depl.DeploymentName)
+		if err != nil {
+			return fmt.Errorf("while registering function workers, %v", err)
+		}
+		return nil
+	}
+
 	switch depl.Function.Format {
 	case "cgi":
 		if function {
@@ -42,6 +50,15 @@ func StartFunction(ctx context.Context, depl *Deployment, function bool) error {
 		} else {
 			// Nothing to start, this is started on demand
 		}
+	case "fastcgi":
+		if function {
+			err = StartFastCGIFunction(ctx, depl, depl.Function)
+			if err != nil {
+				return fmt.Errorf("while starting FastCGI function, %v", err)
+			}
+		} else {
+			// Nothing to start, this is started on demand
+		}
 	default:
 		err = fmt.Errorf("Unknown function format %s", depl.Function.Format)
 	}
@@ -99,13 +116,11 @@ func StartCGIFunction(ctx context.Context, depl *Deployment, f *DeploymentFuncti
 }
 
 func ExecuteDecodedFunction(ctx context.Context, depl *Deployment, f *DeploymentFunction, stdin io.Reader, handle_stdout func(io.ReadCloser) error) error {
-	var err error
-	if len(f.Exec) < 1 {
-		return fmt.Errorf("Missing executable")
+	cmd, err := f.Command(ctx, depl)
+	if err != nil {
+		return err
 	}
 
-	cmd := exec.CommandContext(ctx, f.Exec[0], f.Exec[1:]...)
-	cmd.Env = append(cmd.Environ(), depl.Vars()...)
 	cmd.Stdin = os.Stdin
 	cmd.Stderr = os.Stderr
 
@@ -156,5 +171,11 @@ func ExecuteDecodedFunction(ctx context.Context, depl *Deployment, f *Deployment
 }
 
 func StopFunction(ctx context.Context, depl *Deployment, function bool) error {
+	if depl.Function.IsManaged() && !function {
+		err := function_manager.Deregister(depl.DeploymentName)
+		if err != nil {
+			return fmt.Errorf("while deregistering function workers, %v", err)
+		}
+	}
 	return nil
 }
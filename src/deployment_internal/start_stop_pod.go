@@ -12,6 +12,7 @@ import (
 	"github.com/coreos/go-systemd/v22/daemon"
 
 	"github.com/mildred/conductor.go/src/tmpl"
+	"github.com/mildred/conductor.go/src/utils"
 
 	. "github.com/mildred/conductor.go/src/deployment"
 	"github.com/mildred/conductor.go/src/dirs"
@@ -27,30 +28,63 @@ import (
 // - or as a HTTP query to the pod IP address with a retry mechanism
 
 func StartPod(ctx context.Context, depl *Deployment) error {
+	if depl.Pod.IdleTimeout > 0 {
+		return RunActivator(ctx, depl)
+	}
+
 	//
 	// Start the pod or fail
 	//
 
+	listeners, err := podListeners(depl)
+	if err != nil {
+		err = fmt.Errorf("failed to get pod sockets, %v", err)
+		SdNotifyOrLog(err.Error())
+		return err
+	}
+
 	log.Printf("start: Start the deployment pod\n")
-	err := depl.StartStopPod(true, ".")
+	err = depl.StartStopPod(true, ".", listeners)
 	if err != nil {
 		err = fmt.Errorf("failed to start deployment pod, %v", err)
 		SdNotifyOrLog(err.Error())
 		return err
 	}
 
+	if len(listeners) > 0 {
+		receivers, err := depl.CheckPodListenFds(len(listeners))
+		if err != nil {
+			e := depl.StartStopPod(false, ".", nil)
+			if e != nil {
+				log.Printf("start: ERROR stopping the pod: %v", e)
+			}
+			err = fmt.Errorf("failed to pass the sockets to the pod, %v", err)
+			SdNotifyOrLog(err.Error())
+			return err
+		}
+		log.Printf("start: Sockets passed to the containers %v\n", receivers)
+	}
+
 	//
 	// Find the pod IP address, add it to config
 	//
 
 	log.Printf("start: Looking up pod IP address...\n")
-	addr, err := depl.FindPodIPAddress()
-	if err != nil {
+	var addr string
+	if depl.Pod.ReachedBySockets() {
+		addr, err = depl.FindPodIPAddressOnce()
+	} else {
+		addr, err = depl.FindPodIPAddress()
+	}
+	if err != nil && depl.Pod.ReachedBySockets() {
+		log.Printf("start: No pod IP address (%v), the pod is reached by its sockets\n", err)
+	} else if err != nil {
 		err = fmt.Errorf("failed to find pod IP address, %v", err)
 		SdNotifyOrLog(err.Error())
 		return err
+	} else {
+		log.Printf("start: Found pod IP address: %s\n", addr)
 	}
-	log.Printf("start: Found pod IP address: %s\n", addr)
 
 	depl.Pod.IPAddress = addr
 
@@ -84,6 +118,28 @@ func StartPod(ctx context.Context, depl *Deployment) error {
 		log.Printf("start: post-start hooks failed, continuing...")
 	}
 
+	//
+	// Wait for the health check to pass before adding the pod to the
+	// load-balancer
+	//
+
+	if check := depl.Pod.HealthCheck; check != nil {
+		log.Printf("start: Waiting for health check %s...\n", check)
+		SdNotifyOrLog(fmt.Sprintf("waiting for health check %s", check))
+
+		ctx1, cancel := context.WithCancel(ctx)
+		go utils.ExtendTimeout(ctx1, 0)
+		err = depl.Pod.WaitHealthy(ctx, depl, check)
+		cancel()
+
+		if err != nil {
+			err = fmt.Errorf("failed health check, %v", err)
+			SdNotifyOrLog(err.Error())
+			return err
+		}
+		log.Printf("start: Health check passed\n")
+	}
+
 	//
 	// Add IP address to load balancer
 	//
@@ -149,8 +205,10 @@ func StopPod(ctx context.Context, depl *Deployment) error {
 	//
 
 	log.Printf("stop: Stopping the containers...\n")
-	err = depl.StartStopPod(false, ".")
-	if err != nil {
+	err = depl.StartStopPod(false, ".", nil)
+	if err != nil && depl.Pod.IdleTimeout > 0 {
+		log.Printf("stop: Could not stop the pod, it may be scaled to zero: %v\n", err)
+	} else if err != nil {
 		err = fmt.Errorf("failed to stop pod, %v", err)
 		SdNotifyOrLog(err.Error())
 		return err
@@ -166,5 +224,5 @@ func Template(dir string, template string) error {
 		return err
 	}
 
-	return tmpl.RunTemplateStdout(context.Background(), template, depl.Vars())
+	return tmpl.RunTemplateStdout(context.Background(), template, depl.Vars(), depl.TemplateOptions())
 }
@@ -44,5 +44,5 @@ func RunDeploymentCommand(depl *Deployment, direct bool, env []string, cmd_name
 		return err
 	}
 
-	return service_util.RunCommand(command, direct, depl_path, append(depl.Vars(), env...), cmd_name, args...)
+	return service_util.RunCommand(command, depl.Service, direct, depl_path, append(depl.Vars(), env...), cmd_name, args...)
 }
@@ -0,0 +1,32 @@
+package deployment_public
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/rodaine/table"
+
+	"github.com/mildred/conductor.go/src/function_manager"
+)
+
+// Print the worker pools of the fast function manager
+func PrintFunctionStats(print_json bool) error {
+	stats, err := function_manager.Stats()
+	if err != nil {
+		return err
+	}
+
+	if print_json {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(stats)
+	}
+
+	tbl := table.New("DEPLOYMENT", "WORKERS", "IDLE", "BUSY", "MIN", "MAX", "REQUESTS", "SPAWNED", "RECYCLED", "FAILED").WithPrintHeaders(true)
+	for _, st := range stats {
+		tbl.AddRow(st.Deployment, st.Workers, st.Idle, st.Busy, st.Min, st.Max, st.Requests, st.Spawned, st.Recycled, st.Failed)
+	}
+	tbl.Print()
+
+	return nil
+}
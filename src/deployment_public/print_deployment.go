@@ -240,7 +240,7 @@ func PrintInspect(deployments ...string) error {
 			Vars []string `json:"_vars"`
 		}{
 			Deployment: depl,
-			Vars:       depl.Vars(),
+			Vars:       depl.MaskedVars(),
 		}
 
 		err = json.NewEncoder(os.Stdout).Encode(exported)
@@ -269,6 +269,9 @@ func Print(depl_name string, settings PrintSettings) error {
 	tbl.AddRow("Part", depl.PartName)
 	tbl.AddRow("Service Path", depl.ServiceDir)
 	tbl.AddRow("Service Id", depl.ServiceId)
+	if reason := depl.FailedReason(); reason != "" {
+		tbl.AddRow("Failed", reason)
+	}
 
 	tbl.Print()
 	fmt.Println()
@@ -8,6 +8,7 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"slices"
 	"strings"
 
 	"github.com/coreos/go-systemd/v22/dbus"
@@ -15,6 +16,9 @@ import (
 	"github.com/taigrr/systemctl/properties"
 
 	"github.com/mildred/conductor.go/src/dirs"
+	"github.com/mildred/conductor.go/src/function_manager"
+	"github.com/mildred/conductor.go/src/history"
+	"github.com/mildred/conductor.go/src/lock"
 	"github.com/mildred/conductor.go/src/service"
 	_ "github.com/mildred/conductor.go/src/utils"
 
@@ -24,6 +28,8 @@ import (
 type StartNewOrExistingOpts struct {
 	MaxIndex  int
 	WantFresh bool
+	Exclude   []string // Deployments that cannot be reused
+	NoCreate  bool     // Reuse or restart existing deployments but do not create new ones
 }
 
 func StartNewOrExistingFromService(ctx context.Context, svc *service.Service, seed *DeploymentSeed, opts StartNewOrExistingOpts) (*Deployment, string, error) {
@@ -72,6 +78,11 @@ func StartNewOrExistingFromService(ctx context.Context, svc *service.Service, se
 	for _, depl := range deployments {
 		log.Printf("[%q] Considering deployment %v...", part, depl.DeploymentName)
 
+		if slices.Contains(opts.Exclude, depl.DeploymentName) {
+			log.Printf("[%q] Deployment %s is already used", part, depl.DeploymentName)
+			continue
+		}
+
 		should_match := depl.AppName == svc.AppName && depl.InstanceName == svc.InstanceName
 		if depl.ServiceDir != svc.BasePath {
 			if should_match {
@@ -131,6 +142,11 @@ func StartNewOrExistingFromService(ctx context.Context, svc *service.Service, se
 	} else if len(starting_deployments) > 0 {
 		log.Printf("[%q] Found starting deployment %q", part, starting_deployments[0].DeploymentName)
 		return starting_deployments[0], "activating", nil
+	} else if len(stopped_deployments) > 0 && opts.NoCreate {
+		log.Printf("[%q] Found stopped deployment %q, restart it", part, stopped_deployments[0].DeploymentName)
+		return stopped_deployments[0], "inactive", nil
+	} else if opts.NoCreate {
+		return nil, "", fmt.Errorf("no existing deployment to start for part %q and creating deployments is not allowed", part)
 	} else if len(stopped_deployments) > 0 {
 		log.Printf("[%q] Found stopped deployment %q", part, stopped_deployments[0].DeploymentName)
 		log.Printf("[%q] Removing deployment...", part)
@@ -157,17 +173,32 @@ func StartNewOrExistingFromService(ctx context.Context, svc *service.Service, se
 		for i <= opts.MaxIndex {
 			name = fmt.Sprintf("%s-%s-%s%d", svc.AppName, svc.InstanceName, seed.Prefix(), i)
 			log.Printf("[%q] Trying new deployment name %s", part, name)
-			_, err := os.Stat(path.Join(DeploymentRunDir, name))
+
+			// Another process may be creating the deployment with this name
+			l, err := lock.TryAcquire(lock.DeploymentLockName(name), "create")
+			if err != nil {
+				return nil, "", err
+			} else if l == nil {
+				i = i + 1
+				name = ""
+				continue
+			}
+
+			_, err = os.Stat(path.Join(DeploymentRunDir, name))
 			if err != nil && !os.IsNotExist(err) {
+				l.Unlock()
 				return nil, "", err
 			} else if err == nil {
 				// the deployment exists, try next integer
+				l.Unlock()
 				i = i + 1
 				name = ""
 				continue
-			} else {
-				break
 			}
+
+			// Keep the name reserved until the deployment is created
+			defer l.Unlock()
+			break
 		}
 
 		if name == "" && len(started_deployments) > 0 {
@@ -200,7 +231,13 @@ func StartNewOrExistingFromService(ctx context.Context, svc *service.Service, se
 func CreateDeploymentFromService(name string, svc *service.Service, seed *DeploymentSeed) (string, error) {
 	dir := path.Join(DeploymentRunDir, name)
 
-	err := os.MkdirAll(dir, 0755)
+	l, err := lock.Deployment(name, "create")
+	if err != nil {
+		return "", err
+	}
+	defer l.Unlock()
+
+	err = os.MkdirAll(dir, 0755)
 	if err != nil {
 		return "", err
 	}
@@ -220,6 +257,11 @@ func CreateDeploymentFromService(name string, svc *service.Service, seed *Deploy
 		return "", err
 	}
 
+	err = history.Record(svc, seed.PartName, seed.PartId, name)
+	if err != nil {
+		log.Printf("[%q] Could not record deployment %s in history: %v", seed.PartName, name, err)
+	}
+
 	// var env string
 	// env += fmt.Sprintf("CONDUCTOR_APP=%s\n", svc.AppName)
 	// env += fmt.Sprintf("CONDUCTOR_INSTANCE=%s\n", svc.InstanceName)
@@ -236,15 +278,25 @@ func CreateDeploymentFromService(name string, svc *service.Service, seed *Deploy
 		unit_name = DeploymentUnit(name)
 		pod := svc.Pods.FindPod(seed.PartName)
 		service_directives = pod.ServiceDirectives
+		err = CreatePodSocketUnits(name, pod)
+		if err != nil {
+			return "", err
+		}
 	} else if seed.IsFunction {
 		fct := svc.Functions.FindFunction(seed.PartName)
-		if fct.IsSingle() {
+		if fct.IsManaged() {
+			unit_name = DeploymentUnit(name)
+		} else if fct.IsSingle() {
 			unit_name = CGIFunctionServiceUnitSingle(name)
 		} else {
 			unit_name = CGIFunctionServiceUnit(name, "")
 		}
 		service_directives = fct.ServiceDirectives
-		err = CreateCGIFunctionUnits(name, fct)
+		if fct.IsManaged() {
+			err = CreateManagedFunctionUnits(name)
+		} else {
+			err = CreateCGIFunctionUnits(name, fct)
+		}
 		if err != nil {
 			return "", err
 		}
@@ -290,11 +342,100 @@ func CreateDeploymentFromService(name string, svc *service.Service, seed *Deploy
 	return dir, nil
 }
 
+func CreatePodSocketUnits(name string, pod *service.ServicePod) error {
+	if len(pod.Sockets) == 0 {
+		return nil
+	}
+
+	err := os.MkdirAll(dirs.Join(dirs.RuntimeDir, "systemd", dirs.SystemdMode(), DeploymentUnit(name)+".d"), 0755)
+	if err != nil {
+		return err
+	}
+
+	var deployment_conf = "[Unit]\n"
+	var sockets_conf = "[Service]\n"
+	for _, socket := range pod.Sockets {
+		unit_name := DeploymentPodSocketUnit(name, socket.Name)
+		deployment_conf += "Requires=" + unit_name + "\n"
+		deployment_conf += "After=" + unit_name + "\n"
+		sockets_conf += "Sockets=" + unit_name + "\n"
+
+		var unit = `[Unit]
+Description=Conductor deployment socket ` + socket.Name + ` for ` + name + `
+
+[Socket]
+ListenStream=` + DeploymentPodSocketListen(name, socket) + `
+FileDescriptorName=` + socket.Name + `
+Service=` + DeploymentUnit(name) + `
+`
+		if socket.IsUnix() {
+			unit += "RemoveOnStop=yes\n"
+		}
+		for _, directive := range socket.SocketDirectives {
+			unit += strings.ReplaceAll(directive, "\n", "\\\n") + "\n"
+		}
+
+		log.Printf("Write %s", dirs.Join(dirs.RuntimeDir, "systemd", dirs.SystemdMode(), unit_name))
+		err = os.WriteFile(dirs.Join(dirs.RuntimeDir, "systemd", dirs.SystemdMode(), unit_name), []byte(unit), 0o644)
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Write %s", dirs.Join(dirs.RuntimeDir, "systemd", dirs.SystemdMode(), DeploymentUnit(name)+".d", "sockets.conf"))
+	err = os.WriteFile(dirs.Join(dirs.RuntimeDir, "systemd", dirs.SystemdMode(), DeploymentUnit(name)+".d", "sockets.conf"), []byte(deployment_conf+"\n"+sockets_conf), 0o644)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Functions with workers are served by the fast function manager, the
+// deployment unit registers the function to the manager. An explicit restart of
+// the manager restarts the deployment units, after an automatic restart the
+// manager registers again the functions of the active deployment units.
+func CreateManagedFunctionUnits(name string) error {
+	var function_conf = `[Unit]
+Requires=` + DeploymentConfigUnit(name) + `
+Before=` + DeploymentConfigUnit(name) + `
+Requires=` + function_manager.ManagerUnit + `
+After=` + function_manager.ManagerUnit + `
+PartOf=` + function_manager.ManagerUnit + `
+
+[Service]
+Type=oneshot
+ExitType=main
+RemainAfterExit=yes
+Restart=on-failure
+`
+
+	log.Printf("Create %s", dirs.Join(dirs.RuntimeDir, "systemd", dirs.SystemdMode(), DeploymentUnit(name)+".d"))
+	err := os.MkdirAll(dirs.Join(dirs.RuntimeDir, "systemd", dirs.SystemdMode(), DeploymentUnit(name)+".d"), 0755)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Write %s", dirs.Join(dirs.RuntimeDir, "systemd", dirs.SystemdMode(), DeploymentUnit(name)+".d", "function.conf"))
+	err = os.WriteFile(dirs.Join(dirs.RuntimeDir, "systemd", dirs.SystemdMode(), DeploymentUnit(name)+".d", "function.conf"), []byte(function_conf), 0o644)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
 func CreateCGIFunctionUnits(name string, f *service.ServiceFunction) error {
 	var unit_name, accept, service_config string
 	if f.IsSingle() {
 		unit_name = CGIFunctionServiceUnitSingle(name)
 		accept = "no"
+		if f.Format == "fastcgi" {
+			// FastCGI applications expect the listening socket on stdin
+			service_config = "StandardInput=socket\n" +
+				"StandardOutput=journal\n" +
+				"StandardError=journal\n"
+		}
 	} else {
 		unit_name = CGIFunctionServiceUnit(name, "")
 		accept = "yes"
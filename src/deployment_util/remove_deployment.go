@@ -12,6 +12,7 @@ import (
 	"github.com/taigrr/systemctl/properties"
 
 	"github.com/mildred/conductor.go/src/dirs"
+	"github.com/mildred/conductor.go/src/lock"
 	_ "github.com/mildred/conductor.go/src/utils"
 
 	. "github.com/mildred/conductor.go/src/deployment"
@@ -62,6 +63,11 @@ func RemoveTimeout(ctx0 context.Context, deployment_name string, timeout, term_t
 		return err
 	}
 
+	pod_sockets, err := DeploymentPodSocketUnits(deployment_name)
+	if err != nil {
+		return err
+	}
+
 	var cancel context.CancelFunc = func() {}
 	var ctx = ctx0
 	if timeout != 0 {
@@ -140,6 +146,24 @@ func RemoveTimeout(ctx0 context.Context, deployment_name string, timeout, term_t
 		return err
 	}
 
+	for _, unit := range pod_sockets {
+		fmt.Fprintf(os.Stderr, "+ systemctl %s stop %s\n", dirs.SystemdModeFlag(), unit)
+		cmd = exec.Command("systemctl", dirs.SystemdModeFlag(), "stop", unit)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		err = cmd.Run()
+		if err != nil {
+			return err
+		}
+	}
+
+	// Lock after the units are stopped, stopping a deployment takes the lock
+	l, err := lock.Deployment(deployment_name, "remove")
+	if err != nil {
+		return err
+	}
+	defer l.Unlock()
+
 	fmt.Fprintf(os.Stderr, "+ rm -rf %q\n", DeploymentDirByNameOnly(deployment_name))
 	err = os.RemoveAll(DeploymentDirByNameOnly(deployment_name))
 	if err != nil {
@@ -153,6 +177,9 @@ func RemoveTimeout(ctx0 context.Context, deployment_name string, timeout, term_t
 		dirs.Join(dirs.RuntimeDir, "systemd", dirs.SystemdMode(), CGIFunctionServiceUnitSingle(deployment_name)),
 		dirs.Join(dirs.RuntimeDir, "systemd", dirs.SystemdMode(), CGIFunctionServiceUnit(deployment_name, "")),
 	}
+	for _, unit := range pod_sockets {
+		systemd_run_dirs = append(systemd_run_dirs, dirs.Join(dirs.RuntimeDir, "systemd", dirs.SystemdMode(), unit))
+	}
 	for _, systemd_run_dir := range systemd_run_dirs {
 		fmt.Fprintf(os.Stderr, "+ rm -rf %q\n", systemd_run_dir)
 		err = os.RemoveAll(systemd_run_dir)
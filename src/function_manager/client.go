@@ -0,0 +1,70 @@
+package function_manager
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+var client = &http.Client{
+	Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", SocketPath)
+		},
+	},
+}
+
+func request(method, path string) (*http.Response, error) {
+	req, err := http.NewRequest(method, "http://fast-function-manager"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("while contacting the fast function manager, %v", err)
+	}
+
+	if res.StatusCode >= 300 {
+		defer res.Body.Close()
+		msg, _ := io.ReadAll(res.Body)
+		return nil, fmt.Errorf("fast function manager %s %s: %s", method, path, strings.TrimSpace(string(msg)))
+	}
+
+	return res, nil
+}
+
+// Ask the fast function manager to start the workers of a deployment and listen
+// on its socket
+func Register(deployment_name string) error {
+	res, err := request(http.MethodPut, "/deployments/"+deployment_name)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+func Deregister(deployment_name string) error {
+	res, err := request(http.MethodDelete, "/deployments/"+deployment_name)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+func Stats() ([]PoolStats, error) {
+	res, err := request(http.MethodGet, "/stats")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var stats []PoolStats
+	err = json.NewDecoder(res.Body).Decode(&stats)
+	return stats, err
+}
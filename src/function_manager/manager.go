@@ -0,0 +1,253 @@
+package function_manager
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/daemon"
+
+	"github.com/mildred/conductor.go/src/deployment"
+	"github.com/mildred/conductor.go/src/dirs"
+	"github.com/mildred/conductor.go/src/utils"
+)
+
+const ManagerUnit = "conductor-fast-function-manager.service"
+
+// Control socket of the fast function manager
+var SocketPath = path.Join(dirs.SelfRuntimeDir, "fast-function-manager.socket")
+
+type manager struct {
+	mu    sync.Mutex
+	pools map[string]*Pool
+	names map[string]*sync.Mutex // Serialize the registrations of a deployment
+}
+
+// Lock the registrations of the deployment, return the unlock function
+func (m *manager) lockName(name string) func() {
+	m.mu.Lock()
+	mu, ok := m.names[name]
+	if !ok {
+		mu = &sync.Mutex{}
+		m.names[name] = mu
+	}
+	m.mu.Unlock()
+
+	mu.Lock()
+	return mu.Unlock
+}
+
+// Start a pool for the deployment, replacing any existing pool
+func (m *manager) register(name string) error {
+	unlock := m.lockName(name)
+	defer unlock()
+
+	depl, err := deployment.ReadDeploymentByName(name, false)
+	if err != nil {
+		return err
+	}
+
+	m.closePool(name)
+
+	pool, err := NewPool(depl)
+	if err != nil {
+		return err
+	}
+
+	err = pool.Start()
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.pools[name] = pool
+	m.mu.Unlock()
+
+	log.Printf("[%s] Registered with %d workers", name, depl.Function.Workers.Min)
+	return nil
+}
+
+func (m *manager) deregister(name string) error {
+	unlock := m.lockName(name)
+	defer unlock()
+
+	return m.closePool(name)
+}
+
+// Remove the pool of the deployment and close it, the deployment must be locked
+func (m *manager) closePool(name string) error {
+	m.mu.Lock()
+	pool := m.pools[name]
+	delete(m.pools, name)
+	m.mu.Unlock()
+
+	if pool == nil {
+		return nil
+	}
+
+	log.Printf("[%s] Deregistered", name)
+	return pool.Close()
+}
+
+// Register again the managed functions whose deployment unit is still active.
+// The deployment units do not follow an automatic restart of the manager and
+// the pools of a crashed manager would otherwise be lost.
+func (m *manager) restore(ctx context.Context) error {
+	sd, err := utils.NewSystemdClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer sd.Close()
+
+	units, err := sd.ListUnitsByPatternsContext(ctx, []string{"active", "reloading"}, []string{deployment.DeploymentUnit("*")})
+	if err != nil {
+		return err
+	}
+
+	for _, u := range units {
+		name := strings.TrimSuffix(strings.TrimPrefix(u.Name, "conductor-deployment@"), ".service")
+
+		depl, err := deployment.ReadDeploymentByName(name, false)
+		if err != nil {
+			log.Printf("[%s] Cannot read deployment: %v", name, err)
+			continue
+		} else if depl.Function == nil || !depl.Function.IsManaged() {
+			continue
+		}
+
+		err = m.register(name)
+		if err != nil {
+			log.Printf("[%s] ERROR restoring: %v", name, err)
+		}
+	}
+
+	return nil
+}
+
+func (m *manager) stats() []PoolStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var stats []PoolStats = []PoolStats{}
+	for _, pool := range m.pools {
+		stats = append(stats, pool.Stats())
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Deployment < stats[j].Deployment })
+	return stats
+}
+
+func (m *manager) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	name, is_deployment := strings.CutPrefix(req.URL.Path, "/deployments/")
+
+	var err error
+	switch {
+	case req.URL.Path == "/stats" && req.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(m.stats())
+	case is_deployment && name != "" && req.Method == http.MethodPut:
+		err = m.register(name)
+		if err == nil {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	case is_deployment && name != "" && req.Method == http.MethodDelete:
+		err = m.deregister(name)
+		if err == nil {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	default:
+		http.Error(w, "Not Found", http.StatusNotFound)
+	}
+
+	if err != nil {
+		log.Printf("ERROR %s %s: %v", req.Method, req.URL.Path, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func RunServer() error {
+	log.SetOutput(os.Stderr)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	m := &manager{pools: map[string]*Pool{}, names: map[string]*sync.Mutex{}}
+
+	err := os.MkdirAll(path.Dir(SocketPath), 0755)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(SocketPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	listener, err := net.Listen("unix", SocketPath)
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{Handler: m}
+
+	http_err := make(chan error, 1)
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			http_err <- err
+		}
+		close(http_err)
+	}()
+
+	err = m.restore(ctx)
+	if err != nil {
+		log.Printf("ERROR restoring the registered functions: %v", err)
+	}
+
+	_, err = daemon.SdNotify(false, daemon.SdNotifyReady)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-ctx.Done():
+		_, err = daemon.SdNotify(false, daemon.SdNotifyStopping)
+		if err != nil {
+			log.Printf("ERROR notifying systemd: %v", err)
+		}
+
+		ctx_grace, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		err = server.Shutdown(ctx_grace)
+
+		m.mu.Lock()
+		var names []string
+		for name := range m.pools {
+			names = append(names, name)
+		}
+		m.mu.Unlock()
+
+		for _, name := range names {
+			e := m.deregister(name)
+			if e != nil {
+				err = errors.Join(err, fmt.Errorf("stopping %s, %v", name, e))
+			}
+		}
+		return err
+
+	case err = <-http_err:
+		return err
+	}
+}
@@ -0,0 +1,453 @@
+package function_manager
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/mildred/conductor.go/src/deployment"
+)
+
+// Headers that are only meaningful for a single connection and are not
+// forwarded between the client and the worker
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// A running http-stdio process, it reads HTTP requests on its standard input
+// and writes the responses on its standard output
+type worker struct {
+	cmd      *exec.Cmd
+	stdin    io.WriteCloser
+	stdout   *bufio.Reader
+	requests int
+	done     chan struct{}
+}
+
+func (w *worker) alive() bool {
+	select {
+	case <-w.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// Close the standard input and let the process exit on its own, kill it if
+// it does not exit in time
+func (w *worker) retire(timeout time.Duration) {
+	w.stdin.Close()
+	select {
+	case <-w.done:
+	case <-time.After(timeout):
+		w.cmd.Process.Kill()
+		<-w.done
+	}
+}
+
+// Pool of workers for a function deployment
+type Pool struct {
+	depl     *deployment.Deployment
+	listener net.Listener
+	server   *http.Server
+	ctx      context.Context
+	cancel   context.CancelFunc
+	idle     chan *worker
+
+	mu       sync.Mutex
+	closed   bool
+	total    int
+	spawning int
+	retiring int
+	requests int64
+	spawned  int64
+	recycled int64
+	failed   int64
+}
+
+func NewPool(depl *deployment.Deployment) (*Pool, error) {
+	if depl.Function == nil || depl.Function.Workers == nil {
+		return nil, fmt.Errorf("deployment %s is not a function with workers", depl.DeploymentName)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	pool := &Pool{
+		depl:   depl,
+		ctx:    ctx,
+		cancel: cancel,
+		idle:   make(chan *worker, depl.Function.Workers.Max),
+	}
+	pool.server = &http.Server{Handler: pool}
+	return pool, nil
+}
+
+// Spawn the minimum number of workers and listen on the deployment socket
+func (pool *Pool) Start() error {
+	for i := 0; i < pool.depl.Function.Workers.Min; i++ {
+		pool.mu.Lock()
+		pool.total++
+		pool.mu.Unlock()
+
+		w, err := pool.spawn()
+		if err != nil {
+			pool.Close()
+			return err
+		}
+		pool.idle <- w
+	}
+
+	socket_path := deployment.DeploymentSocketPath(pool.depl.DeploymentName)
+	err := os.Remove(socket_path)
+	if err != nil && !os.IsNotExist(err) {
+		pool.Close()
+		return err
+	}
+
+	pool.listener, err = net.Listen("unix", socket_path)
+	if err != nil {
+		pool.Close()
+		return err
+	}
+
+	err = os.Chmod(socket_path, 0666)
+	if err != nil {
+		pool.Close()
+		return err
+	}
+
+	go func() {
+		err := pool.server.Serve(pool.listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("[%s] ERROR serving: %v", pool.depl.DeploymentName, err)
+		}
+	}()
+
+	return nil
+}
+
+// Stop accepting requests, wait for the pending requests and stop the workers
+func (pool *Pool) Close() error {
+	pool.mu.Lock()
+	pool.closed = true
+	pool.mu.Unlock()
+
+	var err error
+	if pool.listener != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		err = pool.server.Shutdown(ctx)
+	}
+
+	for {
+		select {
+		case w := <-pool.idle:
+			pool.discard(w)
+			continue
+		default:
+		}
+		break
+	}
+
+	pool.cancel()
+	return err
+}
+
+// Start a new worker, the caller must have counted it in the pool total
+func (pool *Pool) spawn() (w *worker, err error) {
+	defer func() {
+		if err != nil {
+			pool.mu.Lock()
+			pool.total--
+			pool.failed++
+			pool.mu.Unlock()
+		}
+	}()
+
+	cmd, err := pool.depl.Function.Command(pool.ctx, pool.depl)
+	if err != nil {
+		return nil, err
+	}
+	cmd.Dir = deployment.DeploymentDirByNameOnly(pool.depl.DeploymentName)
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("starting worker, %v", err)
+	}
+
+	w = &worker{
+		cmd:    cmd,
+		stdin:  stdin,
+		stdout: bufio.NewReader(stdout),
+		done:   make(chan struct{}),
+	}
+
+	go func() {
+		err := cmd.Wait()
+		if err != nil {
+			log.Printf("[%s] Worker %d exited: %v", pool.depl.DeploymentName, cmd.Process.Pid, err)
+		}
+		close(w.done)
+	}()
+
+	pool.mu.Lock()
+	pool.spawned++
+	pool.mu.Unlock()
+
+	return w, nil
+}
+
+// Keep the minimum number of idle workers, in the background
+func (pool *Pool) fill() {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	for !pool.closed && len(pool.idle)+pool.spawning < pool.depl.Function.Workers.Min && pool.total < pool.depl.Function.Workers.Max {
+		pool.total++
+		pool.spawning++
+		go func() {
+			w, err := pool.spawn()
+
+			pool.mu.Lock()
+			pool.spawning--
+			closed := pool.closed
+			pool.mu.Unlock()
+
+			if err != nil {
+				log.Printf("[%s] ERROR spawning worker: %v", pool.depl.DeploymentName, err)
+			} else if closed {
+				pool.discard(w)
+			} else {
+				pool.idle <- w
+			}
+		}()
+	}
+}
+
+// Take an idle worker or spawn a new one if the pool is not full, else wait for
+// a worker to be released
+func (pool *Pool) acquire(ctx context.Context) (*worker, error) {
+	for {
+		select {
+		case w := <-pool.idle:
+			if w.alive() {
+				return w, nil
+			}
+			pool.discard(w)
+			continue
+		default:
+		}
+
+		pool.mu.Lock()
+		if pool.total < pool.depl.Function.Workers.Max {
+			pool.total++
+			pool.mu.Unlock()
+			return pool.spawn()
+		}
+		pool.mu.Unlock()
+
+		select {
+		case w := <-pool.idle:
+			if w.alive() {
+				return w, nil
+			}
+			pool.discard(w)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Return the worker to the pool, or retire it if it cannot serve more requests
+func (pool *Pool) release(w *worker, reusable bool) {
+	max_requests := pool.depl.Function.Workers.MaxRequests
+
+	pool.mu.Lock()
+	closed := pool.closed
+	pool.mu.Unlock()
+
+	if reusable && !closed && w.alive() && (max_requests == 0 || w.requests < max_requests) {
+		pool.idle <- w
+		return
+	}
+
+	pool.mu.Lock()
+	if reusable && w.alive() {
+		pool.recycled++
+	}
+	pool.retiring++
+	pool.mu.Unlock()
+
+	go pool.finish(w)
+	pool.fill()
+}
+
+func (pool *Pool) discard(w *worker) {
+	pool.mu.Lock()
+	pool.retiring++
+	pool.mu.Unlock()
+
+	pool.finish(w)
+}
+
+// Retire a worker already counted as retiring and remove it from the pool
+func (pool *Pool) finish(w *worker) {
+	w.retire(5 * time.Second)
+
+	pool.mu.Lock()
+	pool.retiring--
+	pool.total--
+	pool.mu.Unlock()
+
+	pool.fill()
+}
+
+func (pool *Pool) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	w, err := pool.acquire(req.Context())
+	if err != nil {
+		log.Printf("[%s] ERROR acquiring worker: %v", pool.depl.DeploymentName, err)
+		http.Error(rw, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	pool.fill()
+
+	reusable, err := pool.forward(w, rw, req)
+	if err != nil {
+		log.Printf("[%s] ERROR forwarding request to worker %d: %v", pool.depl.DeploymentName, w.cmd.Process.Pid, err)
+	}
+
+	pool.mu.Lock()
+	pool.requests++
+	if err != nil {
+		pool.failed++
+	}
+	pool.mu.Unlock()
+
+	pool.release(w, reusable && err == nil)
+}
+
+// Write the request to the worker and copy back its response. Returns true if
+// the worker can serve another request.
+func (pool *Pool) forward(w *worker, rw http.ResponseWriter, req *http.Request) (bool, error) {
+	w.requests++
+
+	out := req.Clone(req.Context())
+	out.Close = false
+	for _, h := range hopHeaders {
+		out.Header.Del(h)
+	}
+
+	write_err := make(chan error, 1)
+	go func() {
+		write_err <- out.Write(w.stdin)
+	}()
+
+	resp, err := http.ReadResponse(w.stdout, out)
+	if err != nil {
+		http.Error(rw, "Bad Gateway", http.StatusBadGateway)
+		return false, fmt.Errorf("reading response, %v", err)
+	}
+	defer resp.Body.Close()
+
+	for _, h := range hopHeaders {
+		resp.Header.Del(h)
+	}
+	for key, values := range resp.Header {
+		for _, value := range values {
+			rw.Header().Add(key, value)
+		}
+	}
+	rw.WriteHeader(resp.StatusCode)
+
+	_, err = io.Copy(flushWriter{rw}, resp.Body)
+	if err != nil {
+		return false, fmt.Errorf("copying response, %v", err)
+	}
+
+	select {
+	case err = <-write_err:
+		if err != nil {
+			return false, fmt.Errorf("writing request, %v", err)
+		}
+	default:
+		// The worker answered before reading the whole request, it is
+		// retired and closing its standard input ends the write
+		log.Printf("[%s] Worker %d responded before reading the whole request, retiring it", pool.depl.DeploymentName, w.cmd.Process.Pid)
+		return false, nil
+	}
+
+	return !resp.Close, nil
+}
+
+// Flush the response after each write so that streamed responses are not
+// delayed
+type flushWriter struct {
+	http.ResponseWriter
+}
+
+func (f flushWriter) Write(p []byte) (int, error) {
+	n, err := f.ResponseWriter.Write(p)
+	if flusher, ok := f.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return n, err
+}
+
+type PoolStats struct {
+	Deployment  string `json:"deployment"`
+	Min         int    `json:"min"`
+	Max         int    `json:"max"`
+	MaxRequests int    `json:"max_requests"`
+	Workers     int    `json:"workers"`
+	Idle        int    `json:"idle"`
+	Busy        int    `json:"busy"`
+	Requests    int64  `json:"requests"`
+	Spawned     int64  `json:"spawned"`
+	Recycled    int64  `json:"recycled"`
+	Failed      int64  `json:"failed"`
+}
+
+func (pool *Pool) Stats() PoolStats {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	idle := len(pool.idle)
+	return PoolStats{
+		Deployment:  pool.depl.DeploymentName,
+		Min:         pool.depl.Function.Workers.Min,
+		Max:         pool.depl.Function.Workers.Max,
+		MaxRequests: pool.depl.Function.Workers.MaxRequests,
+		Workers:     pool.total,
+		Idle:        idle,
+		Busy:        max(pool.total-idle-pool.spawning-pool.retiring, 0),
+		Requests:    pool.requests,
+		Spawned:     pool.spawned,
+		Recycled:    pool.recycled,
+		Failed:      pool.failed,
+	}
+}
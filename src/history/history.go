@@ -0,0 +1,477 @@
+package history
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mildred/conductor.go/src/dirs"
+	"github.com/mildred/conductor.go/src/service"
+	"github.com/mildred/conductor.go/src/utils"
+)
+
+// The history store keeps a snapshot of each service revision that was
+// deployed. Files (templates and executables) are stored by content hash in the
+// objects directory, revisions are keyed by the service id and the hashes of
+// the stored files (the service id does not cover the content of templates and
+// executables), and the index records for each service the deployments created
+// for each revision. Revisions recorded before the files were part of the key
+// are keyed by service id only.
+
+var HistoryDir = dirs.Join(dirs.SelfStateHome, "history")
+var ObjectsDir = path.Join(HistoryDir, "objects")
+var RevisionsDir = path.Join(HistoryDir, "revisions")
+var IndexDir = path.Join(HistoryDir, "index")
+var CheckoutDir = path.Join(HistoryDir, "checkout")
+
+type Revision struct {
+	Key        string            `json:"key"`
+	ServiceId  string            `json:"service_id"`
+	ServiceDir string            `json:"service_dir"`
+	Time       time.Time         `json:"time"`
+	PartIds    map[string]string `json:"part_ids"`
+	Service    json.RawMessage   `json:"service"`
+	Files      map[string]string `json:"files"` // File path to object hash
+}
+
+type IndexEntry struct {
+	Time       time.Time `json:"time"`
+	ServiceId  string    `json:"service_id"`
+	Revision   string    `json:"revision,omitempty"` // Revision key
+	Part       string    `json:"part"`
+	PartId     string    `json:"part_id"`
+	Deployment string    `json:"deployment"`
+}
+
+type HistoryRevision struct {
+	Number      int       `json:"revision"`
+	Key         string    `json:"key"`
+	ServiceId   string    `json:"service_id"`
+	FirstTime   time.Time `json:"first_deployed"`
+	LastTime    time.Time `json:"last_deployed"`
+	Deployments []string  `json:"deployments"`
+	Current     bool      `json:"current"`
+	Pinned      bool      `json:"pinned"`
+}
+
+func indexPath(service_dir string) string {
+	return path.Join(IndexDir, service.ServiceUnit(service_dir)+".jsonl")
+}
+
+func revisionPath(key string) string {
+	return path.Join(RevisionsDir, key+".json")
+}
+
+// Return the revision key of the service id and stored files
+func revisionKey(service_id string, files map[string]string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n", service_id)
+	for _, p := range utils.SortedStringKeys(files) {
+		fmt.Fprintf(h, "%s\x00%s\n", p, files[p])
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))[:32]
+}
+
+// Return the key of the index entry, entries recorded before the files were
+// part of the key use the service id
+func (entry *IndexEntry) key() string {
+	if entry.Revision != "" {
+		return entry.Revision
+	}
+	return entry.ServiceId
+}
+
+func hashFile(fname string) (string, error) {
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", sha256.Sum256(data)), nil
+}
+
+// Return the hashes of the files referenced by the service, and store them in
+// the objects directory if store is true
+func fileHashes(svc *service.Service, store bool) (map[string]string, error) {
+	var files = map[string]string{}
+	for _, p := range svc.FilePaths() {
+		if _, ok := files[*p]; ok {
+			continue
+		}
+
+		var hash string
+		var err error
+		if store {
+			hash, err = storeObject(*p)
+		} else {
+			hash, err = hashFile(*p)
+		}
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("while storing %s in history, %v", *p, err)
+		}
+		files[*p] = hash
+	}
+	return files, nil
+}
+
+// Return the key of the revision currently deployed for the service
+func currentKey(svc *service.Service) (string, error) {
+	if svc.Pin != nil {
+		if svc.Pin.Revision != "" {
+			return svc.Pin.Revision, nil
+		}
+		return svc.Pin.ServiceId, nil
+	}
+
+	files, err := fileHashes(svc, false)
+	if err != nil {
+		return "", err
+	}
+	return revisionKey(svc.Id, files), nil
+}
+
+// Store a file in the objects directory and return its hash
+func storeObject(fname string) (string, error) {
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		return "", err
+	}
+
+	st, err := os.Stat(fname)
+	if err != nil {
+		return "", err
+	}
+
+	hash := fmt.Sprintf("%x", sha256.Sum256(data))
+	object := path.Join(ObjectsDir, hash)
+
+	_, err = os.Stat(object)
+	if err == nil {
+		return hash, nil
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	err = os.MkdirAll(ObjectsDir, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	var mode os.FileMode = 0644
+	if st.Mode()&0111 != 0 {
+		mode = 0755
+	}
+
+	tmp := object + ".tmp"
+	err = os.WriteFile(tmp, data, mode)
+	if err != nil {
+		return "", err
+	}
+
+	return hash, os.Rename(tmp, object)
+}
+
+// Store a snapshot of the service revision if not already present, the part
+// id is added to the revision, and return the revision key
+func storeRevision(svc *service.Service, part, part_id string) (string, error) {
+	files, err := fileHashes(svc, true)
+	if err != nil {
+		return "", err
+	}
+
+	key := revisionKey(svc.Id, files)
+
+	var rev Revision
+	data, err := os.ReadFile(revisionPath(key))
+	if err == nil {
+		err = json.Unmarshal(data, &rev)
+		if err != nil {
+			return "", fmt.Errorf("while reading revision %s, %v", key, err)
+		}
+		if id, ok := rev.PartIds[part]; ok && id == part_id {
+			return key, nil
+		}
+		if rev.PartIds == nil {
+			rev.PartIds = map[string]string{}
+		}
+		rev.PartIds[part] = part_id
+	} else if os.IsNotExist(err) {
+		rev = Revision{
+			Key:        key,
+			ServiceId:  svc.Id,
+			ServiceDir: svc.BasePath,
+			Time:       time.Now(),
+			PartIds:    map[string]string{part: part_id},
+			Files:      files,
+		}
+
+		rev.Service, err = json.Marshal(svc)
+		if err != nil {
+			return "", err
+		}
+	} else {
+		return "", err
+	}
+
+	data, err = json.MarshalIndent(&rev, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	err = os.MkdirAll(RevisionsDir, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	tmp := revisionPath(key) + ".tmp"
+	err = os.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return "", err
+	}
+
+	return key, os.Rename(tmp, revisionPath(key))
+}
+
+// Record in the history that a deployment was created for a service part
+func Record(svc *service.Service, part, part_id, deployment_name string) error {
+	var service_id = svc.Id
+	var key string
+	var err error
+	if svc.Pin != nil {
+		// Do not snapshot a snapshot, record the pinned revision instead
+		service_id = svc.Pin.ServiceId
+		key = svc.Pin.Revision
+	} else {
+		key, err = storeRevision(svc, part, part_id)
+		if err != nil {
+			return err
+		}
+	}
+
+	data, err := json.Marshal(&IndexEntry{
+		Time:       time.Now(),
+		ServiceId:  service_id,
+		Revision:   key,
+		Part:       part,
+		PartId:     part_id,
+		Deployment: deployment_name,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(IndexDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(indexPath(svc.BasePath), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+// List the revisions deployed for the service, oldest first
+func List(svc *service.Service) ([]*HistoryRevision, error) {
+	f, err := os.Open(indexPath(svc.BasePath))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	current, err := currentKey(svc)
+	if err != nil {
+		return nil, err
+	}
+
+	var revisions []*HistoryRevision
+	var by_key = map[string]*HistoryRevision{}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry IndexEntry
+		err = json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			return nil, fmt.Errorf("while reading %s, %v", indexPath(svc.BasePath), err)
+		}
+
+		key := entry.key()
+		rev, ok := by_key[key]
+		if !ok {
+			rev = &HistoryRevision{
+				Number:    len(revisions) + 1,
+				Key:       key,
+				ServiceId: entry.ServiceId,
+				FirstTime: entry.Time,
+				Current:   key == current,
+				Pinned:    svc.Pin != nil && key == current,
+			}
+			by_key[key] = rev
+			revisions = append(revisions, rev)
+		}
+		rev.LastTime = entry.Time
+		rev.Deployments = append(rev.Deployments, entry.Deployment)
+	}
+
+	return revisions, scanner.Err()
+}
+
+// Return true if a deployment was already created for the part id
+func PartDeployed(svc *service.Service, part_id string) (bool, error) {
+	f, err := os.Open(indexPath(svc.BasePath))
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry IndexEntry
+		err = json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			return false, fmt.Errorf("while reading %s, %v", indexPath(svc.BasePath), err)
+		}
+
+		if entry.PartId == part_id {
+			return true, nil
+		}
+	}
+
+	return false, scanner.Err()
+}
+
+// Find a revision by number, revision key or service id prefix. If empty, return the
+// revision deployed before the current one.
+func Find(svc *service.Service, rev string) (*HistoryRevision, error) {
+	revisions, err := List(svc)
+	if err != nil {
+		return nil, err
+	}
+
+	if rev == "" {
+		var current = len(revisions)
+		for i, r := range revisions {
+			if r.Current {
+				current = i
+			}
+		}
+		if current < 1 {
+			return nil, fmt.Errorf("no previous revision for service %s", svc.Name)
+		}
+		return revisions[current-1], nil
+	}
+
+	if num, err := strconv.Atoi(rev); err == nil {
+		if num < 1 || num > len(revisions) {
+			return nil, fmt.Errorf("revision %d not found for service %s", num, svc.Name)
+		}
+		return revisions[num-1], nil
+	}
+
+	var found *HistoryRevision
+	for _, r := range revisions {
+		if strings.HasPrefix(r.Key, rev) || strings.HasPrefix(r.ServiceId, rev) {
+			if found != nil {
+				return nil, fmt.Errorf("revision %q is ambiguous", rev)
+			}
+			found = r
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("revision %q not found for service %s", rev, svc.Name)
+	}
+	return found, nil
+}
+
+// Materialize the revision snapshot in the checkout directory, with file paths
+// pointing to copies of the snapshotted files, and return the service file
+func Checkout(key string) (string, error) {
+	data, err := os.ReadFile(revisionPath(key))
+	if err != nil {
+		return "", fmt.Errorf("while reading revision %s, %v", key, err)
+	}
+
+	var rev Revision
+	err = json.Unmarshal(data, &rev)
+	if err != nil {
+		return "", fmt.Errorf("while reading revision %s, %v", key, err)
+	}
+
+	var svc service.Service
+	err = json.Unmarshal(rev.Service, &svc)
+	if err != nil {
+		return "", fmt.Errorf("while reading revision %s, %v", key, err)
+	}
+
+	dir := path.Join(CheckoutDir, key)
+	err = os.MkdirAll(path.Join(dir, "files"), 0755)
+	if err != nil {
+		return "", err
+	}
+
+	for _, p := range svc.FilePaths() {
+		hash, ok := rev.Files[*p]
+		if !ok {
+			continue
+		}
+
+		object := path.Join(ObjectsDir, hash)
+		file := path.Join(dir, "files", hash+"-"+filepath.Base(*p))
+
+		content, err := os.ReadFile(object)
+		if err != nil {
+			return "", fmt.Errorf("while reading %s from history, %v", *p, err)
+		}
+
+		st, err := os.Stat(object)
+		if err != nil {
+			return "", err
+		}
+
+		err = os.WriteFile(file, content, st.Mode().Perm())
+		if err != nil {
+			return "", err
+		}
+
+		*p = file
+	}
+
+	data, err = json.MarshalIndent(&svc, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	fname := path.Join(dir, service.ConfigName)
+	return fname, os.WriteFile(fname, data, 0644)
+}
+
+// Pin the service to the revision snapshot
+func Pin(svc *service.Service, rev *HistoryRevision) error {
+	fname, err := Checkout(rev.Key)
+	if err != nil {
+		return err
+	}
+
+	return service.WritePin(svc.BasePath, &service.ServicePin{
+		ServiceId: rev.ServiceId,
+		Revision:  rev.Key,
+		File:      fname,
+	})
+}
@@ -2,6 +2,7 @@ package install
 
 import (
 	_ "embed"
+	"strings"
 
 	"github.com/mildred/conductor.go/src/dirs"
 )
@@ -61,3 +62,37 @@ var ConductorPolicyServerSocketLocation = dirs.Join(dirs.ConfigHome, "systemd",
 
 //go:embed files/conductor-policy-server.socket
 var ConductorPolicyServerSocket string
+
+///////////////////////////////////////////////////////////////////////////////
+
+var ConductorFastFunctionManagerServiceLocation = dirs.Join(dirs.ConfigHome, "systemd", dirs.SystemdMode(), "conductor-fast-function-manager.service")
+
+//go:embed files/conductor-fast-function-manager.service
+var ConductorFastFunctionManagerService string
+
+///////////////////////////////////////////////////////////////////////////////
+
+var ConductorAPIServerServiceLocation = dirs.Join(dirs.ConfigHome, "systemd", dirs.SystemdMode(), "conductor-api-server.service")
+
+//go:embed files/conductor-api-server.service
+var ConductorAPIServerService string
+
+///////////////////////////////////////////////////////////////////////////////
+
+var ConductorAPIServerSocketLocation = dirs.Join(dirs.ConfigHome, "systemd", dirs.SystemdMode(), "conductor-api-server.socket")
+
+//go:embed files/conductor-api-server.socket
+var ConductorAPIServerSocket string
+
+// Group allowed to connect to the API server socket in system mode, Caddy
+// must run with this group
+var CaddyGroup = "caddy"
+
+// The API server runs commands without checking policies, only Caddy must be
+// able to connect to it. In user mode the socket belongs to the user.
+func apiServerSocket() string {
+	if !dirs.AsRoot {
+		return ConductorAPIServerSocket
+	}
+	return strings.Replace(ConductorAPIServerSocket, "SocketMode=0660\n", "SocketMode=0660\nSocketGroup="+CaddyGroup+"\n", 1)
+}
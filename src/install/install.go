@@ -214,6 +214,24 @@ func Install(destdir string) error {
 		return err
 	}
 
+	fmt.Fprintf(os.Stderr, "+ touch %q\n", destdir+ConductorFastFunctionManagerServiceLocation)
+	err = os.WriteFile(destdir+ConductorFastFunctionManagerServiceLocation, []byte(ConductorFastFunctionManagerService), 0644)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "+ touch %q\n", destdir+ConductorAPIServerSocketLocation)
+	err = os.WriteFile(destdir+ConductorAPIServerSocketLocation, []byte(apiServerSocket()), 0644)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "+ touch %q\n", destdir+ConductorAPIServerServiceLocation)
+	err = os.WriteFile(destdir+ConductorAPIServerServiceLocation, []byte(ConductorAPIServerService), 0644)
+	if err != nil {
+		return err
+	}
+
 	/*
 		fmt.Fprintf(os.Stderr, "+ touch %q\n", destdir+ConductorFunctionSocketLocation)
 		err = os.WriteFile(destdir+ConductorFunctionSocketLocation, []byte(ConductorFunctionSocket), 0644)
@@ -301,6 +319,24 @@ func Uninstall(destdir string) error {
 		return err
 	}
 
+	fmt.Fprintf(os.Stderr, "+ rm -f %q\n", destdir+ConductorFastFunctionManagerServiceLocation)
+	err = os.Remove(destdir + ConductorFastFunctionManagerServiceLocation)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "+ rm -f %q\n", destdir+ConductorAPIServerSocketLocation)
+	err = os.Remove(destdir + ConductorAPIServerSocketLocation)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "+ rm -f %q\n", destdir+ConductorAPIServerServiceLocation)
+	err = os.Remove(destdir + ConductorAPIServerServiceLocation)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
 	fmt.Fprintf(os.Stderr, "+ systemctl %s daemon-reload\n", dirs.SystemdModeFlag())
 	cmd := exec.Command("systemctl", dirs.SystemdModeFlag(), "daemon-reload")
 	cmd.Stdout = os.Stdout
@@ -0,0 +1,275 @@
+package lock
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/unit"
+
+	"github.com/mildred/conductor.go/src/dirs"
+)
+
+// Operations on a service or a deployment hold an exclusive flock on a lock
+// file so that concurrent operations (an operator and a timer, or two
+// operators) are serialized. Locks are reentrant within a process, and the
+// lock file records the holder so that it can be shown while the lock is held.
+
+var Dir = dirs.Join(dirs.SelfRuntimeDir, "locks")
+
+// Wait for locks held by other processes, else fail immediately
+var Wait = true
+
+type Holder struct {
+	Pid       int       `json:"pid"`
+	Uid       int       `json:"uid"`
+	User      string    `json:"user"`
+	SudoUser  string    `json:"sudo_user,omitempty"`
+	Operation string    `json:"operation"`
+	Command   []string  `json:"command"`
+	Since     time.Time `json:"since"`
+}
+
+type Lock struct {
+	Name   string
+	Holder *Holder
+	file   *os.File
+	count  int
+}
+
+type LockedError struct {
+	Name   string
+	Holder *Holder
+}
+
+var locks = map[string]*Lock{}
+var mutex sync.Mutex
+
+func ServiceLockName(service_dir string) string {
+	return "service@" + unit.UnitNamePathEscape(service_dir)
+}
+
+func DeploymentLockName(deployment_name string) string {
+	return "deployment@" + deployment_name
+}
+
+func lockPath(name string) string {
+	return path.Join(Dir, name+".lock")
+}
+
+// Return who holds the lock
+func (h *Holder) Who() string {
+	if h.SudoUser != "" {
+		return fmt.Sprintf("%s (%s)", h.SudoUser, h.User)
+	}
+	return h.User
+}
+
+func (h *Holder) String() string {
+	if h == nil {
+		return "another process"
+	}
+
+	return fmt.Sprintf("pid %d (%s) for %s since %s", h.Pid, h.Who(), h.Operation, h.Since.Local().Format(time.DateTime))
+}
+
+func (err *LockedError) Error() string {
+	return fmt.Sprintf("%s is locked by %s", err.Name, err.Holder)
+}
+
+func newHolder(operation string) *Holder {
+	var h = &Holder{
+		Pid:       os.Getpid(),
+		Uid:       os.Getuid(),
+		SudoUser:  os.Getenv("SUDO_USER"),
+		Operation: operation,
+		Command:   os.Args,
+		Since:     time.Now(),
+	}
+	h.User = strconv.Itoa(h.Uid)
+	if u, err := user.LookupId(h.User); err == nil {
+		h.User = u.Username
+	}
+	return h
+}
+
+func readHolder(f *os.File) *Holder {
+	var h Holder
+	data := make([]byte, 64*1024)
+	n, _ := f.ReadAt(data, 0)
+	if n == 0 || json.Unmarshal(data[:n], &h) != nil {
+		return nil
+	}
+	return &h
+}
+
+// Acquire the lock, wait for it if Wait is true
+func Acquire(name, operation string) (*Lock, error) {
+	return acquire(name, operation, Wait)
+}
+
+// Acquire the lock if it is free, returns nil if it is held by another process
+func TryAcquire(name, operation string) (*Lock, error) {
+	l, err := acquire(name, operation, false)
+	var locked *LockedError
+	if errors.As(err, &locked) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func acquire(name, operation string, wait bool) (*Lock, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if l, ok := locks[name]; ok {
+		l.count++
+		return l, nil
+	}
+
+	err := os.MkdirAll(Dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(lockPath(name), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		holder := readHolder(f)
+		if !wait {
+			f.Close()
+			return nil, &LockedError{name, holder}
+		}
+
+		fmt.Fprintf(os.Stderr, "Waiting for %s, locked by %s...\n", name, holder)
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("while locking %s, %v", name, err)
+	}
+
+	var l = &Lock{
+		Name:   name,
+		Holder: newHolder(operation),
+		file:   f,
+		count:  1,
+	}
+
+	data, err := json.Marshal(l.Holder)
+	if err == nil {
+		err = f.Truncate(0)
+	}
+	if err == nil {
+		_, err = f.WriteAt(data, 0)
+	}
+	if err != nil {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+		return nil, fmt.Errorf("while writing lock %s, %v", name, err)
+	}
+
+	locks[name] = l
+	return l, nil
+}
+
+func (l *Lock) Unlock() {
+	if l == nil {
+		return
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	l.count--
+	if l.count > 0 {
+		return
+	}
+
+	delete(locks, l.Name)
+	l.file.Truncate(0)
+	syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+	l.file.Close()
+}
+
+// Release the lock held by the process while f runs so that other processes
+// can acquire it, and acquire it again before returning. Does nothing more
+// than running f if the lock is not held.
+func Released(name string, f func() error) error {
+	mutex.Lock()
+	l, ok := locks[name]
+	if ok {
+		delete(locks, name)
+		l.file.Truncate(0)
+		syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+	}
+	mutex.Unlock()
+
+	if !ok {
+		return f()
+	}
+
+	err := f()
+
+	er := syscall.Flock(int(l.file.Fd()), syscall.LOCK_EX)
+	if er != nil {
+		return errors.Join(err, fmt.Errorf("while locking %s again, %v", name, er))
+	}
+
+	l.Holder.Since = time.Now()
+	if data, er := json.Marshal(l.Holder); er == nil {
+		l.file.WriteAt(data, 0)
+	}
+
+	mutex.Lock()
+	locks[name] = l
+	mutex.Unlock()
+
+	return err
+}
+
+func Service(service_dir, operation string) (*Lock, error) {
+	return Acquire(ServiceLockName(service_dir), operation)
+}
+
+func Deployment(deployment_name, operation string) (*Lock, error) {
+	return Acquire(DeploymentLockName(deployment_name), operation)
+}
+
+// Return the holder of the lock, nil if the lock is free
+func Status(name string) (*Holder, error) {
+	f, err := os.Open(lockPath(name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_SH|syscall.LOCK_NB)
+	if err == nil {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		return nil, nil
+	} else if err != syscall.EWOULDBLOCK {
+		return nil, err
+	}
+
+	holder := readHolder(f)
+	if holder == nil {
+		holder = &Holder{}
+	}
+	return holder, nil
+}
@@ -5,6 +5,9 @@ import (
 	"fmt"
 	"os"
 	"path"
+
+	"github.com/mildred/conductor.go/src/audit"
+	"github.com/mildred/conductor.go/src/service"
 )
 
 func (p *Policy) Save() error {
@@ -23,6 +26,12 @@ func (p *Policy) WriteToDir(dir string) error {
 		return err
 	}
 
+	var old *Policy
+	if data, err := os.ReadFile(fname); err == nil {
+		old = &Policy{}
+		_ = json.Unmarshal(data, old)
+	}
+
 	f, err := os.Create(fname)
 	if err != nil {
 		return err
@@ -31,5 +40,66 @@ func (p *Policy) WriteToDir(dir string) error {
 	defer f.Close()
 
 	p.PolicyDir = dir
-	return json.NewEncoder(f).Encode(p)
+	err = json.NewEncoder(f).Encode(p)
+	if err != nil {
+		return err
+	}
+
+	p.audit(old, fname)
+	return nil
+}
+
+func matchJSON(p *Policy) []byte {
+	if p == nil || len(p.Match) == 0 {
+		return nil
+	}
+	data, _ := json.Marshal(p.Match)
+	return data
+}
+
+// Matchers can contain keys, only their keyed hash is recorded
+func matchHash(data []byte) json.RawMessage {
+	if data == nil {
+		return nil
+	}
+
+	hash, err := service.KeyedHash(data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: cannot hash the policy match for the audit log, %v\n", err)
+		return nil
+	}
+	return audit.Value("hmac-sha256:" + hash)
+}
+
+func (p *Policy) audit(old *Policy, fname string) {
+	var entry = &audit.Entry{
+		Action: audit.ActionPolicyCreate,
+		Policy: path.Base(p.PolicyDir),
+		File:   fname,
+	}
+
+	var old_authz json.RawMessage
+	if old != nil {
+		entry.Action = audit.ActionPolicyUpdate
+		if old.DefaultAuthorization != "" {
+			old_authz = audit.Value(old.DefaultAuthorization)
+		}
+	}
+
+	var new_authz json.RawMessage
+	if p.DefaultAuthorization != "" {
+		new_authz = audit.Value(p.DefaultAuthorization)
+	}
+	if string(old_authz) != string(new_authz) {
+		entry.Changes = append(entry.Changes, &audit.Change{Key: "default_authorization", Old: old_authz, New: new_authz})
+	}
+
+	if old_match, new_match := matchJSON(old), matchJSON(p); string(old_match) != string(new_match) {
+		entry.Changes = append(entry.Changes, &audit.Change{Key: "match", Old: matchHash(old_match), New: matchHash(new_match)})
+	}
+
+	err := audit.Record(entry)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: while writing audit log, %v\n", err)
+	}
 }
@@ -0,0 +1,159 @@
+package sandbox
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/mildred/conductor.go/src/dirs"
+)
+
+// Templates, hooks and commands can run through systemd-run in a transient
+// hardened service instead of running with the privileges and the environment
+// of conductor.
+
+const (
+	KindTemplate = "template"
+	KindHook     = "hook"
+	KindCommand  = "command"
+)
+
+type Profile struct {
+	Templates  bool     `json:"templates"`            // Run templates in the sandbox
+	Hooks      bool     `json:"hooks"`                // Run hooks in the sandbox
+	Commands   bool     `json:"commands"`             // Run commands in the sandbox
+	Network    bool     `json:"network"`              // Give network access to templates
+	Properties []string `json:"properties,omitempty"` // Additional unit properties (Key=Value)
+}
+
+type Run struct {
+	Kind       string
+	Dir        string        // Working directory, bound read-only
+	ServiceDir string        // Bound read-only
+	Env        []string      // The only environment variables available
+	Timeout    time.Duration // Maximum run time of the unit
+	Args       []string
+}
+
+func (p *Profile) Enabled(kind string) bool {
+	if p == nil {
+		return false
+	}
+
+	switch kind {
+	case KindTemplate:
+		return p.Templates
+	case KindHook:
+		return p.Hooks
+	case KindCommand:
+		return p.Commands
+	}
+	return false
+}
+
+// Directory of the environment files passed to the sandboxed units
+var EnvDir = path.Join(dirs.SelfRuntimeDir, "sandbox")
+
+// Escape a value for a double quoted string in a systemd EnvironmentFile
+var envFileEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "`", "\\`", `$`, `\$`)
+
+// Write the environment to a file only readable by its owner. The variables
+// can contain secrets and must not appear on the systemd-run command line or
+// in the unit Environment= property.
+func writeEnvFile(env []string) (string, error) {
+	err := os.MkdirAll(EnvDir, 0700)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.CreateTemp(EnvDir, "*.env")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	for _, e := range env {
+		k, v, _ := strings.Cut(e, "=")
+		_, err = fmt.Fprintf(f, "%s=\"%s\"\n", k, envFileEscaper.Replace(v))
+		if err != nil {
+			os.Remove(f.Name())
+			return "", err
+		}
+	}
+
+	return f.Name(), nil
+}
+
+// Return the systemd-run command running in the sandbox
+func (p *Profile) Command(ctx context.Context, run Run) (*exec.Cmd, error) {
+	var args = []string{
+		dirs.SystemdModeFlag(),
+		"--pipe",
+		"--wait",
+		"--quiet",
+		"--collect",
+		"--property=ProtectSystem=strict",
+		"--property=ProtectHome=read-only",
+		"--property=PrivateTmp=yes",
+		"--property=NoNewPrivileges=yes",
+	}
+
+	if dirs.AsRoot {
+		args = append(args, "--property=DynamicUser=yes")
+	}
+
+	if run.Kind == KindTemplate && !p.Network {
+		args = append(args, "--property=PrivateNetwork=yes")
+	}
+
+	var binds []string
+	for _, dir := range []string{run.ServiceDir, run.Dir} {
+		if dir != "" && !slices.Contains(binds, dir) {
+			binds = append(binds, dir)
+			args = append(args, "--property=BindReadOnlyPaths="+dir)
+		}
+	}
+
+	if run.Dir != "" {
+		args = append(args, "--working-directory="+run.Dir)
+	}
+
+	if run.Timeout > 0 {
+		args = append(args, fmt.Sprintf("--property=RuntimeMaxSec=%d", int64(math.Ceil(run.Timeout.Seconds()))))
+	}
+
+	for _, prop := range p.Properties {
+		args = append(args, "--property="+prop)
+	}
+
+	// The environment is not printed, it can contain secrets. Templates also
+	// get the variables as arguments, with the secrets masked, only the
+	// template name is printed to keep the line short.
+	printed_args := run.Args
+	if run.Kind == KindTemplate && len(printed_args) > 1 {
+		printed_args = []string{run.Args[0], "..."}
+	}
+	fmt.Fprintf(os.Stderr, "+ systemd-run %s -- %s\n", strings.Join(args, " "), strings.Join(printed_args, " "))
+
+	if len(run.Env) > 0 {
+		env_file, err := writeEnvFile(run.Env)
+		if err != nil {
+			return nil, fmt.Errorf("while writing sandbox environment, %v", err)
+		}
+
+		// The environment file is read by the service manager before it drops
+		// privileges and is removed with full privileges when the unit stops
+		args = append(args,
+			"--property=EnvironmentFile="+env_file,
+			"--property=ExecStopPost=+/bin/rm -f "+env_file)
+	}
+
+	args = append(append(args, "--"), run.Args...)
+	return exec.CommandContext(ctx, "systemd-run", args...), nil
+}
@@ -1,11 +1,20 @@
 package service
 
 import (
+	"encoding/json"
+	"fmt"
 	"strings"
 
+	"github.com/mildred/conductor.go/src/caddy"
+	"github.com/mildred/conductor.go/src/dirs"
 	"github.com/mildred/conductor.go/src/utils"
 )
 
+// Unit and socket of the API server running commands exposed over HTTP
+const CommandAPIUnit = "conductor-api-server.socket"
+
+var CommandAPISocketPath = dirs.Join(dirs.RuntimeDir, "conductor-api.socket")
+
 type HelpFlag struct {
 	Name string
 	Help string
@@ -32,3 +41,78 @@ func (c *ServiceCommand) GetTabbedHelpFlags() *utils.Tabbed {
 	}
 	return result.Tabulate()
 }
+
+func (commands ServiceCommands) FillDefaults() error {
+	for name, c := range commands {
+		if c.HTTP == nil {
+			continue
+		}
+
+		if len(c.HTTP.Policies) == 0 {
+			return fmt.Errorf("command %s: http requires at least one policy", name)
+		}
+
+		if len(c.Exec) == 0 {
+			return fmt.Errorf("command %s: http requires exec", name)
+		}
+	}
+	return nil
+}
+
+func (commands ServiceCommands) HasHTTP() bool {
+	for _, c := range commands {
+		if c.HTTP != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *ServiceCommand) CaddyConfigName(service *Service, name string) string {
+	return fmt.Sprintf("conductor-command.%s.%s.%s", service.AppName, service.InstanceName, name)
+}
+
+// Path of the command on the load-balancer
+func CommandHTTPPath(service *Service, name string) string {
+	return fmt.Sprintf("/cmd/%s.%s/%s", service.AppName, service.InstanceName, name)
+}
+
+// Route the command path to the API server, after checking the policies
+func (c *ServiceCommand) ReverseProxyConfig(service *Service, name string) (*caddy.ConfigItem, error) {
+	if c.HTTP == nil {
+		return nil, nil
+	}
+
+	route, err := json.Marshal(map[string]interface{}{
+		"@id": c.CaddyConfigName(service, name),
+		"match": []interface{}{
+			map[string]interface{}{
+				"path": []string{CommandHTTPPath(service, name)},
+			},
+		},
+		"handle": []interface{}{
+			PolicyAuthHandler(c.HTTP.Policies),
+			map[string]interface{}{
+				"handler": "reverse_proxy",
+				// Stream the command output as soon as it is written
+				"flush_interval": -1,
+				"transport": map[string]interface{}{
+					"protocol": "http",
+				},
+				"upstreams": []interface{}{
+					map[string]interface{}{
+						"dial": "unix/" + CommandAPISocketPath,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &caddy.ConfigItem{
+		MountPoint: "conductor-server/routes",
+		Config:     route,
+	}, nil
+}
@@ -22,11 +22,14 @@ import (
 
 	"github.com/mildred/conductor.go/src/caddy"
 	"github.com/mildred/conductor.go/src/dirs"
+	"github.com/mildred/conductor.go/src/lock"
+	"github.com/mildred/conductor.go/src/sandbox"
 	"github.com/mildred/conductor.go/src/tmpl"
 	"github.com/mildred/conductor.go/src/utils"
 )
 
 type Hook struct {
+	MergeDirectives
 	Id         string   `json:"id"`
 	When       string   `json:"when"`
 	Exec       []string `json:"exec"`
@@ -40,37 +43,51 @@ type CaddyConfig struct {
 }
 
 type ServiceCommand struct {
-	Deployment           bool       `json:"deployment"`
-	Service              bool       `json:"service"`
-	ServiceAnyDeployment bool       `json:"service_any_deployment"`
-	Description          string     `json:"description"`
-	Exec                 []string   `json:"exec"`
-	HelpFlags            [][]string `json:"help_flags"`
-	HelpArgs             []string   `json:"help_args"`
+	MergeDirectives
+	Deployment           bool         `json:"deployment"`
+	Service              bool         `json:"service"`
+	ServiceAnyDeployment bool         `json:"service_any_deployment"`
+	Description          string       `json:"description"`
+	Exec                 []string     `json:"exec"`
+	HelpFlags            [][]string   `json:"help_flags"`
+	HelpArgs             []string     `json:"help_args"`
+	HTTP                 *CommandHTTP `json:"http,omitempty"`
+}
+
+type CommandHTTP struct {
+	Policies []string `json:"policies"`
 }
 
 type Service struct {
-	BasePath                string                     `json:"-"`
-	FileName                string                     `json:"-"`
-	ConfigSetFile           string                     `json:"-"`
-	Name                    string                     `json:"-"`
-	Id                      string                     `json:"-"`
-	Inherit                 *InheritedFile             `json:"-"`
-	AppName                 string                     `json:"app_name,omitempty"`      // my-app
-	InstanceName            string                     `json:"instance_name,omitempty"` // staging
-	Disable                 *bool                      `json:"disable"`
-	AutoRestart             *bool                      `json:"auto_restart"`
-	Conditions              []ServiceCondition         `json:"conditions"`
-	Config                  map[string]*ConfigValue    `json:"config,omitempty"`                // key-value pairs for config and templating, CHANNEL=staging
-	ProxyConfigTemplate     string                     `json:"proxy_config_template,omitempty"` // Template file for the load-balancer config
-	Pods                    ServicePods                `json:"pods,omitempty"`
-	Functions               ServiceFunctions           `json:"functions,omitempty"`
-	Hooks                   []*Hook                    `json:"hooks,omitempty"`
-	CaddyLoadBalancer       CaddyConfig                `json:"caddy_load_balancer"`
-	DisplayServiceConfig    []DisplayColumn            `json:"display_service_config"`
-	DisplayServiceDepConfig *[]DisplayColumn           `json:"display_service_deployment_config"`
-	DisplayDeploymentConfig []DisplayColumn            `json:"display_deployment_config"`
-	Commands                map[string]*ServiceCommand `json:"commands"`
+	BasePath                string                      `json:"-"`
+	FileName                string                      `json:"-"`
+	ConfigSetFile           string                      `json:"-"`
+	Name                    string                      `json:"-"`
+	Id                      string                      `json:"-"`
+	Inherit                 *InheritedFile              `json:"-"`
+	Pin                     *ServicePin                 `json:"-"`
+	Provenance              Provenances                 `json:"-"`
+	RawConfig               map[string]string           `json:"-"`                       // Config values before expansion
+	AppName                 string                      `json:"app_name,omitempty"`      // my-app
+	InstanceName            string                      `json:"instance_name,omitempty"` // staging
+	Disable                 *bool                       `json:"disable"`
+	AutoRestart             *bool                       `json:"auto_restart"`
+	Conditions              MergeList[ServiceCondition] `json:"conditions"`
+	Config                  map[string]*ConfigValue     `json:"config,omitempty"`                // key-value pairs for config and templating, CHANNEL=staging
+	ProxyConfigTemplate     string                      `json:"proxy_config_template,omitempty"` // Template file for the load-balancer config
+	Pods                    ServicePods                 `json:"pods,omitempty"`
+	Functions               ServiceFunctions            `json:"functions,omitempty"`
+	Hooks                   []*Hook                     `json:"hooks,omitempty"`
+	CaddyLoadBalancer       CaddyConfig                 `json:"caddy_load_balancer"`
+	DisplayServiceConfig    MergeList[DisplayColumn]    `json:"display_service_config"`
+	DisplayServiceDepConfig *MergeList[DisplayColumn]   `json:"display_service_deployment_config"`
+	DisplayDeploymentConfig MergeList[DisplayColumn]    `json:"display_deployment_config"`
+	Commands                ServiceCommands             `json:"commands"`
+	Rollout                 *RolloutConfig              `json:"rollout,omitempty"`
+	TemplateTimeout         utils.JSONDuration          `json:"template_timeout,omitempty"` // Timeout of executable templates
+	Sandbox                 *sandbox.Profile            `json:"sandbox,omitempty"`          // Run templates, hooks and commands with systemd-run
+	CrashLoop               *CrashLoopConfig            `json:"crash_loop,omitempty"`
+	StaticDeployments       bool                        `json:"static_deployments,omitempty"` // Create deployments only on configuration changes
 }
 
 type DisplayColumn struct {
@@ -201,6 +218,16 @@ func ServiceConfigUnit(path string) string {
 	return fmt.Sprintf("conductor-service-config@%s.service", unit.UnitNamePathEscape(path))
 }
 
+// Lock the service for the operation, see the lock package
+func LockServiceByName(name, operation string) (*lock.Lock, error) {
+	dir, err := ServiceDirByName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return lock.Service(dir, operation)
+}
+
 func ServiceDirFromUnit(u string) string {
 	s := strings.TrimSuffix(u, ".service")
 	splits := strings.SplitN(s, "@", 2)
@@ -235,6 +262,29 @@ func LoadServiceFile(path string) (*Service, error) {
 		return nil, fmt.Errorf("while loading service %q, %v", path, err)
 	}
 
+	err = service.ExpandConfig()
+	if err != nil {
+		return nil, fmt.Errorf("while loading service %q, %v", path, err)
+	}
+
+	pin, err := ReadPin(service.BasePath)
+	if err != nil {
+		return nil, fmt.Errorf("while reading pin for service %q, %v", path, err)
+	} else if pin != nil {
+		pinned, err := loadService(pin.File, false, nil, nil)
+		if err != nil {
+			return nil, fmt.Errorf("while loading service %q pinned to %s, %v", path, pin.ServiceId, err)
+		}
+
+		pinned.BasePath = service.BasePath
+		pinned.FileName = service.FileName
+		pinned.ConfigSetFile = service.ConfigSetFile
+		pinned.Inherit = service.Inherit
+		pinned.Pin = pin
+		pinned.overlayOperational(service)
+		service = pinned
+	}
+
 	err = service.FillDefaults()
 	if err != nil {
 		return nil, err
@@ -254,13 +304,63 @@ func LoadServiceFile(path string) (*Service, error) {
 	return service, nil
 }
 
+// The operational settings changed by enable, disable and scale, and the
+// conditions are taken from the service files even when the service is pinned
+func (service *Service) overlayOperational(live *Service) {
+	service.Disable = live.Disable
+	service.Conditions = live.Conditions
+	for _, pod := range service.Pods {
+		if live_pod := live.FindPod(pod.Name); live_pod != nil {
+			pod.Replicas = live_pod.Replicas
+		}
+	}
+}
+
+// Contents of the files being edited, read instead of the files on disk
+var editedFiles = map[string][]byte{}
+
+func sourceKey(path string) string {
+	if real, err := realpath.Realpath(path); err == nil {
+		return real
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	return abs
+}
+
+func readSourceFile(path string) ([]byte, error) {
+	if data, ok := editedFiles[sourceKey(path)]; ok {
+		return slices.Clone(data), nil
+	}
+	return os.ReadFile(path)
+}
+
+func statSourceFile(path string) error {
+	if _, ok := editedFiles[sourceKey(path)]; ok {
+		return nil
+	}
+	_, err := os.Stat(path)
+	return err
+}
+
 func loadService(path string, fix_paths bool, base *Service, inh *InheritFile) (*Service, error) {
 	dir := filepath.Dir(path)
-	data, err := os.ReadFile(path)
+	data, err := readSourceFile(path)
 	if err != nil {
 		return nil, err
 	}
 
+	for _, problem := range UnknownFields(path, data) {
+		log.Printf("warning: %s", problem)
+	}
+
+	data, err = hujson.Standardize(data)
+	if err != nil {
+		return nil, fmt.Errorf("while reading %q, %v", path, err)
+	}
+
 	inherit, err := DecodeInherit(data, dir)
 	if err != nil {
 		return nil, fmt.Errorf("while reading %q, %v", path, err)
@@ -286,7 +386,7 @@ func loadService(path string, fix_paths bool, base *Service, inh *InheritFile) (
 			}
 
 			if inherit.IgnoreError {
-				_, err = os.Stat(inherit.Path)
+				err = statSourceFile(inherit.Path)
 				if err != nil && os.IsNotExist(err) {
 					// log.Printf("service: %s could inherit from %s (not found)", dir, inherit.Path)
 					continue
@@ -310,17 +410,14 @@ func loadService(path string, fix_paths bool, base *Service, inh *InheritFile) (
 	last_hooks := service.Hooks
 	service.Hooks = []*Hook{}
 
-	data, err = hujson.Standardize(data)
-	if err != nil {
-		return nil, err
-	}
-
 	err = json.Unmarshal(data, service)
 	if err != nil {
 		return nil, err
 	}
 
+	file_hooks := service.Hooks
 	service.Hooks = merge_hooks(last_hooks, service.Hooks)
+	service.recordProvenance(path, data, file_hooks)
 
 	service.BasePath = dir
 
@@ -356,6 +453,15 @@ func loadService(path string, fix_paths bool, base *Service, inh *InheritFile) (
 				return nil, err
 			}
 		}
+
+		for _, value := range service.Config {
+			if value == nil || value.Secret == nil {
+				continue
+			}
+			if err := value.Secret.FixPaths(dir); err != nil {
+				return nil, err
+			}
+		}
 	}
 
 	return service, nil
@@ -368,6 +474,15 @@ func merge_hooks(layer1 []*Hook, layer2 []*Hook) []*Hook {
 		if layered_hook.Id != "" {
 			i = slices.IndexFunc(result, func(h *Hook) bool { return h.Id == layered_hook.Id })
 		}
+		if layered_hook.Remove {
+			// remove the inherited hook
+			if i != -1 {
+				result = slices.Delete(result, i, i+1)
+			}
+			continue
+		}
+		// hooks are always replaced, $replace has no effect
+		layered_hook.MergeDirectives = MergeDirectives{}
 		if i == -1 {
 			// new hook, append to results
 			result = append(result, layered_hook)
@@ -398,6 +513,25 @@ func (service *Service) FillDefaults() error {
 		return err
 	}
 
+	err = service.Commands.FillDefaults()
+	if err != nil {
+		return err
+	}
+
+	if service.Rollout != nil {
+		err = service.Rollout.FillDefaults()
+		if err != nil {
+			return err
+		}
+	}
+
+	if service.CrashLoop != nil {
+		err = service.CrashLoop.FillDefaults()
+		if err != nil {
+			return err
+		}
+	}
+
 	if service.AutoRestart == nil {
 		var auto_restart = true
 		service.AutoRestart = &auto_restart
@@ -419,8 +553,46 @@ func (service *Service) FillDefaults() error {
 	return nil
 }
 
+// Return a copy of the service with only the data relevant to compute its id
+func (service *Service) filteredForId(exclude_vars []string) (*Service, error) {
+	var filtered_service = &Service{}
+	*filtered_service = *service
+
+	// Secrets are part of the id through the hash of their content
+	filtered_service.Config = map[string]*ConfigValue{}
+	for k, v := range service.Config {
+		if !slices.Contains(exclude_vars, k) {
+			value, err := v.withHash()
+			if err != nil {
+				return nil, fmt.Errorf("config %s, %v", k, err)
+			}
+			filtered_service.Config[k] = value
+		}
+	}
+
+	// The crash-loop protection and static deployments do not change the
+	// deployments
+	filtered_service.CrashLoop = nil
+	filtered_service.StaticDeployments = false
+
+	// The number of replicas can change without changing the deployments
+	filtered_service.Pods = nil
+	for _, pod := range service.Pods {
+		var filtered_pod = *pod
+		filtered_pod.Replicas = 0
+		filtered_service.Pods = append(filtered_service.Pods, &filtered_pod)
+	}
+
+	return filtered_service, nil
+}
+
 func (service *Service) ComputeIdData(extra string) ([]byte, error) {
-	data, err := json.Marshal(service)
+	filtered_service, err := service.filteredForId(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(filtered_service)
 	if err != nil {
 		return nil, err
 	}
@@ -434,18 +606,9 @@ func (service *Service) ComputeIdData(extra string) ([]byte, error) {
 }
 
 func (service *Service) ComputeId(extra string, exclude_vars []string) (string, error) {
-	var filtered_service *Service
-	if len(exclude_vars) == 0 {
-		filtered_service = service
-	} else {
-		filtered_service = &Service{}
-		*filtered_service = *service
-		filtered_service.Config = map[string]*ConfigValue{}
-		for k, v := range service.Config {
-			if !slices.Contains(exclude_vars, k) {
-				filtered_service.Config[k] = v
-			}
-		}
+	filtered_service, err := service.filteredForId(exclude_vars)
+	if err != nil {
+		return "", err
 	}
 
 	data, err := json.Marshal(filtered_service)
@@ -509,7 +672,7 @@ func (service *Service) PartId(ctx context.Context, part string) (string, error)
 	if part_id_template != "" {
 		data, err := tmpl.RunTemplate(ctx, part_id_template, append(service.VarsExcluding(excluded_vars),
 			"CONDUCTOR_SERVICE_PART="+part,
-		))
+		), service.PartTemplateOptions(part))
 
 		if err != nil {
 			return "", err
@@ -533,7 +696,21 @@ func (service *Service) Vars() []string {
 	return service.VarsExcluding(nil)
 }
 
+// Variables for display, secrets are masked
+func (service *Service) MaskedVars() []string {
+	return service.vars(nil, true)
+}
+
+// Variables for templates, hooks and commands, secrets are read
 func (service *Service) VarsExcluding(excluded []string) []string {
+	return service.vars(excluded, false)
+}
+
+func (service *Service) MaskedVarsExcluding(excluded []string) []string {
+	return service.vars(excluded, true)
+}
+
+func (service *Service) vars(excluded []string, masked bool) []string {
 	name := service.Name
 	if name == "" {
 		name = service.BasePath
@@ -548,13 +725,61 @@ func (service *Service) VarsExcluding(excluded []string) []string {
 		"CONDUCTOR_SERVICE_CONFIG_UNIT=" + ServiceConfigUnit(service.BasePath),
 	}
 	for k, v := range service.Config {
-		if !slices.Contains(excluded, k) {
+		if slices.Contains(excluded, k) {
+			continue
+		} else if masked {
 			vars = append(vars, fmt.Sprintf("%s=%s", k, v))
+			continue
 		}
+
+		value, err := v.Resolve()
+		if err != nil {
+			log.Printf("while reading secret %s, %v", k, err)
+			continue
+		}
+		vars = append(vars, fmt.Sprintf("%s=%s", k, value))
 	}
 	return vars
 }
 
+// Options for templates run in the context of the service
+func (service *Service) TemplateOptions() *tmpl.Options {
+	return &tmpl.Options{
+		Data: map[string]interface{}{
+			"Service":   service,
+			"Pods":      service.Pods,
+			"Functions": service.Functions,
+		},
+		Timeout:    time.Duration(service.TemplateTimeout),
+		Sandbox:    service.Sandbox,
+		ServiceDir: service.BasePath,
+		Secrets:    service.SecretNames(),
+	}
+}
+
+// Return the names of the config variables holding secrets
+func (service *Service) SecretNames() []string {
+	var names []string
+	for _, k := range utils.SortedStringKeys(service.Config) {
+		if v := service.Config[k]; v != nil && v.Kind == ConfigValueSecret {
+			names = append(names, k)
+		}
+	}
+	return names
+}
+
+// Options for templates run in the context of a part
+func (service *Service) PartTemplateOptions(part string) *tmpl.Options {
+	opts := service.TemplateOptions()
+	opts.Data["Part"] = part
+	if pod := service.FindPod(part); pod != nil && pod.TemplateTimeout > 0 {
+		opts.Timeout = time.Duration(pod.TemplateTimeout)
+	} else if f := service.FindFunction(part); f != nil && f.TemplateTimeout > 0 {
+		opts.Timeout = time.Duration(f.TemplateTimeout)
+	}
+	return opts
+}
+
 func (service *Service) FindPod(part_name string) *ServicePod {
 	for _, pod := range service.Pods {
 		if pod.Name == part_name {
@@ -609,9 +834,18 @@ func (service *Service) ProxyConfig(ctx context.Context) (caddy.ConfigItems, err
 		configs = append(configs, cfgs...)
 	}
 
+	for _, name := range utils.SortedStringKeys(service.Commands) {
+		cfg, err := service.Commands[name].ReverseProxyConfig(service, name)
+		if err != nil {
+			return nil, err
+		} else if cfg != nil {
+			configs = append(configs, cfg)
+		}
+	}
+
 	if service.ProxyConfigTemplate != "" {
 		var c caddy.ConfigItems
-		err := tmpl.RunTemplateJSON(ctx, service.ProxyConfigTemplate, service.Vars(), &c)
+		err := tmpl.RunTemplateJSON(ctx, service.ProxyConfigTemplate, service.Vars(), service.TemplateOptions(), &c)
 		if err != nil {
 			return nil, err
 		}
@@ -684,7 +918,18 @@ func (s *Service) GetDisplayColumn(c DisplayColumn, runner CommandRunnerDisplayC
 	}
 }
 
-func (s *Service) EvaluateCondition(verbose bool) (condition bool, disable bool, err error) {
+// Evaluate the conditions without running the command conditions, their last
+// recorded result is used instead
+func (s *Service) EvaluateCondition(verbose bool) (res *ConditionResult, disable bool, err error) {
+	return s.evaluateConditionTree(verbose, false)
+}
+
+// Evaluate the conditions and run the command conditions
+func (s *Service) EvaluateConditionTree(verbose bool) (res *ConditionResult, disable bool, err error) {
+	return s.evaluateConditionTree(verbose, true)
+}
+
+func (s *Service) evaluateConditionTree(verbose, probe bool) (res *ConditionResult, disable bool, err error) {
 	disable = false
 	if s.Disable != nil {
 		disable = *s.Disable
@@ -693,9 +938,16 @@ func (s *Service) EvaluateCondition(verbose bool) (condition bool, disable bool,
 		}
 	}
 
-	condition, err = EvaluateConditions(s.Conditions, verbose)
+	res, err = EvaluateConditions(s.Conditions, s.BasePath, probe)
+	if err != nil {
+		return nil, disable, err
+	}
+
+	if verbose {
+		logConditionResult(res)
+	}
 
-	return condition, disable, err
+	return res, disable, nil
 }
 
 func (s *Service) RunHooks(ctx context.Context, when string, part string, vars []string, extend_timeout time.Duration) error {
@@ -737,8 +989,25 @@ func (s *Service) RunHooks(ctx context.Context, when string, part string, vars [
 			//  		"--collect",
 			//  		"--unit=" + fmt.Sprintf("hook-%s-%s", depl.DeploymentName, when),
 			//  	}, hook.Exec...)...)
-			cmd := exec.Command(hook.Exec[0], hook.Exec[1:]...)
-			cmd.Env = append(cmd.Environ(), vars...)
+			var cmd *exec.Cmd
+			if s.Sandbox.Enabled(sandbox.KindHook) {
+				var err error
+				wd, _ := os.Getwd()
+				cmd, err = s.Sandbox.Command(ctx1, sandbox.Run{
+					Kind:       sandbox.KindHook,
+					Dir:        wd,
+					ServiceDir: s.BasePath,
+					Env:        vars,
+					Timeout:    time.Duration(hook.TimeoutSec * int64(time.Second)),
+					Args:       hook.Exec,
+				})
+				if err != nil {
+					return err
+				}
+			} else {
+				cmd = exec.Command(hook.Exec[0], hook.Exec[1:]...)
+				cmd.Env = append(cmd.Environ(), vars...)
+			}
 			cmd.Stdout = os.Stdout
 			cmd.Stderr = os.Stderr
 			return cmd.Run()
@@ -1,6 +1,7 @@
 package service
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 )
@@ -12,21 +13,51 @@ const (
 	ConfigValueString = iota
 	ConfigValueTrue
 	ConfigValueFalse
+	ConfigValueSecret
 )
 
 type ConfigValue struct {
-	Kind ConfigValueKind
-	Str  string
+	Kind   ConfigValueKind
+	Str    string
+	Secret *ConfigSecret
 }
 
+// Return the value, secrets are masked
 func (v *ConfigValue) String() string {
 	if v == nil {
 		return ""
+	} else if v.Kind == ConfigValueSecret {
+		return SecretMask
 	}
 
 	return v.Str
 }
 
+// Return the value, secrets are read
+func (v *ConfigValue) Resolve() (string, error) {
+	if v == nil {
+		return "", nil
+	} else if v.Kind == ConfigValueSecret {
+		return v.Secret.Read()
+	}
+
+	return v.Str, nil
+}
+
+// Return a copy of the value with the secret hash, to compute the service id
+func (v *ConfigValue) withHash() (*ConfigValue, error) {
+	if v == nil || v.Kind != ConfigValueSecret {
+		return v, nil
+	}
+
+	secret, err := v.Secret.withHash()
+	if err != nil {
+		return nil, err
+	}
+
+	return &ConfigValue{ConfigValueSecret, "", secret}, nil
+}
+
 func (v *ConfigValue) UnmarshalJSON(data []byte) error {
 	var value interface{}
 	err := json.Unmarshal(data, &value)
@@ -36,19 +67,32 @@ func (v *ConfigValue) UnmarshalJSON(data []byte) error {
 
 	switch val := value.(type) {
 	case string:
-		*v = ConfigValue{ConfigValueString, val}
+		*v = ConfigValue{ConfigValueString, val, nil}
 	case float64:
-		*v = ConfigValue{ConfigValueString, fmt.Sprintf("%v", val)}
+		*v = ConfigValue{ConfigValueString, fmt.Sprintf("%v", val), nil}
 	case bool:
 		if val {
-			*v = ConfigValue{ConfigValueTrue, "true"}
+			*v = ConfigValue{ConfigValueTrue, "true", nil}
 		} else {
-			*v = ConfigValue{ConfigValueFalse, "false"}
+			*v = ConfigValue{ConfigValueFalse, "false", nil}
 		}
 	case nil:
-		*v = ConfigValue{ConfigValueNull, ""}
+		*v = ConfigValue{ConfigValueNull, "", nil}
+	case map[string]interface{}:
+		var secret ConfigSecret
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&secret)
+		if err != nil {
+			return fmt.Errorf("cannot decode secret configuration value %s, %v", string(data), err)
+		}
+		secret.Hash = ""
+		if err = secret.check(); err != nil {
+			return err
+		}
+		*v = ConfigValue{ConfigValueSecret, "", &secret}
 	default:
-		return fmt.Errorf("cannot decode configuration value %s, must be a string", string(data))
+		return fmt.Errorf("cannot decode configuration value %s, must be a string or a secret", string(data))
 	}
 
 	return nil
@@ -62,6 +106,8 @@ func (v *ConfigValue) MarshalJSON() ([]byte, error) {
 		return []byte("true"), nil
 	case ConfigValueFalse:
 		return []byte("false"), nil
+	case ConfigValueSecret:
+		return json.Marshal(v.Secret)
 	}
 
 	return json.Marshal(v.Str)
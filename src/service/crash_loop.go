@@ -0,0 +1,72 @@
+package service
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mildred/conductor.go/src/utils"
+)
+
+// Deployments failing to start or crashing are counted per part id. New
+// deployments are started after an exponential backoff and past the maximum
+// number of failures within the window, the part is degraded and no new
+// deployment is created until the configuration changes or the failures are
+// reset.
+
+type CrashLoopConfig struct {
+	MaxFailures int                `json:"max_failures,omitempty"` // Negative to never degrade the service
+	Window      utils.JSONDuration `json:"window,omitempty"`
+	Backoff     utils.JSONDuration `json:"backoff,omitempty"` // Delay after the first failure, doubled after each failure
+	MaxBackoff  utils.JSONDuration `json:"max_backoff,omitempty"`
+}
+
+func (crash_loop *CrashLoopConfig) FillDefaults() error {
+	if crash_loop.MaxFailures == 0 {
+		crash_loop.MaxFailures = 5
+	}
+	if crash_loop.Window == 0 {
+		crash_loop.Window = utils.JSONDuration(10 * time.Minute)
+	}
+	if crash_loop.Backoff == 0 {
+		crash_loop.Backoff = utils.JSONDuration(10 * time.Second)
+	}
+	if crash_loop.MaxBackoff == 0 {
+		crash_loop.MaxBackoff = utils.JSONDuration(5 * time.Minute)
+	}
+
+	if crash_loop.Window < 0 || crash_loop.Backoff < 0 || crash_loop.MaxBackoff < 0 {
+		return fmt.Errorf("crash_loop durations must be positive")
+	}
+	return nil
+}
+
+// Return the crash-loop settings of the service, the defaults if not
+// configured
+func (service *Service) CrashLoopSettings() *CrashLoopConfig {
+	if service.CrashLoop != nil {
+		return service.CrashLoop
+	}
+
+	var crash_loop = &CrashLoopConfig{}
+	crash_loop.FillDefaults()
+	return crash_loop
+}
+
+// Return the delay before starting a new deployment after the number of
+// failures
+func (crash_loop *CrashLoopConfig) BackoffDelay(failures int) time.Duration {
+	if failures <= 0 {
+		return 0
+	}
+
+	delay := time.Duration(crash_loop.Backoff)
+	for i := 1; i < failures && delay < time.Duration(crash_loop.MaxBackoff); i++ {
+		delay = 2 * delay
+	}
+	return min(delay, time.Duration(crash_loop.MaxBackoff))
+}
+
+// Return true if the number of failures degrades the service
+func (crash_loop *CrashLoopConfig) Degrades(failures int) bool {
+	return crash_loop.MaxFailures > 0 && failures >= crash_loop.MaxFailures
+}
@@ -0,0 +1,244 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+type DiffEntry struct {
+	Path    string          `json:"path"` // config.KEY, pods[NAME].image, ...
+	Old     json.RawMessage `json:"old,omitempty"`
+	New     json.RawMessage `json:"new,omitempty"`
+	Ignored string          `json:"ignored,omitempty"` // Why the difference does not change the part id
+}
+
+func (d *DiffEntry) Kind() string {
+	if d.Old == nil {
+		return "+"
+	} else if d.New == nil {
+		return "-"
+	} else {
+		return "~"
+	}
+}
+
+func (d *DiffEntry) String() string {
+	var res string
+	switch d.Kind() {
+	case "+":
+		res = fmt.Sprintf("+ %s: %s", d.Path, d.New)
+	case "-":
+		res = fmt.Sprintf("- %s: %s", d.Path, d.Old)
+	default:
+		res = fmt.Sprintf("~ %s: %s -> %s", d.Path, d.Old, d.New)
+	}
+	if d.Ignored != "" {
+		res += fmt.Sprintf(" (ignored: %s)", d.Ignored)
+	}
+	return res
+}
+
+// Compare the data used to compute the ids of two services. If part is not
+// empty, differences that do not change the part id are marked ignored.
+func (old_service *Service) Diff(new_service *Service, part string) ([]*DiffEntry, error) {
+	old_data, err := old_service.ComputeIdData("")
+	if err != nil {
+		return nil, err
+	}
+
+	new_data, err := new_service.ComputeIdData("")
+	if err != nil {
+		return nil, err
+	}
+
+	var old_value, new_value interface{}
+	err = json.Unmarshal(old_data, &old_value)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(new_data, &new_value)
+	if err != nil {
+		return nil, err
+	}
+
+	var diff []*DiffEntry
+	err = diffValues(&diff, "", old_value, new_value)
+	if err != nil {
+		return nil, err
+	}
+
+	var part_id_template string
+	var exclude_vars []string
+	if pod := new_service.FindPod(part); pod != nil {
+		part_id_template = pod.PartIdTemplate
+		exclude_vars = pod.ExcludeVars
+	} else if f := new_service.FindFunction(part); f != nil {
+		part_id_template = f.PartIdTemplate
+		exclude_vars = f.ExcludeVars
+	}
+
+	for _, d := range diff {
+		if key, is_config := strings.CutPrefix(d.Path, "config."); is_config && slices.Contains(exclude_vars, key) {
+			d.Ignored = fmt.Sprintf("%s is in exclude_vars of part %s", key, part)
+		} else if part_id_template != "" {
+			d.Ignored = fmt.Sprintf("part %s id is computed by part_id_template %s", part, part_id_template)
+		}
+	}
+
+	return diff, nil
+}
+
+// Return the key used to match list items: their name or id if all items of
+// both lists have a unique one.
+func diffListKey(old_list, new_list []interface{}) string {
+	for _, key := range []string{"name", "id"} {
+		if diffListHasKey(old_list, key) && diffListHasKey(new_list, key) {
+			return key
+		}
+	}
+	return ""
+}
+
+func diffListHasKey(list []interface{}, key string) bool {
+	var keys []string
+	for _, item := range list {
+		obj, ok := item.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		val, ok := obj[key].(string)
+		if !ok || val == "" || slices.Contains(keys, val) {
+			return false
+		}
+		keys = append(keys, val)
+	}
+	return true
+}
+
+func diffValues(diff *[]*DiffEntry, path string, old_value, new_value interface{}) error {
+	old_json, err := json.Marshal(old_value)
+	if err != nil {
+		return err
+	}
+
+	new_json, err := json.Marshal(new_value)
+	if err != nil {
+		return err
+	}
+
+	if bytes.Equal(old_json, new_json) {
+		return nil
+	}
+
+	old_obj, old_is_obj := old_value.(map[string]interface{})
+	new_obj, new_is_obj := new_value.(map[string]interface{})
+	if old_is_obj && new_is_obj {
+		var keys []string
+		for k := range old_obj {
+			keys = append(keys, k)
+		}
+		for k := range new_obj {
+			if _, ok := old_obj[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			sub_path := k
+			if path != "" {
+				sub_path = path + "." + k
+			}
+			old_sub, old_ok := old_obj[k]
+			new_sub, new_ok := new_obj[k]
+			if !old_ok {
+				err = addDiff(diff, sub_path, false, nil, true, new_sub)
+			} else if !new_ok {
+				err = addDiff(diff, sub_path, true, old_sub, false, nil)
+			} else {
+				err = diffValues(diff, sub_path, old_sub, new_sub)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	old_list, old_is_list := old_value.([]interface{})
+	new_list, new_is_list := new_value.([]interface{})
+	if old_is_list && new_is_list {
+		key := diffListKey(old_list, new_list)
+		if key == "" && len(old_list) == len(new_list) {
+			for i := range old_list {
+				err = diffValues(diff, fmt.Sprintf("%s[%d]", path, i), old_list[i], new_list[i])
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		} else if key != "" {
+			var names []string
+			var old_items = map[string]interface{}{}
+			var new_items = map[string]interface{}{}
+			for _, item := range old_list {
+				name := item.(map[string]interface{})[key].(string)
+				old_items[name] = item
+				names = append(names, name)
+			}
+			for _, item := range new_list {
+				name := item.(map[string]interface{})[key].(string)
+				new_items[name] = item
+				if _, ok := old_items[name]; !ok {
+					names = append(names, name)
+				}
+			}
+
+			for _, name := range names {
+				sub_path := fmt.Sprintf("%s[%s]", path, name)
+				old_sub, old_ok := old_items[name]
+				new_sub, new_ok := new_items[name]
+				if !old_ok {
+					err = addDiff(diff, sub_path, false, nil, true, new_sub)
+				} else if !new_ok {
+					err = addDiff(diff, sub_path, true, old_sub, false, nil)
+				} else {
+					err = diffValues(diff, sub_path, old_sub, new_sub)
+				}
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+
+	return addDiff(diff, path, true, old_value, true, new_value)
+}
+
+func addDiff(diff *[]*DiffEntry, path string, old_ok bool, old_value interface{}, new_ok bool, new_value interface{}) error {
+	var entry = &DiffEntry{Path: path}
+	var err error
+
+	if old_ok {
+		entry.Old, err = json.Marshal(old_value)
+		if err != nil {
+			return err
+		}
+	}
+
+	if new_ok {
+		entry.New, err = json.Marshal(new_value)
+		if err != nil {
+			return err
+		}
+	}
+
+	*diff = append(*diff, entry)
+	return nil
+}
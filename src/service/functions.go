@@ -10,14 +10,17 @@ import (
 
 	"github.com/mildred/conductor.go/src/caddy"
 	"github.com/mildred/conductor.go/src/dirs"
+	"github.com/mildred/conductor.go/src/utils"
 )
 
 type ServiceFunction struct {
+	MergeDirectives
 	Name                 string                       `json:"name"`
 	PartIdTemplate       string                       `json:"part_id_template"`
+	TemplateTimeout      utils.JSONDuration           `json:"template_timeout,omitempty"` // Overrides the service template_timeout
 	ExcludeVars          []string                     `json:"exclude_vars"`
-	ServiceDirectives    []string                     `json:"service_directives,omitempty"`
-	Format               string                       `json:"format,omitempty"` // Format: cgi, http-stdio, sdactivate
+	ServiceDirectives    MergeList[string]            `json:"service_directives,omitempty"`
+	Format               string                       `json:"format,omitempty"` // Format: cgi, http-stdio, sdactivate, fastcgi
 	Exec                 []string                     `json:"exec,omitempty"`
 	StderrAsStdout       bool                         `json:"stderr_as_stdout,omitempty"`
 	ResponseHeaders      []string                     `json:"response_headers,omitempty"`    // Additional response headers
@@ -26,6 +29,23 @@ type ServiceFunction struct {
 	Policies             []string                     `json:"policies,omitempty"`            // Policies to match
 	ProvidedReverseProxy []ServiceFunctionProxyConfig `json:"reverse_proxy"`
 	DefaultReverseProxy  *bool                        `json:"default_reverse_proxy,omitempty"`
+	Workers              *FunctionWorkers             `json:"workers,omitempty"` // Run pre-spawned workers in the fast function manager
+	FastCGI              *FunctionFastCGI             `json:"fastcgi,omitempty"` // Caddy fastcgi transport settings
+}
+
+// Settings of the Caddy fastcgi transport for the fastcgi format
+type FunctionFastCGI struct {
+	Root      string            `json:"root,omitempty"`       // Document root, the service directory by default
+	SplitPath []string          `json:"split_path,omitempty"` // Substrings splitting the script name from PATH_INFO, such as .php
+	Env       map[string]string `json:"env,omitempty"`        // Extra FastCGI parameters
+}
+
+// Pool of http-stdio workers kept running by the fast function manager, each
+// worker serves requests one at a time
+type FunctionWorkers struct {
+	Min         int `json:"min,omitempty"`          // Idle workers kept ready, 1 by default
+	Max         int `json:"max,omitempty"`          // Maximum number of workers, 4 times min by default
+	MaxRequests int `json:"max_requests,omitempty"` // Recycle a worker after this many requests, unlimited by default
 }
 
 type ServiceFunctionProxyConfig struct { // TODO
@@ -64,6 +84,11 @@ func (functions *ServiceFunctions) FixPaths(dir string) error {
 				return err
 			}
 		}
+		if f.FastCGI != nil {
+			if err := fix_path(dir, &f.FastCGI.Root, false); err != nil {
+				return err
+			}
+		}
 	}
 	return nil
 }
@@ -79,13 +104,54 @@ func (functions *ServiceFunctions) FillDefaults(service *Service) error {
 }
 
 func (f *ServiceFunction) IsSingle() bool {
-	return f.Format == "sdactivate"
+	return f.Format == "sdactivate" || f.Format == "fastcgi"
 }
 
 func (f *ServiceFunction) FillDefaults(service *Service) error {
+	if f.FastCGI != nil && f.Format != "fastcgi" {
+		return fmt.Errorf("fastcgi settings require the fastcgi format, got %q", f.Format)
+	}
+	if f.Format == "fastcgi" && f.FastCGI == nil {
+		f.FastCGI = &FunctionFastCGI{}
+	}
+	if f.Format == "fastcgi" && f.PathInfoStrip > 0 && len(f.FastCGI.SplitPath) > 0 {
+		return fmt.Errorf("path_info_strip and fastcgi split_path cannot be used together")
+	}
+	if f.FastCGI != nil && f.FastCGI.Root == "" {
+		f.FastCGI.Root = service.BasePath
+	}
+	if f.Workers != nil {
+		if f.Format != "http-stdio" {
+			return fmt.Errorf("workers require the http-stdio format, got %q", f.Format)
+		}
+		if f.StderrAsStdout {
+			return fmt.Errorf("workers are incompatible with stderr_as_stdout")
+		}
+		if len(f.ServiceDirectives) > 0 {
+			// Workers run in the manager, the directives would not apply
+			return fmt.Errorf("workers are incompatible with service_directives")
+		}
+		if f.Workers.Min < 0 || f.Workers.Max < 0 || f.Workers.MaxRequests < 0 {
+			return fmt.Errorf("workers settings cannot be negative")
+		}
+		if f.Workers.Min == 0 {
+			f.Workers.Min = 1
+		}
+		if f.Workers.Max == 0 {
+			f.Workers.Max = 4 * f.Workers.Min
+		}
+		if f.Workers.Max < f.Workers.Min {
+			return fmt.Errorf("workers max (%d) cannot be lower than min (%d)", f.Workers.Max, f.Workers.Min)
+		}
+	}
 	return nil
 }
 
+// Return true if the function is served by the fast function manager
+func (f *ServiceFunction) IsManaged() bool {
+	return f.Workers != nil
+}
+
 func (f *ServiceFunction) ReverseProxy(ctx context.Context, service *Service) (res []ServiceFunctionProxyConfig, err error) {
 	var names []string
 
@@ -188,71 +254,65 @@ func (f *ServiceFunction) CaddyConfig(ctx context.Context, service *Service, nam
 	var handlers []interface{}
 
 	if len(f.Policies) > 0 {
-		handlers = append(handlers, map[string]interface{}{
-			"handler": "reverse_proxy",
-			"transport": map[string]interface{}{
-				"protocol": "http",
-			},
-			"upstreams": []interface{}{
-				map[string]interface{}{
-					"dial": "unix/" + dirs.Join(dirs.RuntimeDir, "conductor-policy.socket"),
-				},
-			},
-			"rewrite": map[string]interface{}{
-				"method": "HEAD",
-			},
-			"headers": map[string]interface{}{
-				"request": map[string]interface{}{
-					"set": map[string]interface{}{
-						"Conductor-Policy":   strings.Join(f.Policies, " "),
-						"X-Forwarded-Method": []string{"{http.request.method}"},
-						"X-Forwarded-Uri":    []string{"{http.request.uri}"},
-					},
+		handlers = append(handlers, PolicyAuthHandler(f.Policies))
+	}
+
+	var transport = map[string]interface{}{
+		"protocol": "http",
+	}
+
+	var prefixes = []string{
+		fmt.Sprintf("/cgi/%s", part_id),
+		fmt.Sprintf("/cgi/%s.%s.%s", service.AppName, service.InstanceName, f.Name),
+	}
+
+	var match []map[string]interface{}
+	for _, prefix := range prefixes {
+		match = append(match, map[string]interface{}{
+			"path": []string{prefix + "/*"},
+		})
+	}
+
+	if f.Format == "fastcgi" {
+		transport = f.FastCGITransport()
+		if f.PathInfoStrip > 0 {
+			// Capture on the path before the prefix is stripped the elements
+			// passed as SCRIPT_NAME and the rest as PATH_INFO, as for cgi
+			for _, m := range match {
+				m["path_regexp"] = map[string]interface{}{
+					"name":    "conductor_path_info",
+					"pattern": fmt.Sprintf("^((?:/[^/]*){0,%d})(/.*)?$", f.PathInfoStrip),
+				}
+			}
+		}
+
+		// Strip the matched prefix as php_fastcgi does, else the script file
+		// name would be looked up under the prefix in the root directory
+		var routes []interface{}
+		for _, prefix := range prefixes {
+			routes = append(routes, map[string]interface{}{
+				"match": []map[string]interface{}{
+					{"path": []string{prefix + "/*"}},
 				},
-			},
-			"handle_response": []interface{}{
-				// When a response handler is invoked, the response from the backend is
-				// not written to the client, and the configured handle_response route
-				// will be executed instead, and it is up to that route to write a
-				// response. If the route does not write a response, then request
-				// handling will continue with any handlers that are ordered after this
-				// reverse_proxy.
-				//
-				// - any handle_response matching: the request can continue down the
-				//   line of handlers, unless the response handler writes a HTTP
-				//   response
-				// - no handle_response matching: the response from the auth upstream
-				//   is sent directly
-				map[string]interface{}{
-					"match": map[string]interface{}{
-						"status_code": []interface{}{2},
-					},
-					"routes": []interface{}{
-						map[string]interface{}{
-							"handle": []interface{}{
-								map[string]interface{}{
-									"handler": "headers",
-									"request": map[string]interface{}{
-										"set": map[string]interface{}{
-											"Conductor-Policy-Pass": []string{"1"},
-										},
-									},
-								},
-							},
-						},
+				"handle": []interface{}{
+					map[string]interface{}{
+						"handler":           "rewrite",
+						"strip_path_prefix": prefix,
 					},
 				},
-			},
-		})
+			})
+		}
 
+		handlers = append(handlers, map[string]interface{}{
+			"handler": "subroute",
+			"routes":  routes,
+		})
 	}
 
 	handlers = append(handlers, map[string]interface{}{
-		"@id":     config_id + ".handler",
-		"handler": "reverse_proxy",
-		"transport": map[string]interface{}{
-			"protocol": "http",
-		},
+		"@id":       config_id + ".handler",
+		"handler":   "reverse_proxy",
+		"transport": transport,
 		"upstreams": []interface{}{
 			// map[string]interface{}{
 			// 	"dial": "unix/" + opts.SocketPath,
@@ -261,19 +321,45 @@ func (f *ServiceFunction) CaddyConfig(ctx context.Context, service *Service, nam
 	})
 
 	return json.Marshal(map[string]interface{}{
-		"@id": config_id,
-		"match": []interface{}{
-			map[string]interface{}{
-				"path": []string{fmt.Sprintf("/cgi/%s/*", part_id)},
-			},
-			map[string]interface{}{
-				"path": []string{fmt.Sprintf("/cgi/%s.%s.%s/*", service.AppName, service.InstanceName, f.Name)},
-			},
-		},
+		"@id":    config_id,
+		"match":  match,
 		"handle": handlers,
 	})
 }
 
+// Caddy fastcgi transport, SCRIPT_NAME and PATH_INFO are derived by Caddy from
+// split_path on the path stripped of the route prefix, or path_info_strip maps
+// onto them using the path_regexp matcher of the route
+func (f *ServiceFunction) FastCGITransport() map[string]interface{} {
+	var env = map[string]string{}
+	if f.PathInfoStrip > 0 {
+		env["SCRIPT_NAME"] = "{http.regexp.conductor_path_info.1}"
+		env["PATH_INFO"] = "{http.regexp.conductor_path_info.2}"
+	}
+
+	var transport = map[string]interface{}{
+		"protocol": "fastcgi",
+	}
+
+	if f.FastCGI != nil {
+		if f.FastCGI.Root != "" {
+			transport["root"] = f.FastCGI.Root
+		}
+		if len(f.FastCGI.SplitPath) > 0 {
+			transport["split_path"] = f.FastCGI.SplitPath
+		}
+		for k, v := range f.FastCGI.Env {
+			env[k] = v
+		}
+	}
+
+	if len(env) > 0 {
+		transport["env"] = env
+	}
+
+	return transport
+}
+
 func (functions *ServiceFunctions) UnmarshalJSON(data []byte) error {
 	var raw_functions []json.RawMessage
 	err := json.Unmarshal(data, &raw_functions)
@@ -284,22 +370,93 @@ func (functions *ServiceFunctions) UnmarshalJSON(data []byte) error {
 	for _, raw_func := range raw_functions {
 		var func_name struct {
 			Name string `json:"name"`
+			MergeDirectives
 		}
 		err = json.Unmarshal(raw_func, &func_name)
 		if err != nil {
 			return fmt.Errorf("unmarshalling function for name, %v", err)
 		}
-		var existing_func *ServiceFunction = functions.FindFunction(func_name.Name)
-		if existing_func == nil {
-			existing_func = &ServiceFunction{}
-			*functions = append(*functions, existing_func)
+		var idx = slices.IndexFunc(*functions, func(f *ServiceFunction) bool { return f.Name == func_name.Name })
+		if func_name.Remove {
+			if idx != -1 {
+				*functions = slices.Delete(*functions, idx, idx+1)
+			}
+			continue
+		} else if idx == -1 {
+			idx = len(*functions)
+			*functions = append(*functions, &ServiceFunction{})
+		} else if func_name.Replace {
+			(*functions)[idx] = &ServiceFunction{}
 		}
+		var existing_func *ServiceFunction = (*functions)[idx]
 		err = json.Unmarshal(raw_func, existing_func)
 		if err != nil {
 			log.Printf("Failed to parse JSON: %v\n", string(raw_func))
 			return fmt.Errorf("unmarshalling function %q, %v", func_name.Name, err)
 		}
+		existing_func.MergeDirectives = MergeDirectives{}
 	}
 
 	return nil
 }
+
+// Handler checking the request against the policies using the policy server,
+// the request continues with the Conductor-Policy-Pass header when allowed
+func PolicyAuthHandler(policies []string) map[string]interface{} {
+	return map[string]interface{}{
+		"handler": "reverse_proxy",
+		"transport": map[string]interface{}{
+			"protocol": "http",
+		},
+		"upstreams": []interface{}{
+			map[string]interface{}{
+				"dial": "unix/" + dirs.Join(dirs.RuntimeDir, "conductor-policy.socket"),
+			},
+		},
+		"rewrite": map[string]interface{}{
+			"method": "HEAD",
+		},
+		"headers": map[string]interface{}{
+			"request": map[string]interface{}{
+				"set": map[string]interface{}{
+					"Conductor-Policy":   strings.Join(policies, " "),
+					"X-Forwarded-Method": []string{"{http.request.method}"},
+					"X-Forwarded-Uri":    []string{"{http.request.uri}"},
+				},
+			},
+		},
+		"handle_response": []interface{}{
+			// When a response handler is invoked, the response from the backend is
+			// not written to the client, and the configured handle_response route
+			// will be executed instead, and it is up to that route to write a
+			// response. If the route does not write a response, then request
+			// handling will continue with any handlers that are ordered after this
+			// reverse_proxy.
+			//
+			// - any handle_response matching: the request can continue down the
+			//   line of handlers, unless the response handler writes a HTTP
+			//   response
+			// - no handle_response matching: the response from the auth upstream
+			//   is sent directly
+			map[string]interface{}{
+				"match": map[string]interface{}{
+					"status_code": []interface{}{2},
+				},
+				"routes": []interface{}{
+					map[string]interface{}{
+						"handle": []interface{}{
+							map[string]interface{}{
+								"handler": "headers",
+								"request": map[string]interface{}{
+									"set": map[string]interface{}{
+										"Conductor-Policy-Pass": []string{"1"},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
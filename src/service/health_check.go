@@ -0,0 +1,92 @@
+package service
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mildred/conductor.go/src/utils"
+)
+
+type HealthCheck struct {
+	HTTP             *HealthCheckHTTP   `json:"http,omitempty"`
+	TCP              *HealthCheckTCP    `json:"tcp,omitempty"`
+	Exec             *HealthCheckExec   `json:"exec,omitempty"`
+	Interval         utils.JSONDuration `json:"interval,omitempty"`          // Time between two probes
+	Timeout          utils.JSONDuration `json:"timeout,omitempty"`           // Timeout of a single probe
+	StartTimeout     utils.JSONDuration `json:"start_timeout,omitempty"`     // Maximum time to wait for the check to pass
+	SuccessThreshold int                `json:"success_threshold,omitempty"` // Consecutive successes required
+	FailureThreshold int                `json:"failure_threshold,omitempty"` // Consecutive failures to be considered dead
+}
+
+type HealthCheckHTTP struct {
+	Port   int    `json:"port"`
+	Path   string `json:"path,omitempty"`
+	Scheme string `json:"scheme,omitempty"`
+}
+
+type HealthCheckTCP struct {
+	Port int `json:"port"`
+}
+
+type HealthCheckExec struct {
+	Container string   `json:"container"`
+	Command   []string `json:"command"`
+}
+
+func (check *HealthCheck) FillDefaults() {
+	if check.Interval == 0 {
+		check.Interval = utils.JSONDuration(5 * time.Second)
+	}
+	if check.Timeout == 0 {
+		check.Timeout = utils.JSONDuration(2 * time.Second)
+	}
+	if check.StartTimeout == 0 {
+		check.StartTimeout = utils.JSONDuration(2 * time.Minute)
+	}
+	if check.SuccessThreshold <= 0 {
+		check.SuccessThreshold = 1
+	}
+	if check.FailureThreshold <= 0 {
+		check.FailureThreshold = 3
+	}
+	if check.HTTP != nil {
+		if check.HTTP.Path == "" {
+			check.HTTP.Path = "/"
+		}
+		if check.HTTP.Scheme == "" {
+			check.HTTP.Scheme = "http"
+		}
+	}
+}
+
+func (check *HealthCheck) Validate() error {
+	var num = 0
+	if check.HTTP != nil {
+		num += 1
+	}
+	if check.TCP != nil {
+		num += 1
+	}
+	if check.Exec != nil {
+		num += 1
+	}
+	if num != 1 {
+		return fmt.Errorf("health check must have exactly one of http, tcp or exec")
+	}
+	if check.Exec != nil && len(check.Exec.Command) == 0 {
+		return fmt.Errorf("health check exec must have a command")
+	}
+	return nil
+}
+
+func (check *HealthCheck) String() string {
+	if check.HTTP != nil {
+		return fmt.Sprintf("http %s port %d", check.HTTP.Path, check.HTTP.Port)
+	} else if check.TCP != nil {
+		return fmt.Sprintf("tcp port %d", check.TCP.Port)
+	} else if check.Exec != nil {
+		return fmt.Sprintf("exec %q in container %q", check.Exec.Command, check.Exec.Container)
+	} else {
+		return "empty health check"
+	}
+}
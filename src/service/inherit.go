@@ -53,11 +53,11 @@ func DecodeInherit(data []byte, dir string) (*InheritedFile, error) {
 
 	if len(inherited.Inherit) > 0 {
 		for _, inherit := range inherited.Inherit {
-			inherit.Path = join_paths(dir, inherit.Path)
-
 			if strings.HasSuffix(inherit.Path, "/") {
 				inherit.Path = filepath.Join(inherit.Path, ConfigName)
 			}
+
+			inherit.Path = join_paths(dir, inherit.Path)
 		}
 	}
 
@@ -0,0 +1,173 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mildred/conductor.go/src/utils"
+)
+
+// Config values can reference other config values with ${VAR}, or
+// ${VAR:-default} to use a default when the variable is unset or empty. $${
+// produces a literal ${. CONDUCTOR_APP, CONDUCTOR_INSTANCE and
+// CONDUCTOR_SERVICE_DIR are also available.
+
+type configInterpolation struct {
+	service  *Service
+	builtins map[string]string
+	expanded map[string]string
+	stack    []string
+}
+
+func isVarChar(c byte, first bool) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (!first && c >= '0' && c <= '9')
+}
+
+// Return the index of the } closing the ${ that starts before s
+func closingBrace(s string) int {
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		if strings.HasPrefix(s[i:], "$${") {
+			i += 2
+		} else if strings.HasPrefix(s[i:], "${") {
+			depth++
+			i++
+		} else if s[i] == '}' {
+			if depth == 0 {
+				return i
+			}
+			depth--
+		}
+	}
+	return -1
+}
+
+func (ci *configInterpolation) expandString(s string) (string, error) {
+	var res strings.Builder
+	for i := 0; i < len(s); i++ {
+		if strings.HasPrefix(s[i:], "$${") {
+			res.WriteString("${")
+			i += 2
+			continue
+		} else if !strings.HasPrefix(s[i:], "${") {
+			res.WriteByte(s[i])
+			continue
+		}
+
+		expr := s[i+2:]
+		end := closingBrace(expr)
+		if end == -1 {
+			return "", fmt.Errorf("unterminated ${ in %q", s)
+		}
+		expr = expr[:end]
+		i += 2 + end
+
+		n := 0
+		for n < len(expr) && isVarChar(expr[n], n == 0) {
+			n++
+		}
+		name, rest := expr[:n], expr[n:]
+		if name == "" {
+			return "", fmt.Errorf("invalid variable reference ${%s}", expr)
+		}
+
+		value, defined, err := ci.lookup(name)
+		if err != nil {
+			return "", err
+		}
+
+		if rest == "" {
+			if !defined {
+				return "", fmt.Errorf("undefined variable %s", name)
+			}
+		} else if def, ok := strings.CutPrefix(rest, ":-"); ok {
+			if !defined || value == "" {
+				value, err = ci.expandString(def)
+				if err != nil {
+					return "", err
+				}
+			}
+		} else {
+			return "", fmt.Errorf("invalid variable reference ${%s}, only ${VAR} and ${VAR:-default} are supported", expr)
+		}
+
+		res.WriteString(value)
+	}
+	return res.String(), nil
+}
+
+func (ci *configInterpolation) lookup(name string) (string, bool, error) {
+	if value, ok := ci.expanded[name]; ok {
+		return value, true, nil
+	}
+
+	cfg, ok := ci.service.Config[name]
+	if !ok {
+		value, ok := ci.builtins[name]
+		return value, ok, nil
+	} else if cfg == nil || cfg.Kind == ConfigValueNull {
+		return "", false, nil
+	} else if cfg.Kind == ConfigValueSecret {
+		return "", false, fmt.Errorf("cannot reference secret %s", name)
+	} else if cfg.Kind != ConfigValueString {
+		return cfg.Str, true, nil
+	}
+
+	for i, n := range ci.stack {
+		if n == name {
+			return "", false, fmt.Errorf("cycle in config interpolation: %s -> %s", strings.Join(ci.stack[i:], " -> "), name)
+		}
+	}
+
+	ci.stack = append(ci.stack, name)
+	value, err := ci.expandString(cfg.Str)
+	ci.stack = ci.stack[:len(ci.stack)-1]
+	if err != nil {
+		return "", false, err
+	}
+
+	ci.expanded[name] = value
+	return value, true, nil
+}
+
+// Expand the variable references in the config values. The values before
+// expansion are kept in RawConfig.
+func (service *Service) ExpandConfig() error {
+	ci := &configInterpolation{
+		service: service,
+		builtins: map[string]string{
+			"CONDUCTOR_APP":         service.AppName,
+			"CONDUCTOR_INSTANCE":    service.InstanceName,
+			"CONDUCTOR_SERVICE_DIR": service.BasePath,
+		},
+		expanded: map[string]string{},
+	}
+
+	for _, name := range utils.SortedStringKeys(service.Config) {
+		cfg := service.Config[name]
+		if cfg == nil || cfg.Kind != ConfigValueString || !strings.Contains(cfg.Str, "${") {
+			continue
+		}
+
+		value, _, err := ci.lookup(name)
+		if err != nil {
+			return fmt.Errorf("while expanding config %s, %v", name, err)
+		}
+
+		if service.RawConfig == nil {
+			service.RawConfig = map[string]string{}
+		}
+		service.RawConfig[name] = cfg.Str
+		service.Config[name] = &ConfigValue{ConfigValueString, value, nil}
+	}
+
+	return nil
+}
+
+// Return the config value as written in the service file, before expansion
+func (service *Service) RawConfigValue(name string) string {
+	if raw, ok := service.RawConfig[name]; ok {
+		return raw
+	}
+	return service.Config[name].String()
+}
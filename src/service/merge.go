@@ -0,0 +1,95 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+)
+
+// Merge directives accepted on inherited pods, functions, hooks and commands.
+// They are reset once the item is merged and are never part of the service id.
+type MergeDirectives struct {
+	Remove  bool `json:"$remove,omitempty"`  // Remove the inherited item
+	Replace bool `json:"$replace,omitempty"` // Replace the inherited item instead of merging
+}
+
+// A list that is replaced by a JSON array, or extended by an object with
+// $prepend and $append lists
+type MergeList[T any] []T
+
+func (MergeList[T]) isMergeList() {}
+
+var mergeListType = reflect.TypeOf((*interface{ isMergeList() })(nil)).Elem()
+
+type mergeListDirectives[T any] struct {
+	Prepend []T `json:"$prepend"`
+	Append  []T `json:"$append"`
+}
+
+func (list *MergeList[T]) UnmarshalJSON(data []byte) error {
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		var items []T
+		err := json.Unmarshal(data, &items)
+		if err != nil {
+			return err
+		}
+		*list = items
+		return nil
+	}
+
+	var directives mergeListDirectives[T]
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&directives)
+	if err != nil {
+		return fmt.Errorf("while decoding list merge directives, %v", err)
+	}
+
+	*list = slices.Concat(directives.Prepend, *list, directives.Append)
+	return nil
+}
+
+// Commands are merged by name
+type ServiceCommands map[string]*ServiceCommand
+
+func (commands *ServiceCommands) UnmarshalJSON(data []byte) error {
+	var raw_commands map[string]json.RawMessage
+	err := json.Unmarshal(data, &raw_commands)
+	if err != nil {
+		return fmt.Errorf("unmarshalling commands, %v", err)
+	}
+
+	if raw_commands == nil {
+		*commands = nil
+		return nil
+	} else if *commands == nil {
+		*commands = ServiceCommands{}
+	}
+
+	for name, raw_cmd := range raw_commands {
+		var directives MergeDirectives
+		err = json.Unmarshal(raw_cmd, &directives)
+		if err != nil {
+			return fmt.Errorf("unmarshalling command %q, %v", name, err)
+		}
+
+		existing_cmd := (*commands)[name]
+		if directives.Remove {
+			delete(*commands, name)
+			continue
+		} else if existing_cmd == nil || directives.Replace {
+			existing_cmd = &ServiceCommand{}
+		}
+
+		err = json.Unmarshal(raw_cmd, existing_cmd)
+		if err != nil {
+			return fmt.Errorf("unmarshalling command %q, %v", name, err)
+		}
+		existing_cmd.MergeDirectives = MergeDirectives{}
+		(*commands)[name] = existing_cmd
+	}
+
+	return nil
+}
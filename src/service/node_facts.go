@@ -0,0 +1,42 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/tailscale/hujson"
+
+	"github.com/mildred/conductor.go/src/dirs"
+)
+
+// Facts about the node, used by service conditions
+var NodeFactsFile = path.Join(dirs.SelfConfigHome, "node.json")
+
+type NodeFacts struct {
+	Labels map[string]string `json:"labels"`
+}
+
+func ReadNodeFacts() (*NodeFacts, error) {
+	var facts = &NodeFacts{}
+
+	data, err := os.ReadFile(NodeFactsFile)
+	if os.IsNotExist(err) {
+		return facts, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	data, err = hujson.Standardize(data)
+	if err != nil {
+		return nil, fmt.Errorf("while reading %s, %v", NodeFactsFile, err)
+	}
+
+	err = json.Unmarshal(data, facts)
+	if err != nil {
+		return nil, fmt.Errorf("while reading %s, %v", NodeFactsFile, err)
+	}
+
+	return facts, nil
+}
@@ -0,0 +1,42 @@
+package service
+
+import (
+	"path/filepath"
+)
+
+// Return pointers to all the file paths referenced by the service: templates
+// and executables. Only paths that have been resolved to an absolute path are
+// returned. Secret files are not listed so they are never copied in the
+// history.
+func (service *Service) FilePaths() []*string {
+	var paths []*string
+	add := func(p *string) {
+		if *p != "" && filepath.IsAbs(*p) {
+			paths = append(paths, p)
+		}
+	}
+
+	add(&service.ProxyConfigTemplate)
+	for _, pod := range service.Pods {
+		add(&pod.PartIdTemplate)
+		add(&pod.PodTemplate)
+		add(&pod.ConfigMapTemplate)
+	}
+	for _, f := range service.Functions {
+		add(&f.PartIdTemplate)
+		if len(f.Exec) > 0 {
+			add(&f.Exec[0])
+		}
+	}
+	for _, hook := range service.Hooks {
+		if len(hook.Exec) > 0 {
+			add(&hook.Exec[0])
+		}
+	}
+	for _, command := range service.Commands {
+		if len(command.Exec) > 0 {
+			add(&command.Exec[0])
+		}
+	}
+	return paths
+}
@@ -0,0 +1,64 @@
+package service
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/mildred/conductor.go/src/dirs"
+)
+
+// A service can be pinned to a snapshot of a past revision (see `conductor
+// service rollback`), in which case the snapshot is loaded instead of the
+// service files.
+
+var PinDir = dirs.Join(dirs.SelfStateHome, "history", "pins")
+
+type ServicePin struct {
+	ServiceId string `json:"service_id"`         // Id of the pinned revision
+	Revision  string `json:"revision,omitempty"` // Key of the pinned revision
+	File      string `json:"file"`               // Snapshot service file to load
+}
+
+func PinPath(service_dir string) string {
+	return filepath.Join(PinDir, ServiceUnit(service_dir)+".json")
+}
+
+// Return the pin of the service directory, or nil if it is not pinned
+func ReadPin(service_dir string) (*ServicePin, error) {
+	data, err := os.ReadFile(PinPath(service_dir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var pin ServicePin
+	err = json.Unmarshal(data, &pin)
+	if err != nil {
+		return nil, err
+	}
+	return &pin, nil
+}
+
+func WritePin(service_dir string, pin *ServicePin) error {
+	data, err := json.Marshal(pin)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(PinDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(PinPath(service_dir), data, 0644)
+}
+
+func RemovePin(service_dir string) error {
+	err := os.Remove(PinPath(service_dir))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
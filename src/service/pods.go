@@ -4,19 +4,53 @@ import (
 	"encoding/json"
 	"fmt"
 	"path/filepath"
+	"regexp"
 	"slices"
+	"strings"
 
 	"github.com/mildred/conductor.go/src/caddy"
+	"github.com/mildred/conductor.go/src/utils"
 )
 
 type ServicePod struct {
+	MergeDirectives
 	Name                 string                  `json:"name"`
 	PartIdTemplate       string                  `json:"part_id_template"`
 	ExcludeVars          []string                `json:"exclude_vars"`
-	ServiceDirectives    []string                `json:"service_directives,omitempty"`
+	ServiceDirectives    MergeList[string]       `json:"service_directives,omitempty"`
+	Replicas             int                     `json:"replicas,omitempty"`            // Number of concurrent deployments, not part of the id
 	PodTemplate          string                  `json:"pod_template,omitempty"`        // Template file for pod
 	ConfigMapTemplate    string                  `json:"config_map_template,omitempty"` // ConfigMap template file
+	TemplateTimeout      utils.JSONDuration      `json:"template_timeout,omitempty"`    // Overrides the service template_timeout
 	ProvidedReverseProxy []ServicePodProxyConfig `json:"reverse_proxy"`
+	HealthCheck          *HealthCheck            `json:"health_check,omitempty"`   // Must pass before registering to load-balancer
+	LivenessCheck        *HealthCheck            `json:"liveness_check,omitempty"` // Checked continuously by the service
+	Sockets              []*PodSocket            `json:"sockets,omitempty"`        // Listening sockets passed to the pod
+	IdleTimeout          utils.JSONDuration      `json:"idle_timeout,omitempty"`   // Stop the pod after this time without traffic, start it on the next connection
+}
+
+// A listening socket created by systemd and passed to the pod containers using
+// the LISTEN_FDS protocol
+type PodSocket struct {
+	Name             string            `json:"name"`                        // Used as FileDescriptorName
+	Listen           string            `json:"listen,omitempty"`            // Unix socket path or TCP [address:]port, defaults to a unix socket in the deployment directory
+	SocketDirectives MergeList[string] `json:"socket_directives,omitempty"` // Extra directives in the [Socket] section
+}
+
+var podSocketNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Unix sockets have an empty listen address or an absolute path
+func (socket *PodSocket) IsUnix() bool {
+	return socket.Listen == "" || strings.HasPrefix(socket.Listen, "/")
+}
+
+func (pod *ServicePod) FindSocket(name string) *PodSocket {
+	for _, socket := range pod.Sockets {
+		if socket.Name == name {
+			return socket
+		}
+	}
+	return nil
 }
 
 type ServicePodProxyConfig struct {
@@ -25,6 +59,7 @@ type ServicePodProxyConfig struct {
 	Route         json.RawMessage `json:"route"`
 	UpstreamsPath string          `json:"upstreams_path"`
 	Port          int             `json:"port"`
+	Socket        string          `json:"socket,omitempty"` // Dial the named pod socket instead of the pod IP address and port
 }
 
 type ServicePods []*ServicePod
@@ -68,6 +103,56 @@ func (pods *ServicePods) FillDefaults(service *Service) error {
 		if pod.PodTemplate == "" {
 			pod.PodTemplate = filepath.Join(service.BasePath, "pod.template")
 		}
+		if pod.Replicas < 0 {
+			return fmt.Errorf("pod %q: replicas cannot be negative", pod.Name)
+		} else if pod.Replicas == 0 {
+			pod.Replicas = 1
+		}
+		if pod.HealthCheck != nil {
+			if err := pod.HealthCheck.Validate(); err != nil {
+				return fmt.Errorf("pod %q: %v", pod.Name, err)
+			}
+			pod.HealthCheck.FillDefaults()
+		}
+		if pod.LivenessCheck != nil {
+			if err := pod.LivenessCheck.Validate(); err != nil {
+				return fmt.Errorf("pod %q liveness: %v", pod.Name, err)
+			}
+			pod.LivenessCheck.FillDefaults()
+		}
+		if err := pod.validateSockets(service); err != nil {
+			return fmt.Errorf("pod %q: %v", pod.Name, err)
+		}
+		if pod.IdleTimeout < 0 {
+			return fmt.Errorf("pod %q: idle_timeout cannot be negative", pod.Name)
+		} else if pod.IdleTimeout > 0 && len(pod.Sockets) > 0 {
+			return fmt.Errorf("pod %q: idle_timeout cannot be used with sockets", pod.Name)
+		} else if pod.IdleTimeout > 0 && pod.LivenessCheck != nil {
+			return fmt.Errorf("pod %q: idle_timeout cannot be used with a liveness_check", pod.Name)
+		}
+	}
+	return nil
+}
+
+func (pod *ServicePod) validateSockets(service *Service) error {
+	var names []string
+	for _, socket := range pod.Sockets {
+		if !podSocketNameRegexp.MatchString(socket.Name) {
+			return fmt.Errorf("invalid socket name %q", socket.Name)
+		} else if slices.Contains(names, socket.Name) {
+			return fmt.Errorf("socket %q appears more than once", socket.Name)
+		}
+		names = append(names, socket.Name)
+
+		// Two deployments of the part cannot listen on the same address
+		if socket.Listen != "" && (pod.Replicas > 1 || service.RolloutStrategy() != RolloutRecreate) {
+			return fmt.Errorf("socket %q listens on a fixed address and requires a single replica with the recreate rollout strategy", socket.Name)
+		}
+	}
+	for _, proxy := range pod.ProvidedReverseProxy {
+		if proxy.Socket != "" && pod.FindSocket(proxy.Socket) == nil {
+			return fmt.Errorf("reverse proxy %q refers to unknown socket %q", proxy.Name, proxy.Socket)
+		}
 	}
 	return nil
 }
@@ -124,6 +209,24 @@ func (pod *ServicePod) CaddyConfigName(service *Service, name string) string {
 	return fmt.Sprintf("conductor-pod.%s.%s.%s.%s", service.AppName, service.InstanceName, pod.Name, name)
 }
 
+// Return the Caddy @id of the deployment upstream. When multiple deployments of
+// the same part can be registered at the same time, the id is unique per
+// deployment.
+func (pod *ServicePod) UpstreamId(service *Service, name, deployment_name string) string {
+	if service.RolloutIsGradual() || pod.Replicas > 1 {
+		return fmt.Sprintf("%s.%s.upstream", pod.CaddyConfigName(service, name), deployment_name)
+	}
+	return pod.CaddyConfigName(service, name) + ".upstream"
+}
+
+// Return the number of replicas of the part, 1 for functions
+func (service *Service) PartReplicas(part string) int {
+	if pod := service.FindPod(part); pod != nil && pod.Replicas > 0 {
+		return pod.Replicas
+	}
+	return 1
+}
+
 func (pods *ServicePods) UnmarshalJSON(data []byte) error {
 	var raw_pods []json.RawMessage
 	err := json.Unmarshal(data, &raw_pods)
@@ -134,20 +237,30 @@ func (pods *ServicePods) UnmarshalJSON(data []byte) error {
 	for _, raw_pod := range raw_pods {
 		var pod_name struct {
 			Name string `json:"name"`
+			MergeDirectives
 		}
 		err = json.Unmarshal(raw_pod, &pod_name)
 		if err != nil {
 			return fmt.Errorf("unmarshalling pod for name, %v", err)
 		}
-		var existing_pod *ServicePod = pods.FindPod(pod_name.Name)
-		if existing_pod == nil {
-			existing_pod = &ServicePod{}
-			*pods = append(*pods, existing_pod)
+		var idx = slices.IndexFunc(*pods, func(p *ServicePod) bool { return p.Name == pod_name.Name })
+		if pod_name.Remove {
+			if idx != -1 {
+				*pods = slices.Delete(*pods, idx, idx+1)
+			}
+			continue
+		} else if idx == -1 {
+			idx = len(*pods)
+			*pods = append(*pods, &ServicePod{})
+		} else if pod_name.Replace {
+			(*pods)[idx] = &ServicePod{}
 		}
+		var existing_pod *ServicePod = (*pods)[idx]
 		err = json.Unmarshal(raw_pod, existing_pod)
 		if err != nil {
 			return fmt.Errorf("unmarshalling pod %q, %v", pod_name.Name, err)
 		}
+		existing_pod.MergeDirectives = MergeDirectives{}
 	}
 
 	return nil
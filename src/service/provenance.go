@@ -0,0 +1,199 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/tailscale/hujson"
+)
+
+// Provenance records which file set each resolved key of the service, and the
+// values it overrides. Keys follow the merge rules of the loader: pods and
+// functions are keyed by name (pods[NAME].pod_template), hooks by id (or index
+// in the merged list if they have none), config and commands by name
+// (config.KEY).
+
+type Provenance struct {
+	Key       string          `json:"key"`
+	File      string          `json:"file"`
+	Line      int             `json:"line"`
+	Column    int             `json:"column"`
+	Value     json.RawMessage `json:"value"`
+	Overrides []*Provenance   `json:"overrides,omitempty"` // Most recent first
+}
+
+type Provenances map[string]*Provenance
+
+func (p *Provenance) String() string {
+	return fmt.Sprintf("%s:%d:%d", p.File, p.Line, p.Column)
+}
+
+func (provenances Provenances) set(key string, prov *Provenance) {
+	if previous, ok := provenances[key]; ok {
+		prov.Overrides = append([]*Provenance{previous}, previous.Overrides...)
+		previous.Overrides = nil
+	}
+	provenances[key] = prov
+}
+
+// Forget the keys below key, when an item is removed or replaced
+func (provenances Provenances) clear(key string) {
+	for k := range provenances {
+		if len(k) > len(key) && k[:len(key)] == key && (k[len(key)] == '.' || k[len(key)] == '[') {
+			delete(provenances, k)
+		}
+	}
+}
+
+// Return the provenance for the keys matching key (the key itself and the keys
+// below it), sorted by key
+func (provenances Provenances) Find(key string) []*Provenance {
+	var res []*Provenance
+	for k, p := range provenances {
+		if key == "" || k == key || (len(k) > len(key) && k[:len(key)] == key && (k[len(key)] == '.' || k[len(key)] == '[')) {
+			res = append(res, p)
+		}
+	}
+	slices.SortFunc(res, func(a, b *Provenance) int {
+		if a.Key < b.Key {
+			return -1
+		} else if a.Key > b.Key {
+			return 1
+		}
+		return 0
+	})
+	return res
+}
+
+type provenanceRecorder struct {
+	provenances Provenances
+	file        string
+	data        []byte // Standardized content
+}
+
+func (r *provenanceRecorder) leaf(v *hujson.Value, key string) {
+	var value bytes.Buffer
+	if err := json.Compact(&value, r.data[v.StartOffset:v.EndOffset]); err != nil {
+		value.Reset()
+		value.Write(r.data[v.StartOffset:v.EndOffset])
+	}
+
+	line, column := lineColumn(r.data, v.StartOffset)
+	r.provenances.set(key, &Provenance{
+		Key:    key,
+		File:   r.file,
+		Line:   line,
+		Column: column,
+		Value:  json.RawMessage(value.Bytes()),
+	})
+}
+
+// Record an item that can have merge directives
+func (r *provenanceRecorder) item(v *hujson.Value, t reflect.Type, key string) {
+	if boolValue(member(v, "$remove")) {
+		r.provenances.clear(key)
+		r.leaf(v, key)
+		return
+	} else if boolValue(member(v, "$replace")) {
+		r.provenances.clear(key)
+	}
+	r.walk(v, t, key)
+}
+
+func (r *provenanceRecorder) walk(v *hujson.Value, t reflect.Type, key string) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch val := v.Value.(type) {
+	case *hujson.Object:
+		if t.Kind() == reflect.Map {
+			for i := range val.Members {
+				name := val.Members[i].Name.Value.(hujson.Literal).String()
+				r.item(&val.Members[i].Value, t.Elem(), key+"."+name)
+			}
+			return
+		} else if t.Kind() == reflect.Struct && !reflect.PointerTo(t).Implements(unmarshalerType) {
+			fields := jsonFields(t)
+			for i := range val.Members {
+				name := val.Members[i].Name.Value.(hujson.Literal).String()
+				idx := slices.IndexFunc(fields, func(f jsonField) bool { return f.Name == name })
+				if idx == -1 || strings.HasPrefix(name, "$") {
+					continue
+				}
+				sub_key := name
+				if key != "" {
+					sub_key = key + "." + name
+				}
+				r.walk(&val.Members[i].Value, fields[idx].Type, sub_key)
+			}
+			return
+		}
+	case *hujson.Array:
+		// Pods and functions are merged by name
+		if t == reflect.TypeOf(ServicePods{}) || t == reflect.TypeOf(ServiceFunctions{}) {
+			for i := range val.Elements {
+				name, _ := stringValue(member(&val.Elements[i], "name"))
+				r.item(&val.Elements[i], t.Elem(), fmt.Sprintf("%s[%s]", key, name))
+			}
+			return
+		}
+	}
+
+	r.leaf(v, key)
+}
+
+// Record the provenance of the keys set by a service file. The hooks of the
+// file are given as decoded, before they are merged in the service.
+func (service *Service) recordProvenance(path string, data []byte, file_hooks []*Hook) {
+	root, err := hujson.Parse(data)
+	if err != nil {
+		return
+	}
+
+	obj, ok := root.Value.(*hujson.Object)
+	if !ok {
+		return
+	}
+
+	if service.Provenance == nil {
+		service.Provenance = Provenances{}
+	}
+
+	r := &provenanceRecorder{
+		provenances: service.Provenance,
+		file:        path,
+		data:        data,
+	}
+	fields := jsonFields(reflect.TypeOf(Service{}))
+
+	for i := range obj.Members {
+		name := obj.Members[i].Name.Value.(hujson.Literal).String()
+		value := &obj.Members[i].Value
+
+		if name == "hooks" {
+			for j, hook := range elements(value) {
+				if j >= len(file_hooks) {
+					break
+				}
+				hook_key := "hooks[" + file_hooks[j].Id + "]"
+				if file_hooks[j].Id == "" {
+					hook_key = "hooks[" + strconv.Itoa(slices.Index(service.Hooks, file_hooks[j])) + "]"
+				}
+				r.leaf(hook, hook_key)
+			}
+			continue
+		}
+
+		idx := slices.IndexFunc(fields, func(f jsonField) bool { return f.Name == name })
+		if idx == -1 {
+			continue
+		}
+		r.walk(value, fields[idx].Type, name)
+	}
+}
@@ -0,0 +1,65 @@
+package service
+
+import (
+	"fmt"
+)
+
+const (
+	RolloutRecreate  = "recreate"
+	RolloutRolling   = "rolling"
+	RolloutCanary    = "canary"
+	RolloutBlueGreen = "blue-green"
+)
+
+type RolloutConfig struct {
+	Strategy     string `json:"strategy"`
+	CanaryWeight int    `json:"canary_weight,omitempty"` // Percentage of traffic sent to the new deployments
+}
+
+func (rollout *RolloutConfig) FillDefaults() error {
+	if rollout.Strategy == "" {
+		rollout.Strategy = RolloutRolling
+	}
+
+	switch rollout.Strategy {
+	case RolloutRecreate, RolloutRolling, RolloutCanary, RolloutBlueGreen:
+	default:
+		return fmt.Errorf("unknown rollout strategy %q", rollout.Strategy)
+	}
+
+	if rollout.Strategy == RolloutCanary && rollout.CanaryWeight == 0 {
+		rollout.CanaryWeight = 10
+	}
+	if rollout.CanaryWeight < 0 || rollout.CanaryWeight > 100 {
+		return fmt.Errorf("rollout canary weight must be a percentage, got %d", rollout.CanaryWeight)
+	}
+	return nil
+}
+
+// Return the rollout strategy of the service, rolling by default
+func (service *Service) RolloutStrategy() string {
+	if service.Rollout == nil || service.Rollout.Strategy == "" {
+		return RolloutRolling
+	}
+	return service.Rollout.Strategy
+}
+
+// Return true if the new deployments are kept alongside the previous ones until
+// the rollout is promoted or aborted
+func (service *Service) RolloutIsGradual() bool {
+	strategy := service.RolloutStrategy()
+	return strategy == RolloutCanary || strategy == RolloutBlueGreen
+}
+
+// Return the traffic weight percentage the new deployments should get during a
+// gradual rollout
+func (service *Service) RolloutNewWeight() int {
+	switch service.RolloutStrategy() {
+	case RolloutCanary:
+		return service.Rollout.CanaryWeight
+	case RolloutBlueGreen:
+		return 0
+	default:
+		return 100
+	}
+}
@@ -0,0 +1,216 @@
+package service
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+
+	"github.com/mildred/conductor.go/src/utils"
+)
+
+// The JSON Schema of the service file is generated from the Service structure
+// so it always follows the fields the decoder accepts.
+
+const SchemaId = "https://github.com/mildred/conductor.go/conductor-service.schema.json"
+
+var HookWhens = []string{
+	"pre-start", "post-start", "pre-stop", "post-stop",
+	"pre-start-service", "post-start-service", "pre-stop-service", "post-stop-service",
+}
+
+var FunctionFormats = []string{"cgi", "http-stdio", "sdactivate", "fastcgi"}
+
+// Keys accepted at the top-level of the service file that are not decoded in
+// the Service structure
+var serviceExtraKeys = map[string]interface{}{
+	"$schema": map[string]interface{}{"type": "string"},
+	"inherit": map[string]interface{}{
+		"oneOf": []interface{}{
+			map[string]interface{}{"$ref": "#/$defs/inherit"},
+			map[string]interface{}{"type": "array", "items": map[string]interface{}{"$ref": "#/$defs/inherit"}},
+		},
+	},
+}
+
+// Schemas for types with a custom JSON decoder
+var schemaOverrides = map[reflect.Type]interface{}{
+	reflect.TypeOf(ConfigValue{}): map[string]interface{}{
+		"oneOf": []interface{}{
+			map[string]interface{}{"type": []string{"string", "number", "boolean", "null"}},
+			map[string]interface{}{
+				"type":        "object",
+				"description": "secret value, read from exactly one of file, credential or age",
+				"properties": map[string]interface{}{
+					"file":       map[string]interface{}{"type": "string"},
+					"credential": map[string]interface{}{"type": "string"},
+					"age":        map[string]interface{}{"type": "string"},
+					"identity":   map[string]interface{}{"type": "string"},
+				},
+				"additionalProperties": false,
+			},
+		},
+	},
+	reflect.TypeOf(utils.JSONDuration(0)): map[string]interface{}{
+		"type":        []string{"string", "number"},
+		"description": "duration such as 5s or 2m, or a number of nanoseconds",
+	},
+	reflect.TypeOf(json.RawMessage{}): map[string]interface{}{},
+	reflect.TypeOf(DisplayColumn{}): map[string]interface{}{
+		"oneOf": []interface{}{
+			map[string]interface{}{"type": "string"},
+			map[string]interface{}{"$ref": "#/$defs/DisplayColumnData"},
+		},
+	},
+}
+
+// Enumerations for string fields, keyed by "Type.json_name"
+var schemaEnums = map[string][]string{
+	"Hook.when":              HookWhens,
+	"ServiceFunction.format": FunctionFormats,
+	"RolloutConfig.strategy": {RolloutRecreate, RolloutRolling, RolloutCanary, RolloutBlueGreen},
+	"HealthCheckHTTP.scheme": {"http", "https"},
+}
+
+// Types whose fields are checked in place of the decoded type
+var schemaAliases = map[reflect.Type]reflect.Type{
+	reflect.TypeOf(DisplayColumn{}): reflect.TypeOf(DisplayColumnData{}),
+}
+
+type jsonField struct {
+	Name  string
+	Type  reflect.Type
+	Owner reflect.Type
+}
+
+// Return the fields decoded from a JSON object for a struct type
+func jsonFields(t reflect.Type) []jsonField {
+	var fields []jsonField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		name, _, _ := strings.Cut(tag, ",")
+		if name == "-" {
+			continue
+		}
+
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				fields = append(fields, jsonFields(ft)...)
+				continue
+			}
+		}
+
+		if !f.IsExported() {
+			continue
+		}
+
+		if name == "" {
+			name = f.Name
+		}
+		fields = append(fields, jsonField{Name: name, Type: f.Type, Owner: t})
+	}
+	return fields
+}
+
+type schemaGenerator struct {
+	defs map[string]interface{}
+}
+
+func (g *schemaGenerator) schema(t reflect.Type) interface{} {
+	if override, ok := schemaOverrides[t]; ok {
+		return override
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return nullable(g.schema(t.Elem()))
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Implements(mergeListType) {
+			items := map[string]interface{}{"type": "array", "items": g.schema(t.Elem())}
+			return nullable(map[string]interface{}{
+				"oneOf": []interface{}{
+					items,
+					map[string]interface{}{
+						"type":                 "object",
+						"properties":           map[string]interface{}{"$append": items, "$prepend": items},
+						"additionalProperties": false,
+					},
+				},
+			})
+		}
+		return nullable(map[string]interface{}{"type": "array", "items": g.schema(t.Elem())})
+	case reflect.Map:
+		return nullable(map[string]interface{}{"type": "object", "additionalProperties": g.schema(t.Elem())})
+	case reflect.Struct:
+		name := t.Name()
+		if _, ok := g.defs[name]; !ok {
+			g.defs[name] = nil // Prevent infinite recursion
+			g.defs[name] = g.object(t, nil)
+		}
+		return map[string]interface{}{"$ref": "#/$defs/" + name}
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+// Values that are decoded from null
+func nullable(schema interface{}) interface{} {
+	return map[string]interface{}{
+		"anyOf": []interface{}{schema, map[string]interface{}{"type": "null"}},
+	}
+}
+
+func (g *schemaGenerator) object(t reflect.Type, extra map[string]interface{}) map[string]interface{} {
+	properties := map[string]interface{}{}
+	for k, v := range extra {
+		properties[k] = v
+	}
+
+	for _, f := range jsonFields(t) {
+		schema := g.schema(f.Type)
+		if enum, ok := schemaEnums[f.Owner.Name()+"."+f.Name]; ok {
+			schema = map[string]interface{}{"type": "string", "enum": enum}
+		}
+		properties[f.Name] = schema
+	}
+
+	return map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+}
+
+// Generate the JSON Schema of the service file
+func Schema() ([]byte, error) {
+	g := &schemaGenerator{defs: map[string]interface{}{}}
+
+	g.schema(reflect.TypeOf(DisplayColumnData{}))
+	g.defs["inherit"] = map[string]interface{}{
+		"oneOf": []interface{}{
+			map[string]interface{}{"type": "string"},
+			g.object(reflect.TypeOf(InheritFileBase{}), nil),
+		},
+	}
+
+	schema := g.object(reflect.TypeOf(Service{}), serviceExtraKeys)
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["$id"] = SchemaId
+	schema["title"] = "Conductor service"
+	schema["$defs"] = g.defs
+
+	return json.MarshalIndent(schema, "", "  ")
+}
@@ -0,0 +1,250 @@
+package service
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/mildred/conductor.go/src/dirs"
+	"github.com/mildred/conductor.go/src/tmpl"
+)
+
+// Secret config values reference their content which is only read when
+// templates, hooks and commands run. Only the reference is marshalled, and a
+// keyed hash of the content is part of the service id.
+
+const SecretMask = tmpl.SecretMask
+
+var AgeIdentityFile = filepath.Join(dirs.SelfConfigHome, "age-identity.txt")
+
+// Node-local key of the secret hashes, generated on first use
+var SecretHashKeyFile = filepath.Join(dirs.SelfStateHome, "secret-hash.key")
+
+var CredentialDirs = []string{"/run/credstore", "/etc/credstore", "/usr/local/lib/credstore", "/usr/lib/credstore"}
+
+type ConfigSecret struct {
+	File       string `json:"file,omitempty"`       // Plain file
+	Credential string `json:"credential,omitempty"` // systemd credential name
+	Age        string `json:"age,omitempty"`        // age encrypted file
+	Identity   string `json:"identity,omitempty"`   // age identity file
+	Hash       string `json:"hash,omitempty"`       // Content HMAC, only set to compute the service id
+}
+
+func (secret *ConfigSecret) check() error {
+	var n = 0
+	for _, src := range []string{secret.File, secret.Credential, secret.Age} {
+		if src != "" {
+			n++
+		}
+	}
+	if n != 1 {
+		return fmt.Errorf("secret must have exactly one of file, credential or age")
+	} else if secret.Identity != "" && secret.Age == "" {
+		return fmt.Errorf("secret identity is only valid with age")
+	}
+	return nil
+}
+
+func (secret *ConfigSecret) FixPaths(dir string) error {
+	if err := fix_path(dir, &secret.File, false); err != nil {
+		return err
+	}
+	if err := fix_path(dir, &secret.Age, false); err != nil {
+		return err
+	}
+	return fix_path(dir, &secret.Identity, false)
+}
+
+// Read the secret content
+func (secret *ConfigSecret) Read() (string, error) {
+	var data []byte
+	var err error
+
+	if secret.File != "" {
+		data, err = os.ReadFile(secret.File)
+	} else if secret.Credential != "" {
+		data, err = readCredential(secret.Credential)
+	} else if secret.Age != "" {
+		identity := secret.Identity
+		if identity == "" {
+			identity = AgeIdentityFile
+		}
+
+		var stderr bytes.Buffer
+		cmd := exec.Command("age", "--decrypt", "-i", identity, secret.Age)
+		cmd.Stderr = &stderr
+		data, err = cmd.Output()
+		if err != nil {
+			err = fmt.Errorf("while decrypting %s, %v: %s", secret.Age, err, strings.TrimSpace(stderr.String()))
+		}
+	} else {
+		err = fmt.Errorf("empty secret")
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSuffix(string(data), "\n"), nil
+}
+
+// Read a systemd credential, either passed to the current unit with
+// LoadCredential= or from the system credential store
+func readCredential(name string) ([]byte, error) {
+	if strings.Contains(name, "/") {
+		return nil, fmt.Errorf("invalid credential name %q", name)
+	}
+
+	if creds := os.Getenv("CREDENTIALS_DIRECTORY"); creds != "" {
+		data, err := os.ReadFile(filepath.Join(creds, name))
+		if err == nil || !os.IsNotExist(err) {
+			return data, err
+		}
+	}
+
+	for _, dir := range CredentialDirs {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err == nil || !os.IsNotExist(err) {
+			return data, err
+		}
+
+		fname := filepath.Join(dir+".encrypted", name)
+		if _, err := os.Stat(fname); err == nil {
+			var stderr bytes.Buffer
+			cmd := exec.Command("systemd-creds", "decrypt", "--name="+name, fname, "-")
+			cmd.Stderr = &stderr
+			data, err := cmd.Output()
+			if err != nil {
+				return nil, fmt.Errorf("while decrypting credential %s, %v: %s", name, err, strings.TrimSpace(stderr.String()))
+			}
+			return data, nil
+		}
+	}
+
+	return nil, fmt.Errorf("credential %s not found", name)
+}
+
+// Read the key of the secret hashes, or generate it. The hashes are keyed so
+// that the ids and diffs do not allow to guess the secrets.
+func secretHashKey() ([]byte, error) {
+	key, err := os.ReadFile(SecretHashKeyFile)
+	if err == nil {
+		return key, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key = make([]byte, 32)
+	_, err = rand.Read(key)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.MkdirAll(filepath.Dir(SecretHashKeyFile), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	// Write the key to a temporary file and link it in place so that readers
+	// never see a partial key and concurrent writers agree on a single key
+	f, err := os.CreateTemp(filepath.Dir(SecretHashKeyFile), ".secret-hash.key.*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	_, err = f.Write(key)
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.Link(f.Name(), SecretHashKeyFile)
+	if errors.Is(err, fs.ErrExist) {
+		// Created concurrently
+		return os.ReadFile(SecretHashKeyFile)
+	} else if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// Return a copy of the secret with the keyed hash of its content, or with the
+// hash already recorded
+func (secret *ConfigSecret) withHash() (*ConfigSecret, error) {
+	var res = *secret
+	if secret.Hash != "" {
+		return &res, nil
+	}
+
+	content, err := secret.Read()
+	if err != nil {
+		return nil, fmt.Errorf("while reading secret to compute the service id, %v", err)
+	}
+
+	res.Hash, err = KeyedHash([]byte(content))
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Return the hash of the data keyed with the node secret hash key, to record
+// sensitive values without allowing to guess them
+func KeyedHash(data []byte) (string, error) {
+	key, err := secretHashKey()
+	if err != nil {
+		return "", fmt.Errorf("while reading %s, %v", SecretHashKeyFile, err)
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// Return the keyed hashes of the secret config values, to be recorded with the
+// deployments
+func (service *Service) ComputeSecretHashes() (map[string]string, error) {
+	var hashes = map[string]string{}
+	for k, v := range service.Config {
+		if v == nil || v.Kind != ConfigValueSecret {
+			continue
+		}
+
+		secret, err := v.Secret.withHash()
+		if err != nil {
+			return nil, fmt.Errorf("config %s, %v", k, err)
+		}
+		hashes[k] = secret.Hash
+	}
+	return hashes, nil
+}
+
+// Return a copy of the service whose secrets use the recorded hashes instead
+// of hashing their current content
+func (service *Service) WithSecretHashes(hashes map[string]string) *Service {
+	var res = *service
+	res.Config = map[string]*ConfigValue{}
+	for k, v := range service.Config {
+		if hash, ok := hashes[k]; ok && v != nil && v.Kind == ConfigValueSecret {
+			var secret = *v.Secret
+			secret.Hash = hash
+			v = &ConfigValue{ConfigValueSecret, "", &secret}
+		}
+		res.Config[k] = v
+	}
+	return &res
+}
@@ -1,47 +1,445 @@
 package service
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/mildred/conductor.go/src/dirs"
+	"github.com/mildred/conductor.go/src/utils"
 )
 
+// A condition matches when all the predicates it declares match. A condition
+// without any predicate never matches.
 type ServiceCondition struct {
-	Hostname *string `json:"hostname"`
+	Hostname      *string            `json:"hostname"`
+	HostnameGlob  *string            `json:"hostname_glob,omitempty"`
+	HostnameRegex *string            `json:"hostname_regex,omitempty"`
+	Labels        map[string]string  `json:"labels,omitempty"`      // Node labels (glob values)
+	Env           map[string]string  `json:"env,omitempty"`         // Environment variables (glob values)
+	FileExists    *string            `json:"file_exists,omitempty"` // Relative to the service directory
+	Command       []string           `json:"command,omitempty"`     // Matches if exit status is 0
+	All           []ServiceCondition `json:"all,omitempty"`
+	Any           []ServiceCondition `json:"any,omitempty"`
+	Not           *ServiceCondition  `json:"not,omitempty"`
+}
+
+var ConditionCommandTimeout = 30 * time.Second
+
+// Command conditions are only run on reload and plan, their results are
+// recorded there so that listings can show them without running the commands
+var ConditionCommandsDir = dirs.Join(dirs.SelfRuntimeDir, "conditions")
+
+type commandResult struct {
+	Result bool      `json:"result"`
+	Detail string    `json:"detail,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+func conditionCommandsPath(service_dir string) string {
+	return filepath.Join(ConditionCommandsDir, ServiceUnit(service_dir)+".json")
+}
+
+// The evaluation tree of a condition
+type ConditionResult struct {
+	Condition    string             `json:"condition"`
+	Result       bool               `json:"result"`
+	Detail       string             `json:"detail,omitempty"`
+	NotEvaluated bool               `json:"not_evaluated,omitempty"` // Command never run
+	Children     []*ConditionResult `json:"children,omitempty"`
+}
+
+// Return false if the result depends on a command condition that was never run
+func (r *ConditionResult) Evaluated() bool {
+	if r.NotEvaluated {
+		return false
+	}
+	for _, child := range r.Children {
+		if !child.Evaluated() {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *ConditionResult) String() string {
+	if r.Detail != "" {
+		return fmt.Sprintf("%s (%s)", r.Condition, r.Detail)
+	}
+	return r.Condition
+}
+
+func (r *ConditionResult) Lines() []string {
+	var lines = []string{fmt.Sprintf("[%v] %s", r.Result, r.String())}
+	for _, child := range r.Children {
+		for _, line := range child.Lines() {
+			lines = append(lines, "  "+line)
+		}
+	}
+	return lines
+}
+
+type conditionEnv struct {
+	dir      string
+	facts    *NodeFacts
+	probe    bool                      // Run the command conditions
+	commands map[string]*commandResult // Command results by command line
+}
+
+func (env *conditionEnv) readCommands() error {
+	env.commands = map[string]*commandResult{}
+
+	data, err := os.ReadFile(conditionCommandsPath(env.dir))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(data, &env.commands)
+	if err != nil {
+		return fmt.Errorf("while reading %s, %v", conditionCommandsPath(env.dir), err)
+	}
+	return nil
+}
+
+func (env *conditionEnv) writeCommands() error {
+	if len(env.commands) == 0 {
+		err := os.Remove(conditionCommandsPath(env.dir))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	data, err := json.Marshal(env.commands)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(ConditionCommandsDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(conditionCommandsPath(env.dir), data, 0644)
+}
+
+func (env *conditionEnv) nodeFacts() (*NodeFacts, error) {
+	if env.facts == nil {
+		facts, err := ReadNodeFacts()
+		if err != nil {
+			return nil, err
+		}
+		env.facts = facts
+	}
+	return env.facts, nil
 }
 
-func EvaluateConditions(conditions []ServiceCondition, verbose bool) (res bool, err error) {
+// The service conditions match if any condition in the list matches. The
+// command conditions are run only if probe is true, else the result recorded
+// by the last probe is used.
+func EvaluateConditions(conditions []ServiceCondition, dir string, probe bool) (*ConditionResult, error) {
 	if len(conditions) == 0 {
-		return true, nil
+		return &ConditionResult{Condition: "no condition", Result: true}, nil
+	}
+
+	env := &conditionEnv{dir: dir, probe: probe}
+	if probe {
+		env.commands = map[string]*commandResult{}
+	} else {
+		err := env.readCommands()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	res, err := evaluateAny(env, "any", conditions)
+	if err != nil {
+		return nil, err
 	}
 
+	if probe {
+		err = env.writeCommands()
+		if err != nil {
+			return nil, fmt.Errorf("while recording the command conditions, %v", err)
+		}
+	}
+
+	return res, nil
+}
+
+func evaluateAny(env *conditionEnv, name string, conditions []ServiceCondition) (*ConditionResult, error) {
+	var res = &ConditionResult{Condition: name}
 	for _, cond := range conditions {
-		res, err = cond.Evaluate(verbose)
-		if res || err != nil {
-			return res, err
+		child, err := cond.evaluate(env)
+		if err != nil {
+			return nil, err
+		}
+		res.Children = append(res.Children, child)
+		if child.Result {
+			res.Result = true
+			break
+		}
+	}
+	return res, nil
+}
+
+func evaluateAll(env *conditionEnv, name string, conditions []ServiceCondition) (*ConditionResult, error) {
+	var res = &ConditionResult{Condition: name, Result: true}
+	for _, cond := range conditions {
+		child, err := cond.evaluate(env)
+		if err != nil {
+			return nil, err
+		}
+		res.Children = append(res.Children, child)
+		if !child.Result {
+			res.Result = false
+			break
 		}
 	}
+	return res, nil
+}
 
-	return false, nil
+func globMatch(pattern, value string) (bool, error) {
+	matched, err := filepath.Match(pattern, value)
+	if err != nil {
+		return false, fmt.Errorf("invalid pattern %q, %v", pattern, err)
+	}
+	return matched, nil
 }
 
-func (cond *ServiceCondition) Evaluate(verbose bool) (bool, error) {
-	var result = false
+func (cond *ServiceCondition) evaluate(env *conditionEnv) (*ConditionResult, error) {
+	var predicates []func() (*ConditionResult, error)
 
-	if cond.Hostname != nil {
+	if cond.Hostname != nil || cond.HostnameGlob != nil || cond.HostnameRegex != nil {
 		hostname, err := os.Hostname()
 		if err != nil {
-			return false, fmt.Errorf("could not check hostname condition for %+s, %v", *cond.Hostname, err)
+			return nil, fmt.Errorf("could not check hostname condition, %v", err)
 		}
 
-		result = hostname == *cond.Hostname
-		if verbose {
-			log.Printf("Check service condition hostname=%+v: %v", *cond.Hostname, result)
+		if cond.Hostname != nil {
+			predicates = append(predicates, func() (*ConditionResult, error) {
+				return &ConditionResult{
+					Condition: fmt.Sprintf("hostname=%s", *cond.Hostname),
+					Result:    hostname == *cond.Hostname,
+					Detail:    "hostname is " + hostname,
+				}, nil
+			})
 		}
-		if !result {
-			return false, nil
+
+		if cond.HostnameGlob != nil {
+			predicates = append(predicates, func() (*ConditionResult, error) {
+				matched, err := globMatch(*cond.HostnameGlob, hostname)
+				return &ConditionResult{
+					Condition: fmt.Sprintf("hostname_glob=%s", *cond.HostnameGlob),
+					Result:    matched,
+					Detail:    "hostname is " + hostname,
+				}, err
+			})
+		}
+
+		if cond.HostnameRegex != nil {
+			predicates = append(predicates, func() (*ConditionResult, error) {
+				matched, err := regexp.MatchString(*cond.HostnameRegex, hostname)
+				if err != nil {
+					return nil, fmt.Errorf("invalid hostname_regex %q, %v", *cond.HostnameRegex, err)
+				}
+				return &ConditionResult{
+					Condition: fmt.Sprintf("hostname_regex=%s", *cond.HostnameRegex),
+					Result:    matched,
+					Detail:    "hostname is " + hostname,
+				}, nil
+			})
 		}
 	}
 
-	return result, nil
+	for _, key := range utils.SortedStringKeys(cond.Labels) {
+		pattern := cond.Labels[key]
+		predicates = append(predicates, func() (*ConditionResult, error) {
+			facts, err := env.nodeFacts()
+			if err != nil {
+				return nil, err
+			}
+
+			var res = &ConditionResult{Condition: fmt.Sprintf("label %s=%s", key, pattern)}
+			value, ok := facts.Labels[key]
+			if ok {
+				res.Detail = fmt.Sprintf("%s=%s", key, value)
+				res.Result, err = globMatch(pattern, value)
+			} else {
+				res.Detail = fmt.Sprintf("no label %s", key)
+			}
+			return res, err
+		})
+	}
+
+	for _, key := range utils.SortedStringKeys(cond.Env) {
+		pattern := cond.Env[key]
+		predicates = append(predicates, func() (*ConditionResult, error) {
+			var err error
+			var res = &ConditionResult{Condition: fmt.Sprintf("env %s=%s", key, pattern)}
+			value, ok := os.LookupEnv(key)
+			if ok {
+				res.Detail = fmt.Sprintf("%s=%s", key, value)
+				res.Result, err = globMatch(pattern, value)
+			} else {
+				res.Detail = fmt.Sprintf("%s is not set", key)
+			}
+			return res, err
+		})
+	}
+
+	if cond.FileExists != nil {
+		predicates = append(predicates, func() (*ConditionResult, error) {
+			fname := *cond.FileExists
+			if !path.IsAbs(fname) {
+				fname = path.Join(env.dir, fname)
+			}
+
+			_, err := os.Stat(fname)
+			if err != nil && !os.IsNotExist(err) {
+				return nil, fmt.Errorf("could not check file_exists condition for %s, %v", fname, err)
+			}
+			return &ConditionResult{
+				Condition: fmt.Sprintf("file_exists=%s", *cond.FileExists),
+				Result:    err == nil,
+			}, nil
+		})
+	}
+
+	if len(cond.Command) > 0 {
+		predicates = append(predicates, func() (*ConditionResult, error) {
+			var command_line = strings.Join(cond.Command, " ")
+			var res = &ConditionResult{Condition: fmt.Sprintf("command %s", command_line)}
+
+			if !env.probe {
+				recorded, ok := env.commands[command_line]
+				if !ok {
+					res.Detail = "not evaluated"
+					res.NotEvaluated = true
+					return res, nil
+				}
+				res.Result = recorded.Result
+				res.Detail = fmt.Sprintf("at %s", recorded.Time.Format(time.DateTime))
+				if recorded.Detail != "" {
+					res.Detail = fmt.Sprintf("%s %s", recorded.Detail, res.Detail)
+				}
+				return res, nil
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), ConditionCommandTimeout)
+			defer cancel()
+
+			cmd := exec.CommandContext(ctx, cond.Command[0], cond.Command[1:]...)
+			cmd.Dir = env.dir
+			cmd.Stderr = os.Stderr
+
+			err := cmd.Run()
+			var exit_error *exec.ExitError
+			if errors.As(err, &exit_error) {
+				res.Detail = exit_error.String()
+			} else if err != nil {
+				return nil, fmt.Errorf("could not run command condition %v, %v", cond.Command, err)
+			} else {
+				res.Result = true
+			}
+
+			env.commands[command_line] = &commandResult{res.Result, res.Detail, time.Now()}
+			return res, nil
+		})
+	}
+
+	if len(cond.All) > 0 {
+		predicates = append(predicates, func() (*ConditionResult, error) {
+			return evaluateAll(env, "all", cond.All)
+		})
+	}
+
+	if len(cond.Any) > 0 {
+		predicates = append(predicates, func() (*ConditionResult, error) {
+			return evaluateAny(env, "any", cond.Any)
+		})
+	}
+
+	if cond.Not != nil {
+		predicates = append(predicates, func() (*ConditionResult, error) {
+			child, err := cond.Not.evaluate(env)
+			if err != nil {
+				return nil, err
+			}
+			return &ConditionResult{
+				Condition: "not",
+				Result:    !child.Result,
+				Children:  []*ConditionResult{child},
+			}, nil
+		})
+	}
+
+	if len(predicates) == 0 {
+		return &ConditionResult{Condition: "empty condition"}, nil
+	} else if len(predicates) == 1 {
+		return predicates[0]()
+	}
+
+	var res = &ConditionResult{Condition: "all", Result: true}
+	for _, predicate := range predicates {
+		child, err := predicate()
+		if err != nil {
+			return nil, err
+		}
+		res.Children = append(res.Children, child)
+		if !child.Result {
+			res.Result = false
+			break
+		}
+	}
+	return res, nil
+}
+
+// Explain why the service is disabled or enabled given the result of
+// EvaluateConditionTree
+func ConditionReason(res *ConditionResult, disable bool) string {
+	if disable {
+		return "service is disabled explicitly"
+	} else if len(res.Children) == 0 && res.Result {
+		return "service has no condition"
+	} else if res.Result {
+		return "service conditions match"
+	}
+
+	return fmt.Sprintf("no service condition match: %s", strings.Join(res.failures(), ", "))
+}
+
+// Return the conditions responsible for the result to be false
+func (r *ConditionResult) failures() []string {
+	if r.Result {
+		return nil
+	} else if r.Condition == "not" && len(r.Children) == 1 {
+		return []string{fmt.Sprintf("not %s", r.Children[0].String())}
+	} else if len(r.Children) == 0 {
+		return []string{r.String()}
+	}
+
+	var res []string
+	for _, child := range r.Children {
+		res = append(res, child.failures()...)
+	}
+	return res
+}
+
+func logConditionResult(res *ConditionResult) {
+	log.Printf("Check service conditions: %v", res.Result)
+	for _, line := range res.Lines() {
+		log.Printf("  %s", line)
+	}
 }
@@ -0,0 +1,462 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/tailscale/hujson"
+
+	"github.com/mildred/conductor.go/src/caddy"
+	"github.com/mildred/conductor.go/src/tmpl"
+)
+
+type ValidationProblem struct {
+	File    string `json:"file"`
+	Line    int    `json:"line,omitempty"`
+	Column  int    `json:"column,omitempty"`
+	Path    string `json:"path,omitempty"` // JSON pointer within the file
+	Message string `json:"message"`
+}
+
+func (p *ValidationProblem) String() string {
+	var res = p.File
+	if p.Line > 0 {
+		res += fmt.Sprintf(":%d:%d", p.Line, p.Column)
+	}
+	if p.Path != "" {
+		res += ": " + p.Path
+	}
+	return res + ": " + p.Message
+}
+
+type sourceFile struct {
+	path     string
+	data     []byte
+	root     hujson.Value
+	problems []*ValidationProblem
+}
+
+func lineColumn(data []byte, offset int) (int, int) {
+	if offset > len(data) {
+		offset = len(data)
+	}
+	line := 1 + strings.Count(string(data[:offset]), "\n")
+	column := 1 + offset - (strings.LastIndex(string(data[:offset]), "\n") + 1)
+	return line, column
+}
+
+func (f *sourceFile) add(offset int, ptr string, format string, args ...interface{}) {
+	p := &ValidationProblem{
+		File:    f.path,
+		Path:    ptr,
+		Message: fmt.Sprintf(format, args...),
+	}
+	if offset >= 0 {
+		p.Line, p.Column = lineColumn(f.data, offset)
+	}
+	f.problems = append(f.problems, p)
+}
+
+func parseSourceFile(path string) (*sourceFile, error) {
+	data, err := readSourceFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseSource(path, data), nil
+}
+
+func parseSource(path string, data []byte) *sourceFile {
+	var err error
+	f := &sourceFile{path: path, data: data}
+	f.root, err = hujson.Parse(data)
+	if err != nil {
+		f.add(-1, "", "%v", err)
+	}
+	return f
+}
+
+func jsonPointer(ptr string, key string) string {
+	key = strings.ReplaceAll(key, "~", "~0")
+	key = strings.ReplaceAll(key, "/", "~1")
+	return ptr + "/" + key
+}
+
+func member(v *hujson.Value, name string) *hujson.Value {
+	obj, ok := v.Value.(*hujson.Object)
+	if !ok {
+		return nil
+	}
+	for i := range obj.Members {
+		if key, ok := obj.Members[i].Name.Value.(hujson.Literal); ok && key.String() == name {
+			return &obj.Members[i].Value
+		}
+	}
+	return nil
+}
+
+func elements(v *hujson.Value) []*hujson.Value {
+	var res []*hujson.Value
+	if v == nil {
+		return nil
+	} else if arr, ok := v.Value.(*hujson.Array); ok {
+		for i := range arr.Elements {
+			res = append(res, &arr.Elements[i])
+		}
+	}
+	return res
+}
+
+func stringValue(v *hujson.Value) (string, bool) {
+	if v == nil {
+		return "", false
+	}
+	lit, ok := v.Value.(hujson.Literal)
+	if !ok || lit.Kind() != '"' {
+		return "", false
+	}
+	return lit.String(), true
+}
+
+func boolValue(v *hujson.Value) bool {
+	if v == nil {
+		return false
+	}
+	lit, ok := v.Value.(hujson.Literal)
+	return ok && lit.Kind() == 't'
+}
+
+var unmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+// Report object keys that are not decoded in the type t
+func (f *sourceFile) checkFields(v *hujson.Value, t reflect.Type, ptr string, extra_keys map[string]interface{}) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	if alias, ok := schemaAliases[t]; ok {
+		t = alias
+	} else if t.Kind() != reflect.Slice && t.Kind() != reflect.Map && (t.Implements(unmarshalerType) || reflect.PointerTo(t).Implements(unmarshalerType)) {
+		return
+	}
+
+	switch val := v.Value.(type) {
+	case *hujson.Object:
+		if t.Kind() == reflect.Map {
+			for i := range val.Members {
+				key := val.Members[i].Name.Value.(hujson.Literal).String()
+				f.checkFields(&val.Members[i].Value, t.Elem(), jsonPointer(ptr, key), nil)
+			}
+		} else if t.Kind() == reflect.Slice && t.Implements(mergeListType) {
+			for i := range val.Members {
+				key := val.Members[i].Name.Value.(hujson.Literal).String()
+				if key != "$append" && key != "$prepend" {
+					f.add(val.Members[i].Name.StartOffset, jsonPointer(ptr, key), "unknown list merge directive %q", key)
+					continue
+				}
+				f.checkFields(&val.Members[i].Value, reflect.SliceOf(t.Elem()), jsonPointer(ptr, key), nil)
+			}
+		} else if t.Kind() == reflect.Struct {
+			fields := jsonFields(t)
+			for i := range val.Members {
+				key := val.Members[i].Name.Value.(hujson.Literal).String()
+				if _, ok := extra_keys[key]; ok {
+					continue
+				}
+
+				idx := slices.IndexFunc(fields, func(f jsonField) bool { return f.Name == key })
+				if idx == -1 {
+					f.add(val.Members[i].Name.StartOffset, jsonPointer(ptr, key), "unknown field %q", key)
+					continue
+				}
+				f.checkFields(&val.Members[i].Value, fields[idx].Type, jsonPointer(ptr, key), nil)
+			}
+		}
+	case *hujson.Array:
+		if t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+			for i := range val.Elements {
+				f.checkFields(&val.Elements[i], t.Elem(), jsonPointer(ptr, strconv.Itoa(i)), nil)
+			}
+		}
+	}
+}
+
+// Return the unknown fields in the service file content
+func UnknownFields(path string, data []byte) []*ValidationProblem {
+	f := parseSource(path, data)
+	if len(f.problems) == 0 {
+		f.checkFields(&f.root, reflect.TypeOf(Service{}), "", serviceExtraKeys)
+	}
+	return f.problems
+}
+
+// Check that a file referenced from the service file exists and can be
+// executed, or for Go templates that it can be parsed
+func (f *sourceFile) checkExecutable(v *hujson.Value, ptr string, is_executable bool) {
+	fname, ok := stringValue(v)
+	if !ok || fname == "" {
+		return
+	}
+
+	if err := fix_path(filepath.Dir(f.path), &fname, is_executable); err != nil {
+		f.add(v.StartOffset, ptr, "%v", err)
+		return
+	}
+
+	if tmpl.IsGoTemplate(fname) && !is_executable {
+		if _, err := tmpl.ParseGoTemplate(fname); err != nil {
+			f.add(v.StartOffset, ptr, "%v", err)
+		}
+		return
+	}
+
+	if !strings.Contains(fname, "/") {
+		_, err := exec.LookPath(fname)
+		if err != nil {
+			f.add(v.StartOffset, ptr, "%v", err)
+		}
+		return
+	}
+
+	st, err := os.Stat(fname)
+	if err != nil {
+		f.add(v.StartOffset, ptr, "%v", err)
+	} else if st.IsDir() {
+		f.add(v.StartOffset, ptr, "%s is a directory", fname)
+	} else if st.Mode()&0111 == 0 {
+		f.add(v.StartOffset, ptr, "%s is not executable", fname)
+	}
+}
+
+// Check for duplicate names in pods or functions
+func (f *sourceFile) checkNames(list *hujson.Value, ptr string) {
+	var names []string
+	for i, item := range elements(list) {
+		name, _ := stringValue(member(item, "name"))
+		if slices.Contains(names, name) {
+			f.add(item.StartOffset, jsonPointer(ptr, strconv.Itoa(i)), "duplicate part name %q", name)
+		}
+		names = append(names, name)
+	}
+}
+
+// Semantic checks on a single service file
+func (f *sourceFile) checkSemantics() {
+	root := &f.root
+
+	var type_err *json.UnmarshalTypeError
+	var syntax_err *json.SyntaxError
+	data, err := hujson.Standardize(slices.Clone(f.data))
+	if err == nil {
+		err = json.Unmarshal(data, &Service{})
+	}
+	if errors.As(err, &type_err) {
+		f.add(int(type_err.Offset), "", "%v", err)
+	} else if errors.As(err, &syntax_err) {
+		f.add(int(syntax_err.Offset), "", "%v", err)
+	} else if err != nil {
+		f.add(-1, "", "%v", err)
+	}
+
+	f.checkExecutable(member(root, "proxy_config_template"), "/proxy_config_template", false)
+
+	f.checkNames(member(root, "pods"), "/pods")
+	for i, pod := range elements(member(root, "pods")) {
+		ptr := jsonPointer("/pods", strconv.Itoa(i))
+		for _, key := range []string{"pod_template", "config_map_template", "part_id_template"} {
+			f.checkExecutable(member(pod, key), jsonPointer(ptr, key), false)
+		}
+	}
+
+	f.checkNames(member(root, "functions"), "/functions")
+	for i, fct := range elements(member(root, "functions")) {
+		ptr := jsonPointer("/functions", strconv.Itoa(i))
+		if format := member(fct, "format"); format != nil {
+			if val, _ := stringValue(format); !slices.Contains(FunctionFormats, val) {
+				f.add(format.StartOffset, jsonPointer(ptr, "format"), "unknown function format %q, must be one of %s", val, strings.Join(FunctionFormats, ", "))
+			}
+		}
+		f.checkExecutable(member(fct, "part_id_template"), jsonPointer(ptr, "part_id_template"), false)
+		if exec := elements(member(fct, "exec")); len(exec) > 0 {
+			f.checkExecutable(exec[0], jsonPointer(jsonPointer(ptr, "exec"), "0"), false)
+		}
+	}
+
+	for i, hook := range elements(member(root, "hooks")) {
+		ptr := jsonPointer("/hooks", strconv.Itoa(i))
+		when := member(hook, "when")
+		if val, _ := stringValue(when); when != nil && !slices.Contains(HookWhens, val) {
+			f.add(when.StartOffset, jsonPointer(ptr, "when"), "unknown hook %q, must be one of %s", val, strings.Join(HookWhens, ", "))
+		}
+		if exec := elements(member(hook, "exec")); len(exec) > 0 {
+			f.checkExecutable(exec[0], jsonPointer(jsonPointer(ptr, "exec"), "0"), true)
+		}
+		if id, _ := stringValue(member(hook, "id")); id == "" && boolValue(member(hook, "$remove")) {
+			f.add(hook.StartOffset, ptr, "hooks without id cannot be removed")
+		}
+	}
+
+	if commands := member(root, "commands"); commands != nil {
+		if obj, ok := commands.Value.(*hujson.Object); ok {
+			for i := range obj.Members {
+				name := obj.Members[i].Name.Value.(hujson.Literal).String()
+				if exec := elements(member(&obj.Members[i].Value, "exec")); len(exec) > 0 {
+					f.checkExecutable(exec[0], jsonPointer(jsonPointer(jsonPointer("/commands", name), "exec"), "0"), true)
+				}
+			}
+		}
+	}
+
+	inherit := member(root, "inherit")
+	var inherits = elements(inherit)
+	if inherit != nil && inherits == nil {
+		inherits = []*hujson.Value{inherit}
+	}
+	for i, inh := range inherits {
+		ptr := "/inherit"
+		if inherit.Value.Kind() == '[' {
+			ptr = jsonPointer(ptr, strconv.Itoa(i))
+		}
+
+		var inh_file InheritFile
+		if err := json.Unmarshal(inh.Pack(), &inh_file); err != nil {
+			f.add(inh.StartOffset, ptr, "%v", err)
+			continue
+		}
+		if inh_file.IgnoreError {
+			continue
+		}
+
+		fname := inh_file.Path
+		if strings.HasSuffix(fname, "/") {
+			fname = filepath.Join(fname, ConfigName)
+		}
+		fname = join_paths(filepath.Dir(f.path), fname)
+		if _, err := os.Stat(fname); err != nil {
+			f.add(inh.StartOffset, ptr, "%v", err)
+		}
+	}
+}
+
+// Validate the service file and the files it inherits from
+func Validate(ctx context.Context, path string) ([]*ValidationProblem, error) {
+	var problems []*ValidationProblem
+	var visited []string
+
+	var visit func(path string) error
+	visit = func(path string) error {
+		if slices.Contains(visited, path) {
+			return nil
+		}
+		visited = append(visited, path)
+
+		f, err := parseSourceFile(path)
+		if err != nil {
+			return err
+		}
+
+		if len(f.problems) == 0 {
+			f.checkFields(&f.root, reflect.TypeOf(Service{}), "", serviceExtraKeys)
+			f.checkSemantics()
+		}
+		problems = append(problems, f.problems...)
+
+		data, err := hujson.Standardize(slices.Clone(f.data))
+		if err != nil {
+			return nil // already reported
+		}
+
+		inherit, err := DecodeInherit(data, filepath.Dir(path))
+		if err != nil {
+			return nil // already reported
+		}
+		for _, inh := range inherit.Inherit {
+			if err := statSourceFile(inh.Path); err != nil {
+				continue // already reported
+			}
+			err = visit(inh.Path)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	err := visit(path)
+	if err != nil {
+		return nil, err
+	}
+
+	service, err := LoadServiceFile(path)
+	if err != nil {
+		return append(problems, &ValidationProblem{File: path, Message: err.Error()}), nil
+	}
+
+	problems = append(problems, service.validateMerged(ctx)...)
+	return problems, nil
+}
+
+// Validate the service as if the file had the content, without writing it
+func ValidateEdited(ctx context.Context, path, filename string, content []byte) ([]*ValidationProblem, error) {
+	key := sourceKey(filename)
+	editedFiles[key] = content
+	defer delete(editedFiles, key)
+
+	return Validate(ctx, path)
+}
+
+// Checks on the service after inheritance
+func (service *Service) validateMerged(ctx context.Context) []*ValidationProblem {
+	var problems []*ValidationProblem
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, &ValidationProblem{
+			File:    service.FileName,
+			Message: fmt.Sprintf(format, args...),
+		})
+	}
+
+	for _, pod := range service.Pods {
+		if service.Functions.FindFunction(pod.Name) != nil {
+			add("part %q is declared both as a pod and a function", pod.Name)
+		}
+
+		if pod.PodTemplate == filepath.Join(service.BasePath, "pod.template") {
+			if _, err := os.Stat(pod.PodTemplate); err != nil {
+				add("pod %q: no pod_template and default %v", pod.Name, err)
+			}
+		}
+	}
+
+	for _, f := range service.Functions {
+		if f.Format == "" {
+			add("function %q: missing format, must be one of %s", f.Name, strings.Join(FunctionFormats, ", "))
+		}
+	}
+
+	configs, err := service.ProxyConfig(ctx)
+	if err != nil {
+		add("while generating proxy config, %v", err)
+	}
+	for _, config := range configs {
+		if !config.RegisterOnly {
+			continue
+		}
+
+		var snip caddy.ConfigSnip
+		if json.Unmarshal(config.Config, &snip) == nil && snip.Id != "" {
+			add("proxy config %s in %s: register_only is not allowed with @id %q", config.Id, config.MountPoint, snip.Id)
+		}
+	}
+
+	return problems
+}
@@ -0,0 +1,310 @@
+package service_internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"slices"
+	"syscall"
+	"time"
+
+	"github.com/taigrr/systemctl"
+	"github.com/taigrr/systemctl/properties"
+
+	"github.com/mildred/conductor.go/src/deployment"
+	"github.com/mildred/conductor.go/src/dirs"
+	"github.com/mildred/conductor.go/src/history"
+	"github.com/mildred/conductor.go/src/lock"
+	"github.com/mildred/conductor.go/src/utils"
+
+	. "github.com/mildred/conductor.go/src/service"
+)
+
+var CrashLoopDir = dirs.Join(dirs.SelfRuntimeDir, "crash-loops")
+
+// Failures of the service deployments, by part id
+type CrashLoopState struct {
+	Parts map[string]*CrashLoopPart `json:"parts"`
+}
+
+type CrashLoopPart struct {
+	Part      string      `json:"part"`
+	Failures  []time.Time `json:"failures"`
+	LastError string      `json:"last_error,omitempty"`
+	Degraded  *time.Time  `json:"degraded,omitempty"` // Time the part was degraded
+}
+
+func CrashLoopPath(service *Service) string {
+	return path.Join(CrashLoopDir, ServiceUnit(service.BasePath)+".json")
+}
+
+// Read the failures of the service, empty if there is none
+func ReadCrashLoop(service *Service) (*CrashLoopState, error) {
+	var state = &CrashLoopState{Parts: map[string]*CrashLoopPart{}}
+
+	data, err := os.ReadFile(CrashLoopPath(service))
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, state)
+	if err != nil {
+		return nil, fmt.Errorf("while reading %s, %v", CrashLoopPath(service), err)
+	}
+	if state.Parts == nil {
+		state.Parts = map[string]*CrashLoopPart{}
+	}
+	return state, nil
+}
+
+func (state *CrashLoopState) Save(service *Service) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(CrashLoopDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(CrashLoopPath(service), data, 0644)
+}
+
+// Hold an exclusive flock while the crash-loop state is read, modified and
+// saved. The state is written by the service operations and by the monitor.
+func lockCrashLoop(service *Service) (func(), error) {
+	err := os.MkdirAll(CrashLoopDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(CrashLoopPath(service)+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("while locking %s, %v", f.Name(), err)
+	}
+
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// Forget the failures of the service and leave the degraded state
+func ResetCrashLoop(service *Service) error {
+	unlock, err := lockCrashLoop(service)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	err = os.Remove(CrashLoopPath(service))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Return the failures of the part within the window
+func (part *CrashLoopPart) recentFailures(settings *CrashLoopConfig) []time.Time {
+	if part == nil {
+		return nil
+	}
+
+	since := time.Now().Add(-time.Duration(settings.Window))
+	return slices.DeleteFunc(slices.Clone(part.Failures), func(t time.Time) bool {
+		return t.Before(since)
+	})
+}
+
+// Record a failed deployment for the part, the part is degraded if it failed
+// too many times within the window
+func recordFailure(prefix string, service *Service, part, part_id string, failure error) {
+	settings := service.CrashLoopSettings()
+
+	unlock, err := lockCrashLoop(service)
+	if err != nil {
+		log.Printf("%s: ERROR locking crash-loop state (but continuing): %v", prefix, err)
+		return
+	}
+	defer unlock()
+
+	state, err := ReadCrashLoop(service)
+	if err != nil {
+		log.Printf("%s: ERROR reading crash-loop state (but continuing): %v", prefix, err)
+		return
+	}
+
+	// Forget the parts that did not fail recently
+	for id, p := range state.Parts {
+		if p.Degraded == nil && len(p.recentFailures(settings)) == 0 {
+			delete(state.Parts, id)
+		}
+	}
+
+	p := state.Parts[part_id]
+	if p == nil {
+		p = &CrashLoopPart{Part: part}
+		state.Parts[part_id] = p
+	}
+	p.Failures = append(p.recentFailures(settings), time.Now())
+	if failure != nil {
+		p.LastError = failure.Error()
+	}
+
+	log.Printf("%s: part %q: deployment failure %d within %s", prefix, part, len(p.Failures), time.Duration(settings.Window))
+	if p.Degraded == nil && settings.Degrades(len(p.Failures)) {
+		now := time.Now()
+		p.Degraded = &now
+		log.Printf("%s: part %q: service is degraded, no new deployment will be created until the configuration changes or the failures are reset", prefix, part)
+	}
+
+	err = state.Save(service)
+	if err != nil {
+		log.Printf("%s: ERROR saving crash-loop state (but continuing): %v", prefix, err)
+	}
+}
+
+// Record the pod deployments that crashed as failures of the part and return
+// the other deployments. Crashed deployments are removed, or reset to be
+// started again with static deployments.
+func removeFailedDeployments(ctx context.Context, prefix string, service *Service, part, part_id string, deployments []*deployment.Deployment, opts StartOrReloadOpts) []*deployment.Deployment {
+	var res []*deployment.Deployment
+	for _, depl := range deployments {
+		if depl.Pod == nil || depl.FailedReason() != "" {
+			// Deployments failed during a rollout are already recorded
+			res = append(res, depl)
+			continue
+		}
+
+		state, err := systemctl.Show(ctx, deployment.DeploymentUnit(depl.DeploymentName), properties.ActiveState, systemctl.Options{UserMode: !dirs.AsRoot})
+		if err != nil || state != "failed" {
+			res = append(res, depl)
+			continue
+		}
+
+		log.Printf("%s: part %q: deployment %s has failed", prefix, part, depl.DeploymentName)
+		recordFailure(prefix, service, part, part_id, fmt.Errorf("deployment %s has failed", depl.DeploymentName))
+
+		if service.StaticDeployments {
+			fmt.Fprintf(os.Stderr, "+ systemctl %s reset-failed %q\n", dirs.SystemdModeFlag(), deployment.DeploymentUnit(depl.DeploymentName))
+			cmd := exec.Command("systemctl", dirs.SystemdModeFlag(), "reset-failed", deployment.DeploymentUnit(depl.DeploymentName))
+			cmd.Stdout = os.Stdout
+			cmd.Stderr = os.Stderr
+			err = cmd.Run()
+			if err != nil {
+				log.Printf("%s: ERROR %v", prefix, err)
+			}
+		} else {
+			removeDeployments(prefix, []string{depl.DeploymentName}, opts)
+		}
+	}
+	return res
+}
+
+// Return the degraded parts of the service, for the current part ids
+func DegradedParts(ctx context.Context, service *Service) ([]string, error) {
+	state, err := ReadCrashLoop(service)
+	if err != nil || len(state.Parts) == 0 {
+		return nil, err
+	}
+
+	part_ids, err := service.PartIds(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var degraded []string
+	for _, part := range utils.SortedStringKeys(part_ids) {
+		if p := state.Parts[part_ids[part]]; p != nil && p.Degraded != nil {
+			degraded = append(degraded, part)
+		}
+	}
+	return degraded, nil
+}
+
+type DegradedError struct {
+	Part  string
+	State *CrashLoopPart
+}
+
+func (e *DegradedError) Error() string {
+	return fmt.Sprintf("part %q is degraded since %s after %d failures (last error: %s), reset it with conductor service reset-failed",
+		e.Part, e.State.Degraded.Local().Format(time.DateTime), len(e.State.Failures), e.State.LastError)
+}
+
+// Return a *DegradedError if the part is degraded, or another error if the
+// state cannot be read
+func checkDegraded(service *Service, part, part_id string) error {
+	state, err := ReadCrashLoop(service)
+	if err != nil {
+		return err
+	}
+
+	p := state.Parts[part_id]
+	if p != nil && p.Degraded != nil {
+		return &DegradedError{part, p}
+	}
+	return nil
+}
+
+// Wait for the backoff delay after the last failures of the part before a new
+// deployment is started
+func crashLoopBackoff(ctx context.Context, prefix string, service *Service, part, part_id string) error {
+	settings := service.CrashLoopSettings()
+
+	state, err := ReadCrashLoop(service)
+	if err != nil {
+		return err
+	}
+
+	failures := state.Parts[part_id].recentFailures(settings)
+	if len(failures) == 0 {
+		return nil
+	}
+
+	delay := time.Until(failures[len(failures)-1].Add(settings.BackoffDelay(len(failures))))
+	if delay <= 0 {
+		return nil
+	}
+
+	log.Printf("%s: part %q: %d recent failures, waiting %s before starting a deployment", prefix, part, len(failures), delay.Round(time.Second))
+
+	ctx1, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go utils.ExtendTimeout(ctx1, 60*time.Second)
+
+	// Other operations on the service can run during the wait
+	return lock.Released(lock.ServiceLockName(service.BasePath), func() error {
+		select {
+		case <-time.After(delay):
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+}
+
+// Return true if new deployments can be created for the part. With static
+// deployments, they are only created for explicit operations (reload, scale or
+// fresh deployments) or for a part id that was never deployed.
+func canCreateDeployment(prefix string, service *Service, part_id string, want_fresh bool) (bool, error) {
+	if !service.StaticDeployments || want_fresh || prefix == "restart" || prefix == "scale" {
+		return true, nil
+	}
+
+	deployed, err := history.PartDeployed(service, part_id)
+	return !deployed, err
+}
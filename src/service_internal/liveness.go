@@ -0,0 +1,147 @@
+package service_internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/mildred/conductor.go/src/caddy"
+	"github.com/mildred/conductor.go/src/deployment"
+	"github.com/mildred/conductor.go/src/deployment_util"
+	"github.com/mildred/conductor.go/src/dirs"
+	"github.com/mildred/conductor.go/src/utils"
+
+	. "github.com/mildred/conductor.go/src/service"
+)
+
+// Track the liveness of the service deployments across monitor iterations
+type livenessMonitor struct {
+	failures map[string]int
+}
+
+func newLivenessMonitor() *livenessMonitor {
+	return &livenessMonitor{
+		failures: map[string]int{},
+	}
+}
+
+// Return the delay between two monitor iterations, the liveness check interval
+// if it is shorter than the default delay
+func (m *livenessMonitor) Interval(service *Service, delay time.Duration) time.Duration {
+	for _, pod := range service.Pods {
+		if pod.LivenessCheck != nil && time.Duration(pod.LivenessCheck.Interval) < delay {
+			delay = time.Duration(pod.LivenessCheck.Interval)
+		}
+	}
+	return delay
+}
+
+// Probe the deployment and replace it if it failed too many consecutive times
+func (m *livenessMonitor) Check(ctx context.Context, service *Service, part string, depl *deployment.Deployment, opts StartOrReloadOpts) error {
+	if depl.Pod == nil || depl.Pod.LivenessCheck == nil {
+		return nil
+	}
+
+	check := depl.Pod.LivenessCheck
+	failures := m.failures[depl.DeploymentName]
+
+	err := depl.Pod.Probe(ctx, depl, check)
+	if err == nil {
+		if failures > 0 {
+			log.Printf("liveness: part %q: deployment %s recovered after %d failures", part, depl.DeploymentName, failures)
+		}
+		delete(m.failures, depl.DeploymentName)
+		return nil
+	}
+
+	failures += 1
+	m.failures[depl.DeploymentName] = failures
+	if failures == 1 {
+		log.Printf("liveness: part %q: deployment %s is failing (1/%d): %v", part, depl.DeploymentName, check.FailureThreshold, err)
+	} else {
+		log.Printf("liveness: part %q: deployment %s is still failing (%d/%d): %v", part, depl.DeploymentName, failures, check.FailureThreshold, err)
+	}
+
+	if failures < check.FailureThreshold {
+		return nil
+	}
+
+	log.Printf("liveness: part %q: deployment %s is dead, removing from load-balancer", part, depl.DeploymentName)
+	delete(m.failures, depl.DeploymentName)
+	recordFailure("liveness", service, part, depl.PartId, fmt.Errorf("deployment %s is dead: %v", depl.DeploymentName, err))
+
+	upstreams, err := depl.Pod.ProxyConfig(depl)
+	if err != nil {
+		return err
+	}
+
+	if len(upstreams) > 0 {
+		client, err := caddy.NewClient(depl.CaddyLoadBalancer.ApiEndpoint, time.Duration(depl.CaddyLoadBalancer.Timeout))
+		if err != nil {
+			return err
+		}
+
+		err = client.Register(ctx, false, upstreams)
+		if err != nil {
+			log.Printf("liveness: part %q: ERROR removing deployment %s from load-balancer (but continuing): %v", part, depl.DeploymentName, err)
+		}
+	}
+
+	if service.StaticDeployments {
+		var degraded *DegradedError
+		err = checkDegraded(service, part, depl.PartId)
+		if errors.As(err, &degraded) {
+			log.Printf("liveness: part %q: not restarting deployment %s: %v", part, depl.DeploymentName, err)
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		err = crashLoopBackoff(ctx, "liveness", service, part, depl.PartId)
+		if err != nil {
+			return err
+		}
+
+		log.Printf("liveness: part %q: static deployments, restarting deployment %s", part, depl.DeploymentName)
+		fmt.Fprintf(os.Stderr, "+ systemctl %s restart %q\n", dirs.SystemdModeFlag(), deployment.DeploymentUnit(depl.DeploymentName))
+		cmd := exec.Command("systemctl", dirs.SystemdModeFlag(), "restart", deployment.DeploymentUnit(depl.DeploymentName))
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		err = cmd.Run()
+		if err != nil {
+			recordFailure("liveness", service, part, depl.PartId, err)
+			log.Printf("liveness: part %q: ERROR restarting deployment %s (but continuing): %v", part, depl.DeploymentName, err)
+		}
+		return nil
+	}
+
+	log.Printf("liveness: part %q: replacing deployment %s", part, depl.DeploymentName)
+	new_depl, _, err := startPart(ctx, "liveness", service, part, deployment_util.StartNewOrExistingOpts{
+		MaxIndex:  opts.MaxDeploymentIndex,
+		WantFresh: true,
+	})
+	var degraded *DegradedError
+	if errors.As(err, &degraded) {
+		log.Printf("liveness: part %q: not replacing deployment %s: %v", part, depl.DeploymentName, err)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("while replacing dead deployment %s for part %q, %v", depl.DeploymentName, part, err)
+	}
+
+	log.Printf("liveness: part %q: deployment %s replaced by %s, removing it", part, depl.DeploymentName, new_depl.DeploymentName)
+
+	ctx1, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go utils.ExtendTimeout(ctx1, 60*time.Second)
+
+	err = deployment_util.RemoveTimeout(ctx1, depl.DeploymentName, opts.StopTimeout, opts.TermTimeout)
+	if err != nil {
+		log.Printf("liveness: part %q: ERROR removing deployment %s (but continuing): %v", part, depl.DeploymentName, err)
+	}
+
+	return nil
+}
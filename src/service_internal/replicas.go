@@ -0,0 +1,84 @@
+package service_internal
+
+import (
+	"context"
+	"log"
+	"sort"
+
+	"github.com/mildred/conductor.go/src/deployment"
+	"github.com/mildred/conductor.go/src/deployment_util"
+
+	. "github.com/mildred/conductor.go/src/service"
+)
+
+// Start or remove deployments of the part so that the number of deployments
+// matching the part id is the number of replicas of the part.
+func reconcileReplicas(ctx context.Context, prefix string, service *Service, part string, matching []*deployment.Deployment, opts StartOrReloadOpts) error {
+	replicas := service.PartReplicas(part)
+
+	var names []string
+	for _, depl := range matching {
+		names = append(names, depl.DeploymentName)
+	}
+	sort.Strings(names)
+
+	if len(names) > replicas {
+		log.Printf("%s: part %q: scaling down from %d to %d replicas", prefix, part, len(names), replicas)
+		removeDeployments(prefix, names[replicas:], opts)
+	}
+
+	if len(names) < replicas {
+		log.Printf("%s: part %q: scaling up from %d to %d replicas", prefix, part, len(names), replicas)
+		for i := len(names); i < replicas; i++ {
+			depl, _, err := startPart(ctx, prefix, service, part, deployment_util.StartNewOrExistingOpts{
+				MaxIndex: max(opts.MaxDeploymentIndex, 2*replicas+1),
+				Exclude:  names,
+			})
+			if err != nil {
+				return err
+			}
+			names = append(names, depl.DeploymentName)
+		}
+	}
+
+	return nil
+}
+
+// Reconcile the number of deployments for all the service parts
+func Reconcile(service_name string, opts StartOrReloadOpts) error {
+	ctx := context.Background()
+
+	l, err := LockServiceByName(service_name, "scale")
+	if err != nil {
+		return err
+	}
+	defer l.Unlock()
+
+	service, err := LoadServiceByName(service_name)
+	if err != nil {
+		return err
+	}
+
+	part_ids, err := service.PartIds(ctx)
+	if err != nil {
+		return err
+	}
+
+	for part, part_id := range part_ids {
+		matching, err := deployment_util.List(deployment_util.ListOpts{
+			FilterServiceDir: service.BasePath,
+			FilterPartName:   &part,
+			FilterPartId:     part_id,
+		})
+		if err != nil {
+			return err
+		}
+
+		err = reconcileReplicas(ctx, "scale", service, part, matching, opts)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,603 @@
+package service_internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/taigrr/systemctl"
+	"github.com/taigrr/systemctl/properties"
+
+	"github.com/mildred/conductor.go/src/caddy"
+	"github.com/mildred/conductor.go/src/deployment"
+	"github.com/mildred/conductor.go/src/deployment_util"
+	"github.com/mildred/conductor.go/src/dirs"
+	"github.com/mildred/conductor.go/src/utils"
+
+	. "github.com/mildred/conductor.go/src/service"
+)
+
+var RolloutReportDir = dirs.Join(dirs.SelfRuntimeDir, "rollouts")
+
+type RolloutReport struct {
+	Service             string         `json:"service"`
+	ServiceId           string         `json:"service_id"`
+	StartTime           time.Time      `json:"start_time"`
+	EndTime             time.Time      `json:"end_time"`
+	Success             bool           `json:"success"`
+	Error               string         `json:"error,omitempty"`
+	PreviousDeployments []string       `json:"previous_deployments"`
+	Parts               []*RolloutPart `json:"parts"`
+	RemovedDeployments  []string       `json:"removed_deployments,omitempty"`
+	KeptDeployments     []string       `json:"kept_deployments,omitempty"`
+}
+
+type RolloutPart struct {
+	Part       string `json:"part"`
+	Deployment string `json:"deployment,omitempty"`
+	Status     string `json:"status"` // reused, started, failed or rolled-back
+	Error      string `json:"error,omitempty"`
+}
+
+type RolloutError struct {
+	Report *RolloutReport
+	Err    error // Error of the part that failed to start, if any
+}
+
+func (e *RolloutError) Unwrap() error {
+	return e.Err
+}
+
+func (e *RolloutError) Error() string {
+	var lines []string
+	lines = append(lines, fmt.Sprintf("rollout of service %s failed and was rolled back: %s", e.Report.Service, e.Report.Error))
+	for _, part := range e.Report.Parts {
+		line := fmt.Sprintf("part %q: deployment %s %s", part.Part, part.Deployment, part.Status)
+		if part.Error != "" {
+			line += ": " + part.Error
+		}
+		lines = append(lines, line)
+	}
+	if len(e.Report.KeptDeployments) > 0 {
+		lines = append(lines, fmt.Sprintf("kept previous deployments: %s", strings.Join(e.Report.KeptDeployments, ", ")))
+	}
+	return strings.Join(lines, "\n  - ")
+}
+
+func RolloutReportPath(service *Service) string {
+	return path.Join(RolloutReportDir, ServiceUnit(service.BasePath)+".json")
+}
+
+// Read the report of the last rollout of the service
+func ReadRolloutReport(service *Service) (*RolloutReport, error) {
+	data, err := os.ReadFile(RolloutReportPath(service))
+	if err != nil {
+		return nil, err
+	}
+
+	var report RolloutReport
+	err = json.Unmarshal(data, &report)
+	return &report, err
+}
+
+func (report *RolloutReport) Save(service *Service) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(RolloutReportDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(RolloutReportPath(service), data, 0644)
+}
+
+// Start the deployments for all service parts and only when all of them are
+// started, remove the previous deployments. If any deployment fails to start,
+// stop the newly started deployments, mark them failed and keep the previous
+// deployments registered in the load-balancer.
+//
+// The returned error is a *RolloutError if the rollout was rolled back.
+func Rollout(ctx context.Context, prefix string, service *Service, opts StartOrReloadOpts) (*RolloutReport, error) {
+	report := &RolloutReport{
+		Service:   service.BasePath,
+		ServiceId: service.Id,
+		StartTime: time.Now(),
+	}
+
+	//
+	// Snapshot the previous deployment set
+	//
+
+	previous, err := deployment_util.List(deployment_util.ListOpts{
+		FilterServiceDir: service.BasePath,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, d := range previous {
+		report.PreviousDeployments = append(report.PreviousDeployments, d.DeploymentName)
+	}
+
+	//
+	// [recreate] Remove the previous deployments before starting the new ones
+	//
+
+	if service.RolloutStrategy() == RolloutRecreate {
+		part_ids, err := service.PartIds(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		var stale []string
+		var remaining []*deployment.Deployment
+		for _, d := range previous {
+			if opts.WantsFresh || part_ids[d.PartName] != d.PartId {
+				stale = append(stale, d.DeploymentName)
+			} else {
+				remaining = append(remaining, d)
+			}
+		}
+
+		log.Printf("%s: Recreate rollout, removing previous deployments %v", prefix, stale)
+		report.RemovedDeployments = removeDeployments(prefix, stale, opts)
+		previous = remaining
+	}
+
+	//
+	// Find or create a suitable deployment for each part and start it
+	//
+
+	parts, err := service.Parts()
+	if err != nil {
+		return nil, err
+	}
+
+	var depl_names []string
+	var new_deployments []*deployment.Deployment
+
+	for _, part_name := range parts {
+		replicas := service.PartReplicas(part_name)
+		for replica := 0; replica < replicas; replica++ {
+			depl, status, err := startPart(ctx, prefix, service, part_name, deployment_util.StartNewOrExistingOpts{
+				MaxIndex:  max(opts.MaxDeploymentIndex, 2*replicas+1),
+				WantFresh: opts.WantsFresh,
+				Exclude:   depl_names,
+			})
+
+			part := &RolloutPart{
+				Part:   part_name,
+				Status: status,
+			}
+			report.Parts = append(report.Parts, part)
+
+			if depl != nil {
+				part.Deployment = depl.DeploymentName
+				depl_names = append(depl_names, depl.DeploymentName)
+				if status != "reused" {
+					new_deployments = append(new_deployments, depl)
+				}
+			}
+
+			if err != nil {
+				part.Status = "failed"
+				part.Error = err.Error()
+				report.Error = fmt.Sprintf("part %q failed to start: %v", part_name, err)
+				rollback(ctx, prefix, service, report, previous, new_deployments)
+				return report, &RolloutError{report, err}
+			}
+		}
+	}
+
+	//
+	// Stop all deployments that are of older config version, unless the
+	// rollout is gradual in which case they are kept until promoted or aborted
+	//
+
+	var obsolete []string
+	for _, d := range previous {
+		if !slices.Contains(depl_names, d.DeploymentName) {
+			obsolete = append(obsolete, d.DeploymentName)
+		}
+	}
+
+	pending, err := ReadPendingRollout(service)
+	if err != nil {
+		log.Printf("%s: ERROR reading pending rollout (but continuing): %v", prefix, err)
+	}
+
+	if service.RolloutIsGradual() && len(obsolete) > 0 && (pending != nil || len(new_deployments) > 0) {
+		var kept, removed []string = obsolete, nil
+		if pending != nil {
+			// Keep the deployments previous to the pending rollout, remove the
+			// deployments of the pending rollout that are replaced
+			kept = nil
+			for _, name := range obsolete {
+				if slices.Contains(pending.PreviousDeployments, name) {
+					kept = append(kept, name)
+				} else {
+					removed = append(removed, name)
+				}
+			}
+		} else {
+			pending = &PendingRollout{
+				Strategy:            service.RolloutStrategy(),
+				StartTime:           time.Now(),
+				PreviousDeployments: kept,
+			}
+		}
+
+		pending.Weight = service.RolloutNewWeight()
+		pending.NewDeployments = depl_names
+
+		log.Printf("%s: %s rollout, keeping previous deployments %v", prefix, pending.Strategy, kept)
+		report.KeptDeployments = kept
+		report.RemovedDeployments = removeDeployments(prefix, removed, opts)
+
+		err = pending.Save(service)
+		if err != nil {
+			return report, err
+		}
+
+		log.Printf("%s: Sending %d%% of the traffic to %v", prefix, pending.Weight, pending.NewDeployments)
+		err = setRolloutWeights(ctx, pending.NewDeployments, pending.Weight)
+		if err != nil {
+			report.Error = fmt.Sprintf("failed to set traffic weights: %v", err)
+			rollback(ctx, prefix, service, report, previous, new_deployments)
+			os.Remove(PendingRolloutPath(service))
+			return report, &RolloutError{report, nil}
+		}
+	} else {
+		log.Printf("%s: Removing obsolete deployments (except %v)...\n", prefix, depl_names)
+		report.RemovedDeployments = append(report.RemovedDeployments, removeDeployments(prefix, obsolete, opts)...)
+
+		if pending != nil {
+			err = resetRolloutWeights(ctx, depl_names)
+			if err != nil {
+				log.Printf("%s: ERROR resetting traffic weights (but continuing): %v", prefix, err)
+			}
+			os.Remove(PendingRolloutPath(service))
+		}
+	}
+
+	report.Success = true
+	report.EndTime = time.Now()
+	err = report.Save(service)
+	if err != nil {
+		log.Printf("%s: ERROR saving rollout report (but continuing): %v", prefix, err)
+	}
+
+	return report, nil
+}
+
+func rollback(ctx context.Context, prefix string, service *Service, report *RolloutReport, previous, new_deployments []*deployment.Deployment) {
+	log.Printf("%s: Rolling back: %s", prefix, report.Error)
+
+	//
+	// Stop the new deployments and mark them failed
+	//
+
+	for _, depl := range new_deployments {
+		units := []string{
+			deployment.DeploymentUnit(depl.DeploymentName),
+			deployment.DeploymentConfigUnit(depl.DeploymentName),
+			deployment.CGIFunctionSocketUnit(depl.DeploymentName),
+		}
+		if depl.Pod != nil {
+			for _, socket := range depl.Pod.Sockets {
+				units = append(units, deployment.DeploymentPodSocketUnit(depl.DeploymentName, socket.Name))
+			}
+		}
+		stopServicesOrLog(prefix, depl, units)
+
+		err := depl.MarkFailed(report.Error)
+		if err != nil {
+			log.Printf("%s: ERROR marking deployment %s failed: %v", prefix, depl.DeploymentName, err)
+		}
+
+		for _, part := range report.Parts {
+			if part.Deployment == depl.DeploymentName && part.Status != "failed" {
+				part.Status = "rolled-back"
+			}
+		}
+	}
+
+	//
+	// Make sure the previous deployments that are still active are registered
+	// in the load-balancer, stopping the new deployments could have removed
+	// upstreams sharing the same identifier.
+	//
+
+	for _, depl := range previous {
+		if slices.ContainsFunc(new_deployments, func(d *deployment.Deployment) bool {
+			return d.DeploymentName == depl.DeploymentName
+		}) {
+			continue
+		}
+
+		state, err := systemctl.Show(ctx, deployment.DeploymentUnit(depl.DeploymentName), properties.ActiveState, systemctl.Options{UserMode: !dirs.AsRoot})
+		if err != nil || state != "active" {
+			continue
+		}
+
+		report.KeptDeployments = append(report.KeptDeployments, depl.DeploymentName)
+
+		log.Printf("%s: Registering previous deployment %s again...", prefix, depl.DeploymentName)
+		configs, err := depl.ProxyConfig(ctx)
+		if err != nil {
+			log.Printf("%s: ERROR generating proxy config for %s: %v", prefix, depl.DeploymentName, err)
+			continue
+		}
+
+		client, err := caddy.NewClient(depl.CaddyLoadBalancer.ApiEndpoint, time.Duration(depl.CaddyLoadBalancer.Timeout))
+		if err == nil {
+			err = client.Register(ctx, true, configs)
+		}
+		if err != nil {
+			log.Printf("%s: ERROR registering deployment %s: %v", prefix, depl.DeploymentName, err)
+		}
+	}
+
+	report.EndTime = time.Now()
+	err := report.Save(service)
+	if err != nil {
+		log.Printf("%s: ERROR saving rollout report: %v", prefix, err)
+	}
+}
+
+// State of a canary or blue-green rollout waiting to be promoted or aborted
+type PendingRollout struct {
+	Strategy            string    `json:"strategy"`
+	Weight              int       `json:"weight"`
+	StartTime           time.Time `json:"start_time"`
+	PreviousDeployments []string  `json:"previous_deployments"`
+	NewDeployments      []string  `json:"new_deployments"`
+}
+
+func PendingRolloutPath(service *Service) string {
+	return path.Join(RolloutReportDir, ServiceUnit(service.BasePath)+".pending.json")
+}
+
+// Read the pending rollout of the service, returns nil if there is none
+func ReadPendingRollout(service *Service) (*PendingRollout, error) {
+	data, err := os.ReadFile(PendingRolloutPath(service))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var pending PendingRollout
+	err = json.Unmarshal(data, &pending)
+	return &pending, err
+}
+
+func (pending *PendingRollout) Save(service *Service) error {
+	data, err := json.MarshalIndent(pending, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(RolloutReportDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(PendingRolloutPath(service), data, 0644)
+}
+
+// Set the traffic weights of the upstreams for the new deployments of a pending
+// rollout so that they get weight percent of the traffic in total, the previous
+// deployments get the remaining traffic. The weights of all the new deployments
+// sharing upstreams are set at once, else each replica would reset the weight
+// of the others.
+func setRolloutWeights(ctx context.Context, new_deployments []string, weight int) error {
+	type upstreams struct {
+		endpoint string
+		client   *caddy.CaddyClient
+		path     string
+		dials    []string
+	}
+
+	var all_upstreams []*upstreams
+	for _, name := range new_deployments {
+		depl, err := deployment.ReadDeploymentByName(name, false)
+		if err != nil {
+			return err
+		}
+
+		if depl.Pod == nil {
+			continue
+		}
+
+		proxies, err := depl.Pod.ReverseProxy(depl.Service)
+		if err != nil {
+			return err
+		}
+
+		client, err := caddy.NewClient(depl.CaddyLoadBalancer.ApiEndpoint, time.Duration(depl.CaddyLoadBalancer.Timeout))
+		if err != nil {
+			return err
+		}
+
+		for _, proxy := range proxies {
+			idx := slices.IndexFunc(all_upstreams, func(u *upstreams) bool {
+				return u.endpoint == depl.CaddyLoadBalancer.ApiEndpoint && u.path == proxy.UpstreamsPath
+			})
+			if idx == -1 {
+				idx = len(all_upstreams)
+				all_upstreams = append(all_upstreams, &upstreams{depl.CaddyLoadBalancer.ApiEndpoint, client, proxy.UpstreamsPath, nil})
+			}
+			all_upstreams[idx].dials = append(all_upstreams[idx].dials, depl.Pod.Dial(depl, proxy))
+		}
+	}
+
+	for _, u := range all_upstreams {
+		err := u.client.SetUpstreamWeights(ctx, u.path, u.dials, weight)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove the traffic weights set for a pending rollout
+func resetRolloutWeights(ctx context.Context, deployments []string) error {
+	for _, name := range deployments {
+		depl, err := deployment.ReadDeploymentByName(name, false)
+		if err != nil {
+			return err
+		}
+
+		if depl.Pod == nil {
+			continue
+		}
+
+		proxies, err := depl.Pod.ReverseProxy(depl.Service)
+		if err != nil {
+			return err
+		}
+
+		client, err := caddy.NewClient(depl.CaddyLoadBalancer.ApiEndpoint, time.Duration(depl.CaddyLoadBalancer.Timeout))
+		if err != nil {
+			return err
+		}
+
+		for _, proxy := range proxies {
+			err = client.ResetUpstreamWeights(ctx, proxy.UpstreamsPath)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func removeDeployments(prefix string, names []string, opts StartOrReloadOpts) []string {
+	var removed []string
+	for _, name := range names {
+		log.Printf("%s: Removing deployment %s...\n", prefix, name)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go utils.ExtendTimeout(ctx, 60*time.Second)
+
+		err := func() error {
+			defer cancel()
+			return deployment_util.RemoveTimeout(ctx, name, opts.StopTimeout, opts.TermTimeout)
+		}()
+		if err != nil {
+			log.Printf("%s: ERROR removing deployment %s (but continuing): %v", prefix, name, err)
+		} else {
+			removed = append(removed, name)
+		}
+	}
+	return removed
+}
+
+// Finish a canary or blue-green rollout: send all the traffic to the new
+// deployments and remove the previous ones
+func Promote(service_name string, opts StartOrReloadOpts) error {
+	ctx := context.Background()
+
+	l, err := LockServiceByName(service_name, "promote")
+	if err != nil {
+		return err
+	}
+	defer l.Unlock()
+
+	service, err := LoadServiceByName(service_name)
+	if err != nil {
+		return err
+	}
+
+	pending, err := ReadPendingRollout(service)
+	if err != nil {
+		return err
+	} else if pending == nil {
+		return fmt.Errorf("no rollout in progress for service %s", service.Name)
+	}
+
+	log.Printf("promote: Promoting deployments %v", pending.NewDeployments)
+	err = setRolloutWeights(ctx, pending.NewDeployments, 100)
+	if err != nil {
+		return err
+	}
+
+	removeDeployments("promote", pending.PreviousDeployments, opts)
+
+	err = resetRolloutWeights(ctx, pending.NewDeployments)
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(PendingRolloutPath(service))
+}
+
+// Revert a canary or blue-green rollout: send all the traffic to the previous
+// deployments and remove the new ones
+func Abort(service_name string, opts StartOrReloadOpts) error {
+	ctx := context.Background()
+
+	l, err := LockServiceByName(service_name, "abort")
+	if err != nil {
+		return err
+	}
+	defer l.Unlock()
+
+	service, err := LoadServiceByName(service_name)
+	if err != nil {
+		return err
+	}
+
+	pending, err := ReadPendingRollout(service)
+	if err != nil {
+		return err
+	} else if pending == nil {
+		return fmt.Errorf("no rollout in progress for service %s", service.Name)
+	}
+
+	log.Printf("abort: Aborting deployments %v", pending.NewDeployments)
+	err = setRolloutWeights(ctx, pending.NewDeployments, 0)
+	if err != nil {
+		return err
+	}
+
+	err = resetRolloutWeights(ctx, pending.PreviousDeployments)
+	if err != nil {
+		log.Printf("abort: ERROR resetting weights (but continuing): %v", err)
+	}
+
+	part_ids, err := service.PartIds(ctx)
+	if err != nil {
+		return err
+	}
+
+	var still_configured bool
+	for _, name := range pending.NewDeployments {
+		depl, err := deployment.ReadDeploymentByName(name, false)
+		if err == nil && part_ids[depl.PartName] == depl.PartId {
+			still_configured = true
+		}
+	}
+
+	removeDeployments("abort", pending.NewDeployments, opts)
+
+	err = os.Remove(PendingRolloutPath(service))
+	if err != nil {
+		return err
+	}
+
+	if still_configured {
+		log.Printf("abort: WARNING the service configuration still matches the aborted deployments, it will be deployed again unless it is reverted")
+	}
+	return nil
+}
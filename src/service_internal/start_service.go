@@ -2,11 +2,11 @@ package service_internal
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"os/exec"
-	"slices"
 	"strings"
 	"time"
 
@@ -48,6 +48,126 @@ func stopServicesOrLog(prefix string, depl *deployment.Deployment, units []strin
 	}
 }
 
+// Find or create a suitable deployment for the service part and start it.
+// Returns the deployment and "reused" if the deployment was already started or
+// "started" if it was started. On error, the failed deployment is returned if
+// it was created.
+func startPart(ctx context.Context, prefix string, service *Service, part_name string, opts deployment_util.StartNewOrExistingOpts) (*deployment.Deployment, string, error) {
+	var status = "started"
+	var started_services []string
+
+	log.Printf("%s: Loaded service, configure socket for part %q...\n", prefix, part_name)
+
+	seed, err := deployment.SeedFromService(ctx, service, part_name)
+	if err != nil {
+		return nil, "", err
+	}
+
+	//
+	// Degraded parts and static deployments only reuse existing deployments
+	//
+
+	can_create, err := canCreateDeployment(prefix, service, seed.PartId, opts.WantFresh)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var degraded *DegradedError
+	err = checkDegraded(service, part_name, seed.PartId)
+	if err != nil && !errors.As(err, &degraded) {
+		return nil, "", err
+	}
+	opts.NoCreate = !can_create || degraded != nil
+
+	depl, depl_status, err := deployment_util.StartNewOrExistingFromService(ctx, service, seed, opts)
+	if degraded != nil && (err != nil || (depl_status != "active" && depl_status != "activating")) {
+		return nil, "", degraded
+	} else if err != nil && !can_create {
+		return nil, "", fmt.Errorf("%v, static_deployments is set: reload the service to create deployments", err)
+	} else if err != nil {
+		return nil, "", err
+	}
+
+	//
+	// Wait before starting a deployment after recent failures
+	//
+
+	if depl_status != "active" && depl_status != "activating" {
+		err = crashLoopBackoff(ctx, prefix, service, part_name, seed.PartId)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	if seed.IsPod {
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go utils.ExtendTimeout(ctx, 60*time.Second)
+
+		err = func() error {
+			defer cancel()
+
+			if depl_status == "active" {
+				log.Printf("%s: Found started pod deployment %s", prefix, depl.DeploymentName)
+				status = "reused"
+			} else if depl_status == "activating" || depl_status == "inactive" {
+				log.Printf("%s: Found %s pod deployment %s, waiting to be started...", prefix, depl_status, depl.DeploymentName)
+				fmt.Fprintf(os.Stderr, "+ systemctl %s start %q\n", dirs.SystemdModeFlag(), deployment.DeploymentUnit(depl.DeploymentName))
+				cmd := exec.Command("systemctl", dirs.SystemdModeFlag(), "start", deployment.DeploymentUnit(depl.DeploymentName))
+				cmd.Stdout = os.Stdout
+				cmd.Stderr = os.Stderr
+				err = cmd.Run()
+				started_services = append(started_services, deployment.DeploymentUnit(depl.DeploymentName))
+				if err != nil {
+					return err
+				}
+			} else {
+				log.Printf("%s: Starting new pod deployment %s...", prefix, depl.DeploymentName)
+				fmt.Fprintf(os.Stderr, "+ systemctl %s start %q\n", dirs.SystemdModeFlag(), deployment.DeploymentUnit(depl.DeploymentName))
+				cmd := exec.Command("systemctl", dirs.SystemdModeFlag(), "start", deployment.DeploymentUnit(depl.DeploymentName))
+				cmd.Stdout = os.Stdout
+				cmd.Stderr = os.Stderr
+				err = cmd.Run()
+				started_services = append(started_services, deployment.DeploymentUnit(depl.DeploymentName))
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		}()
+		if err != nil {
+			stopServicesOrLog(prefix, depl, started_services)
+			recordFailure(prefix, service, part_name, seed.PartId, err)
+			return depl, "failed", err
+		}
+
+	} else if seed.IsFunction {
+
+		unit := deployment.CGIFunctionSocketUnit(depl.DeploymentName)
+		if depl.Function.IsManaged() {
+			log.Printf("%s: Starting new managed function deployment %s...", prefix, depl.DeploymentName)
+			unit = deployment.DeploymentUnit(depl.DeploymentName)
+		} else {
+			log.Printf("%s: Starting new CGI function deployment %s...", prefix, depl.DeploymentName)
+		}
+		fmt.Fprintf(os.Stderr, "+ systemctl %s start %q\n", dirs.SystemdModeFlag(), unit)
+		cmd := exec.Command("systemctl", dirs.SystemdModeFlag(), "start", unit)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		err = cmd.Run()
+		started_services = append(started_services, unit)
+		if err != nil {
+			stopServicesOrLog(prefix, depl, started_services)
+			recordFailure(prefix, service, part_name, seed.PartId, err)
+			return depl, "failed", err
+		}
+
+	}
+
+	return depl, status, nil
+}
+
 func StartOrReload(service_name string, opts StartOrReloadOpts) error {
 	if opts.MaxDeploymentIndex == 0 {
 		opts.MaxDeploymentIndex = 10
@@ -93,153 +213,47 @@ func StartOrReload(service_name string, opts StartOrReloadOpts) error {
 	defer deferred()
 
 	//
-	// Fetch service config
+	// Lock the service during the start sequence
 	//
 
-	service, err := LoadServiceByName(service_name)
+	l, err := LockServiceByName(service_name, prefix)
 	if err != nil {
 		return err
 	}
+	defer func() { l.Unlock() }()
 
 	//
-	// Run pre-start-service hook
+	// Fetch service config
 	//
 
-	err = service.RunHooks(ctx, "pre-start-service", "", service.Vars(), 60*time.Second)
+	service, err := LoadServiceByName(service_name)
 	if err != nil {
 		return err
 	}
 
 	//
-	// Find or create a suitable deployment
+	// Run pre-start-service hook
 	//
 
-	var started_services []string
-
-	parts, err := service.Parts()
+	err = service.RunHooks(ctx, "pre-start-service", "", service.Vars(), 60*time.Second)
 	if err != nil {
 		return err
 	}
 
-	var depl_names []string
-
-	for _, part_name := range parts {
-
-		log.Printf("%s: Loaded service, configure socket for part %q...\n", prefix, part_name)
-
-		seed, err := deployment.SeedFromService(ctx, service, part_name)
-		if err != nil {
-			return err
-		}
-
-		depl, depl_status, err := deployment_util.StartNewOrExistingFromService(ctx, service, seed, deployment_util.StartNewOrExistingOpts{
-			MaxIndex:  opts.MaxDeploymentIndex,
-			WantFresh: opts.WantsFresh,
-		})
-		if err != nil {
-			return err
-		}
-
-		depl_names = append(depl_names, depl.DeploymentName)
-
-		if seed.IsPod {
-
-			ctx, cancel := context.WithCancel(context.Background())
-			go utils.ExtendTimeout(ctx, 60*time.Second)
-
-			err = func() error {
-				defer cancel()
-
-				if depl_status == "active" {
-					log.Printf("%s: Found started pod deployment %s", prefix, depl.DeploymentName)
-				} else if depl_status == "activating" || depl_status == "inactive" {
-					log.Printf("%s: Found %s pod deployment %s, waiting to be started...", prefix, depl_status, depl.DeploymentName)
-					fmt.Fprintf(os.Stderr, "+ systemctl %s start %q\n", dirs.SystemdModeFlag(), deployment.DeploymentUnit(depl.DeploymentName))
-					cmd := exec.Command("systemctl", dirs.SystemdModeFlag(), "start", deployment.DeploymentUnit(depl.DeploymentName))
-					cmd.Stdout = os.Stdout
-					cmd.Stderr = os.Stderr
-					err = cmd.Run()
-					started_services = append(started_services, deployment.DeploymentUnit(depl.DeploymentName))
-					if err != nil {
-						return err
-					}
-				} else {
-					log.Printf("%s: Starting new pod deployment %s...", prefix, depl.DeploymentName)
-					fmt.Fprintf(os.Stderr, "+ systemctl %s start %q\n", dirs.SystemdModeFlag(), deployment.DeploymentUnit(depl.DeploymentName))
-					cmd := exec.Command("systemctl", dirs.SystemdModeFlag(), "start", deployment.DeploymentUnit(depl.DeploymentName))
-					cmd.Stdout = os.Stdout
-					cmd.Stderr = os.Stderr
-					err = cmd.Run()
-					started_services = append(started_services, deployment.DeploymentUnit(depl.DeploymentName))
-					if err != nil {
-						return err
-					}
-				}
-
-				return nil
-			}()
-			if err != nil {
-				stopServicesOrLog(prefix, depl, started_services)
-				started_services = nil
-				return err
-			}
-
-		} else if seed.IsFunction {
-
-			log.Printf("%s: Starting new CGI function deployment %s...", prefix, depl.DeploymentName)
-			fmt.Fprintf(os.Stderr, "+ systemctl %s start %q\n", dirs.SystemdModeFlag(), deployment.CGIFunctionSocketUnit(depl.DeploymentName))
-			cmd := exec.Command("systemctl", dirs.SystemdModeFlag(), "start", deployment.CGIFunctionSocketUnit(depl.DeploymentName))
-			cmd.Stdout = os.Stdout
-			cmd.Stderr = os.Stderr
-			err = cmd.Run()
-			started_services = append(started_services, deployment.CGIFunctionSocketUnit(depl.DeploymentName))
-			if err != nil {
-				stopServicesOrLog(prefix, depl, started_services)
-				started_services = nil
-				return err
-			}
-
-		}
-
-	}
-
 	//
-	// TODO [ if restarting ] if failing to start, exit uncleanly
-	// TODO [ if starting ] if failing, stop all deployments and exit uncleanly
+	// Start new deployments and remove the obsolete ones, or rollback
 	//
 
-	//
-	// Stop all deployments that are of older config version
-	//
-
-	log.Printf("%s: Removing obsolete deployments (except %v)...\n", prefix, depl_names)
-
-	deployments, err := deployment_util.List(deployment_util.ListOpts{
-		FilterServiceDir: service.BasePath,
-	})
-	if err != nil {
+	_, err = Rollout(ctx, prefix, service, opts)
+	var degraded *DegradedError
+	if errors.As(err, &degraded) && !opts.Restart {
+		// Keep the service running, degraded, instead of restarting it
+		log.Printf("%s: Service is degraded: %v", prefix, err)
+		err = nil
+	} else if err != nil {
 		return err
 	}
 
-	for _, d := range deployments {
-		if slices.Contains(depl_names, d.DeploymentName) {
-			continue
-		}
-
-		log.Printf("%s: Removing deployment %s...\n", prefix, d.DeploymentName)
-
-		ctx, cancel := context.WithCancel(context.Background())
-		go utils.ExtendTimeout(ctx, 60*time.Second)
-
-		err = func() error {
-			defer cancel()
-			return deployment_util.RemoveTimeout(ctx, d.DeploymentName, opts.StopTimeout, opts.TermTimeout)
-		}()
-		if err != nil {
-			log.Printf("%s: ERROR removing deployment %s (but continuing): %v", prefix, d.DeploymentName, err)
-		}
-	}
-
 	//
 	// Run post-start-service hook
 	//
@@ -279,66 +293,111 @@ func StartOrReload(service_name string, opts StartOrReloadOpts) error {
 	}
 
 	log.Printf("start: Start sequence completed, start to monitor deployments\n")
+	l.Unlock()
+	l = nil
 
 	//
 	// Keep running in the background, and monitor the deployments
-	// (exit with an error if a deployment is missing)
+	// (exit with an error if a deployment is missing) and their liveness
 	//
 
+	liveness := newLivenessMonitor()
+
 	for {
-		// Reload service in case it changes its id
-		service, err = LoadServiceByName(service_name)
+		l, err := LockServiceByName(service_name, "monitor")
 		if err != nil {
 			return err
 		}
 
-		part_ids, err := service.PartIds(ctx)
+		service, err = monitorDeployments(ctx, prefix, service_name, liveness, opts)
+		l.Unlock()
 		if err != nil {
 			return err
 		}
 
-		var diagnostics []string
-		all_parts_ok := true
+		time.Sleep(liveness.Interval(service, 30*time.Second))
+	}
+}
 
-		for part, part_id := range part_ids {
-			deployments, err := deployment_util.List(deployment_util.ListOpts{
-				FilterServiceDir: service.BasePath,
-				FilterPartName:   &part,
-			})
-			if err != nil {
-				return err
-			}
+func monitorDeployments(ctx context.Context, prefix, service_name string, liveness *livenessMonitor, opts StartOrReloadOpts) (*Service, error) {
+	// Reload service in case it changes its id
+	service, err := LoadServiceByName(service_name)
+	if err != nil {
+		return nil, err
+	}
 
-			if len(deployments) == 0 {
-				diagnostics = append(diagnostics, fmt.Sprintf("part %q: no deployment found", part))
-				all_parts_ok = false
-				continue
-			}
+	part_ids, err := service.PartIds(ctx)
+	if err != nil {
+		return nil, err
+	}
 
-			part_found := false
-			for _, depl := range deployments {
-				if depl.PartId != part_id {
-					diagnostics = append(diagnostics, fmt.Sprintf("part %q: deployment %s id %q (service %q) is invalid", part, depl.DeploymentName, depl.PartId, depl.ServiceId))
-				} else {
-					diagnostics = append(diagnostics, fmt.Sprintf("part %q: deployment %s matches", part, depl.DeploymentName))
-					part_found = true
-				}
-			}
-			if !part_found {
-				all_parts_ok = false
+	var diagnostics []string
+	all_parts_ok := true
+
+	for part, part_id := range part_ids {
+		var degraded *DegradedError
+		if err := checkDegraded(service, part, part_id); errors.As(err, &degraded) {
+			diagnostics = append(diagnostics, err.Error())
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		deployments, err := deployment_util.List(deployment_util.ListOpts{
+			FilterServiceDir: service.BasePath,
+			FilterPartName:   &part,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if len(deployments) == 0 {
+			diagnostics = append(diagnostics, fmt.Sprintf("part %q: no deployment found", part))
+			all_parts_ok = false
+			continue
+		}
+
+		var matching []*deployment.Deployment
+		for _, depl := range deployments {
+			if depl.PartId != part_id {
+				diagnostics = append(diagnostics, fmt.Sprintf("part %q: deployment %s id %q (service %q) is invalid", part, depl.DeploymentName, depl.PartId, depl.ServiceId))
+			} else {
+				diagnostics = append(diagnostics, fmt.Sprintf("part %q: deployment %s matches", part, depl.DeploymentName))
+				matching = append(matching, depl)
 			}
 		}
+		if len(matching) == 0 {
+			all_parts_ok = false
+			continue
+		}
+
+		matching = removeFailedDeployments(ctx, "monitor", service, part, part_id, matching, opts)
 
-		if !all_parts_ok {
-			for part_name, part_id := range part_ids {
-				diagnostics = append([]string{fmt.Sprintf("service part %q has id %q", part_name, part_id)}, diagnostics...)
+		err = reconcileReplicas(ctx, "monitor", service, part, matching, opts)
+		if errors.As(err, &degraded) {
+			log.Printf("monitor: %v", err)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		for _, depl := range matching {
+			err = liveness.Check(ctx, service, part, depl, opts)
+			if err != nil {
+				return nil, err
 			}
-			return fmt.Errorf("deployment has gone missing for service %q or service configuration changed during %s:\n  - service id: %q\n  - %s",
-				service_name, prefix, service.Id, strings.Join(diagnostics, "\n  - "))
 		}
+	}
 
-		time.Sleep(30 * time.Second)
+	if !all_parts_ok {
+		for part_name, part_id := range part_ids {
+			diagnostics = append([]string{fmt.Sprintf("service part %q has id %q", part_name, part_id)}, diagnostics...)
+		}
+		return nil, fmt.Errorf("deployment has gone missing for service %q or service configuration changed during %s:\n  - service id: %q\n  - %s",
+			service_name, prefix, service.Id, strings.Join(diagnostics, "\n  - "))
 	}
+
+	return service, nil
 }
 
 var LookupPaths []string = dirs.MultiJoin("services", append(append([]string{dirs.SelfRuntimeDir}, dirs.SelfConfigDirs...), dirs.SelfDataDirs...)...)
@@ -372,6 +431,17 @@ func CaddyRegister(ctx context.Context, register bool, service_name string) erro
 		log.Printf("deregister: Deregistering service...")
 	}
 
+	if register && service.Commands.HasHTTP() {
+		fmt.Fprintf(os.Stderr, "+ systemctl %s start %q\n", dirs.SystemdModeFlag(), CommandAPIUnit)
+		cmd := exec.Command("systemctl", dirs.SystemdModeFlag(), "start", CommandAPIUnit)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		err = cmd.Run()
+		if err != nil {
+			return fmt.Errorf("while starting the API server socket, %v", err)
+		}
+	}
+
 	err = caddy.Register(ctx, register, configs)
 	if err != nil {
 		return err
@@ -387,5 +457,5 @@ func Template(ctx context.Context, service_name string, template string) error {
 		return err
 	}
 
-	return tmpl.RunTemplateStdout(ctx, template, service.Vars())
+	return tmpl.RunTemplateStdout(ctx, template, service.Vars(), service.TemplateOptions())
 }
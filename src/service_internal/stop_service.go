@@ -30,6 +30,16 @@ func Stop(service_name string) error {
 		return err
 	}
 
+	//
+	// Lock the service during the stop sequence
+	//
+
+	l, err := LockServiceByName(service_name, "stop")
+	if err != nil {
+		return err
+	}
+	defer l.Unlock()
+
 	//
 	// Fetch service config
 	//
@@ -0,0 +1,169 @@
+package service_public
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rodaine/table"
+
+	"github.com/mildred/conductor.go/src/audit"
+	"github.com/mildred/conductor.go/src/utils"
+
+	. "github.com/mildred/conductor.go/src/service"
+)
+
+// Return the config value as recorded in the audit log, secrets are masked
+func auditConfigValue(serv *Service, key string) json.RawMessage {
+	if serv == nil {
+		return nil
+	}
+
+	v, ok := serv.Config[key]
+	if !ok || v == nil || v.Kind == ConfigValueNull {
+		return nil
+	} else if v.Kind == ConfigValueSecret {
+		return audit.Value(SecretMask)
+	} else if v.Kind == ConfigValueTrue || v.Kind == ConfigValueFalse {
+		return audit.Value(v.Kind == ConfigValueTrue)
+	}
+	return audit.Value(serv.RawConfigValue(key))
+}
+
+// Return a comparable form of the config value, secret references included
+func configValueRef(serv *Service, key string) string {
+	v, ok := serv.Config[key]
+	if !ok {
+		return ""
+	} else if v != nil && v.Kind == ConfigValueSecret {
+		data, _ := json.Marshal(v)
+		return string(data)
+	}
+	return string(auditConfigValue(serv, key))
+}
+
+func recordAudit(entry *audit.Entry) {
+	err := audit.Record(entry)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: while writing audit log, %v\n", err)
+	}
+}
+
+// Record a change of the service configuration in the audit log. before and
+// after are the service loaded before and after the change, after is nil if
+// it could not be loaded. Without keys, the config variables that differ are
+// recorded.
+func AuditConfig(action string, before, after *Service, filename string, keys []string) {
+	var entry = &audit.Entry{
+		Action:     action,
+		Service:    before.Name,
+		ServiceDir: before.BasePath,
+		File:       filename,
+	}
+
+	if keys == nil && after != nil {
+		for _, k := range utils.SortedStringKeys(before.Config) {
+			if configValueRef(before, k) != configValueRef(after, k) {
+				keys = append(keys, k)
+			}
+		}
+		for _, k := range utils.SortedStringKeys(after.Config) {
+			if _, ok := before.Config[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+	}
+
+	for _, k := range keys {
+		entry.Changes = append(entry.Changes, &audit.Change{
+			Key: "config." + k,
+			Old: auditConfigValue(before, k),
+			New: auditConfigValue(after, k),
+		})
+	}
+
+	if after != nil {
+		entry.ServiceId = after.Id
+	}
+
+	recordAudit(entry)
+}
+
+// Record the change of a service setting in the audit log
+func auditServiceChange(action string, before *Service, filename, key string, old, new interface{}) {
+	var entry = &audit.Entry{
+		Action:     action,
+		Service:    before.Name,
+		ServiceDir: before.BasePath,
+		File:       filename,
+		Changes:    []*audit.Change{{Key: key, Old: audit.Value(old), New: audit.Value(new)}},
+	}
+
+	if after, err := LoadServiceDir(before.BasePath); err == nil {
+		entry.ServiceId = after.Id
+	}
+
+	recordAudit(entry)
+}
+
+type AuditLogOpts struct {
+	Service   string
+	PrintJson bool
+}
+
+func PrintAuditLog(opts AuditLogOpts) error {
+	entries, err := audit.Read()
+	if err != nil {
+		return err
+	}
+
+	if opts.Service != "" {
+		dir, err := ServiceDirByName(opts.Service)
+		if err != nil {
+			dir = ""
+		}
+
+		entries = slices.DeleteFunc(entries, func(e *audit.Entry) bool {
+			return !(e.Service == opts.Service || (dir != "" && e.ServiceDir == dir))
+		})
+	}
+
+	if opts.PrintJson {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if entries == nil {
+			entries = []*audit.Entry{}
+		}
+		return enc.Encode(entries)
+	}
+
+	tbl := table.New("TIME", "USER", "ACTION", "TARGET", "CHANGES", "SERVICE ID").WithPrintHeaders(true)
+	for _, e := range entries {
+		target := e.Service
+		if target == "" {
+			target = e.ServiceDir
+		}
+		if e.Policy != "" {
+			target = "policy " + e.Policy
+		}
+
+		var changes []string
+		for _, c := range e.Changes {
+			changes = append(changes, c.String())
+		}
+
+		tbl.AddRow(
+			e.Time.Local().Format(time.DateTime),
+			e.Who(),
+			e.Action,
+			target,
+			strings.Join(changes, ", "),
+			e.ServiceId)
+	}
+	tbl.Print()
+
+	return nil
+}
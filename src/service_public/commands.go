@@ -58,54 +58,64 @@ func RunServiceCommand(service *Service, direct bool, strictVersion bool, env []
 
 	if !command.Service && command.ServiceAnyDeployment {
 		// Run a deployment instead
+		depl, err := FindActiveDeployment(service, strictVersion)
+		if err != nil {
+			return err
+		}
 
-		var deployments []*deployment.Deployment
-		var statuses []dbus.UnitStatus
+		return RunCommand(command, depl.Service, direct, deployment.DeploymentDirByNameOnly(depl.DeploymentName), append(depl.Vars(), env...), cmd_name, args...)
+	}
 
-		var filterServiceIds = []string{service.Id}
-		if !strictVersion {
-			filterServiceIds = append(filterServiceIds, "")
-		}
+	err := RunCommand(command, service, direct, service.BasePath, append(service.Vars(), env...), cmd_name, args...)
+	return err
+}
 
-		for _, filterServiceId := range filterServiceIds {
-			var err error
-			deployments, err = deployment_util.List(deployment_util.ListOpts{
-				FilterServiceId:  filterServiceId,
-				FilterServiceDir: service.BasePath,
-			})
-			if err != nil {
-				return err
-			}
+// Find an active deployment of the service, with the same service id if
+// strictVersion is set
+func FindActiveDeployment(service *Service, strictVersion bool) (*deployment.Deployment, error) {
+	var deployments []*deployment.Deployment
+	var statuses []dbus.UnitStatus
 
-			statuses, err = deployment_util.ListUnitStatus(context.Background(), deployments, false)
-			if err != nil {
-				return err
-			}
+	var filterServiceIds = []string{service.Id}
+	if !strictVersion {
+		filterServiceIds = append(filterServiceIds, "")
+	}
 
-			for i, depl := range deployments {
-				st := statuses[i]
-				if st.ActiveState == "active" {
-					return RunCommand(command, direct, deployment.DeploymentDirByNameOnly(depl.DeploymentName), append(depl.Vars(), env...), cmd_name, args...)
-				}
-			}
+	for _, filterServiceId := range filterServiceIds {
+		var err error
+		deployments, err = deployment_util.List(deployment_util.ListOpts{
+			FilterServiceId:  filterServiceId,
+			FilterServiceDir: service.BasePath,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		statuses, err = deployment_util.ListUnitStatus(context.Background(), deployments, false)
+		if err != nil {
+			return nil, err
 		}
 
-		var inactive_deployments []string
 		for i, depl := range deployments {
 			st := statuses[i]
 			if st.ActiveState == "active" {
-				continue
+				return depl, nil
 			}
-			inactive_deployments = append(inactive_deployments, fmt.Sprintf("%s is %s", depl.DeploymentName, st.ActiveState))
 		}
+	}
 
-		if len(deployments) == 0 {
-			return fmt.Errorf("Could not find an active deployment to run the command: there is no deployment found for service %s with id %s.", service.BasePath, service.Id)
-		} else {
-			return fmt.Errorf("Could not find an active deployment to run the command: %s", strings.Join(inactive_deployments, ", "))
+	var inactive_deployments []string
+	for i, depl := range deployments {
+		st := statuses[i]
+		if st.ActiveState == "active" {
+			continue
 		}
+		inactive_deployments = append(inactive_deployments, fmt.Sprintf("%s is %s", depl.DeploymentName, st.ActiveState))
 	}
 
-	err := RunCommand(command, direct, service.BasePath, append(service.Vars(), env...), cmd_name, args...)
-	return err
+	if len(deployments) == 0 {
+		return nil, fmt.Errorf("Could not find an active deployment to run the command: there is no deployment found for service %s with id %s.", service.BasePath, service.Id)
+	} else {
+		return nil, fmt.Errorf("Could not find an active deployment to run the command: %s", strings.Join(inactive_deployments, ", "))
+	}
 }
@@ -0,0 +1,121 @@
+package service_public
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/tailscale/hujson"
+	"github.com/yookoala/realpath"
+
+	. "github.com/mildred/conductor.go/src/service"
+)
+
+func editor() string {
+	for _, name := range []string{"VISUAL", "EDITOR"} {
+		if editor := os.Getenv(name); editor != "" {
+			return editor
+		}
+	}
+	return "vi"
+}
+
+// Open the file in the editor and save it if the service still validates.
+// Returns false if the file was not changed.
+func ServiceEditConfig(ctx context.Context, service_file, filename string) (bool, error) {
+	orig, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		orig = []byte("{\n}\n")
+	} else if err != nil {
+		return false, err
+	}
+
+	mode := os.ModePerm - 0o111
+	if st, err := os.Stat(filename); err == nil {
+		mode = st.Mode().Perm()
+	}
+
+	tmp, err := os.CreateTemp("", "conductor-*"+filepath.Ext(filename))
+	if err != nil {
+		return false, err
+	}
+	tmp_name := tmp.Name()
+	_, err = tmp.Write(orig)
+	tmp.Close()
+	if err != nil {
+		os.Remove(tmp_name)
+		return false, err
+	}
+
+	// The editor command can contain arguments
+	fmt.Fprintf(os.Stderr, "+ %s %s\n", editor(), tmp_name)
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", editor()+` "$1"`, "editor", tmp_name)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if err != nil {
+		os.Remove(tmp_name)
+		return false, fmt.Errorf("while running editor, %v", err)
+	}
+
+	edited, err := os.ReadFile(tmp_name)
+	if err != nil {
+		return false, err
+	} else if bytes.Equal(edited, orig) {
+		os.Remove(tmp_name)
+		return false, nil
+	}
+
+	var problems []*ValidationProblem
+	if _, err := hujson.Parse(edited); err != nil {
+		problems = append(problems, &ValidationProblem{File: filename, Message: err.Error()})
+	} else {
+		problems, err = ValidateEdited(ctx, service_file, filename, edited)
+		if err == nil && len(problems) == 0 {
+			err = replaceFile(filename, edited, mode)
+			if err != nil {
+				return false, fmt.Errorf("while writing %s, %v (the edited file is kept in %s)", filename, err, tmp_name)
+			}
+			os.Remove(tmp_name)
+			return true, nil
+		} else if err != nil {
+			problems = append(problems, &ValidationProblem{File: service_file, Message: err.Error()})
+		}
+	}
+
+	for _, p := range problems {
+		fmt.Println(p.String())
+	}
+	return false, fmt.Errorf("validation failed, %s is unchanged and the edited file is kept in %s", filename, tmp_name)
+}
+
+// Write the file next to the target and rename it over the target so that the
+// target is never partially written
+func replaceFile(filename string, data []byte, mode os.FileMode) error {
+	if real, err := realpath.Realpath(filename); err == nil {
+		filename = real
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(mode)
+	}
+	if e := tmp.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filename)
+}
@@ -0,0 +1,308 @@
+package service_public
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/tailscale/hujson"
+)
+
+// The files written by config set, enable, disable and scale are modified in
+// place through the hujson syntax tree so that comments, key order and
+// formatting are kept. New members are indented like their siblings.
+
+type configSetFile struct {
+	filename string
+	root     hujson.Value
+	mode     os.FileMode
+	unit     string // Indentation unit
+}
+
+// A value of the file with the indentation of the line it starts on
+type configNode struct {
+	value  *hujson.Value
+	indent string
+}
+
+// Return the indentation of the last line of extra, and if extra contains a
+// line break
+func lineIndent(extra hujson.Extra) (string, bool) {
+	i := bytes.LastIndexByte(extra, '\n')
+	if i == -1 {
+		return "", false
+	}
+	rest := extra[i+1:]
+	n := 0
+	for n < len(rest) && (rest[n] == ' ' || rest[n] == '\t') {
+		n++
+	}
+	return string(rest[:n]), true
+}
+
+func hasComment(extra hujson.Extra) bool {
+	return len(bytes.TrimSpace(extra)) > 0
+}
+
+func readConfigSetFile(filename string) (*configSetFile, error) {
+	var f = &configSetFile{filename: filename, mode: os.ModePerm - 0o111, unit: "  "}
+
+	data, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		data = []byte("{}\n")
+	} else if err != nil {
+		return nil, err
+	} else if st, err := os.Stat(filename); err == nil {
+		f.mode = st.Mode().Perm()
+	}
+
+	f.root, err = hujson.Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("while parsing %s, %v", filename, err)
+	}
+
+	obj, ok := f.root.Value.(*hujson.Object)
+	if !ok {
+		return nil, fmt.Errorf("%s does not contain a JSON object", filename)
+	}
+
+	if len(obj.Members) > 0 {
+		if indent, ok := lineIndent(obj.Members[0].Name.BeforeExtra); ok && indent != "" {
+			f.unit = indent
+		}
+	}
+
+	return f, nil
+}
+
+func (f *configSetFile) write() error {
+	data := f.root.Pack()
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		data = append(data, '\n')
+	}
+	return os.WriteFile(f.filename, data, f.mode)
+}
+
+func (f *configSetFile) rootNode() configNode {
+	return configNode{&f.root, ""}
+}
+
+// Return the indentation of a child of the node
+func (f *configSetFile) childIndent(node configNode, before hujson.Extra) string {
+	if indent, ok := lineIndent(before); ok {
+		return indent
+	}
+	return node.indent + f.unit
+}
+
+// Return the extra to put before a new item appended to the node, and update
+// the extra before the closing brace or bracket
+func (f *configSetFile) appendExtra(node configNode, last *hujson.Value, after *hujson.Extra) hujson.Extra {
+	if last == nil {
+		var before hujson.Extra
+		if hasComment(*after) {
+			before = append(bytes.TrimRight(*after, " \t\n"), '\n')
+		} else {
+			before = hujson.Extra("\n")
+		}
+		*after = hujson.Extra("\n" + node.indent)
+		return append(before, node.indent+f.unit...)
+	}
+
+	indent, multiline := lineIndent(last.BeforeExtra)
+	if !multiline && len(last.BeforeExtra) == 0 {
+		return hujson.Extra(" ")
+	} else if !multiline {
+		return slices.Clone(last.BeforeExtra)
+	}
+
+	// Comments on the line of the last item stay on that line
+	var before hujson.Extra
+	if i := bytes.IndexByte(*after, '\n'); i != -1 {
+		before = slices.Clone((*after)[:i])
+		*after = (*after)[i:]
+	} else {
+		before = bytes.TrimRight(*after, " \t")
+		*after = hujson.Extra("\n" + node.indent)
+	}
+	return append(append(before, '\n'), indent...)
+}
+
+func parseValue(value interface{}) (hujson.Value, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return hujson.Value{}, err
+	}
+	return hujson.Parse(data)
+}
+
+// Return the object member, or nil if it does not exist
+func (f *configSetFile) member(node configNode, name string) (*configNode, error) {
+	obj, ok := node.value.Value.(*hujson.Object)
+	if !ok {
+		return nil, fmt.Errorf("%s: expected a JSON object", f.filename)
+	}
+
+	for i := range obj.Members {
+		m := &obj.Members[i]
+		if key, ok := m.Name.Value.(hujson.Literal); ok && key.String() == name {
+			return &configNode{&m.Value, f.childIndent(node, m.Name.BeforeExtra)}, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// Set the object member to the value, existing members keep their position
+// and comments
+func (f *configSetFile) set(node configNode, name string, value interface{}) (*configNode, error) {
+	v, err := parseValue(value)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := f.member(node, name)
+	if err != nil {
+		return nil, err
+	} else if m != nil {
+		m.value.Value = v.Value
+		return m, nil
+	}
+
+	obj := node.value.Value.(*hujson.Object)
+	var last *hujson.Value
+	var after hujson.Extra
+	if len(obj.Members) > 0 {
+		last = &obj.Members[len(obj.Members)-1].Name
+		after = obj.Members[len(obj.Members)-1].Value.AfterExtra
+	}
+
+	v.BeforeExtra = hujson.Extra(" ")
+	if last != nil {
+		v.AfterExtra = after
+		if prev := obj.Members[len(obj.Members)-1].Value.BeforeExtra; !hasComment(prev) {
+			v.BeforeExtra = slices.Clone(prev)
+		}
+	}
+
+	var member = hujson.ObjectMember{
+		Name:  hujson.Value{Value: hujson.String(name)},
+		Value: v,
+	}
+	member.Name.BeforeExtra = f.appendExtra(node, last, &obj.AfterExtra)
+	obj.Members = append(obj.Members, member)
+
+	added := &obj.Members[len(obj.Members)-1]
+	return &configNode{&added.Value, f.childIndent(node, added.Name.BeforeExtra)}, nil
+}
+
+// Return the object member, it is created empty if it does not exist
+func (f *configSetFile) object(node configNode, name string) (configNode, error) {
+	m, err := f.member(node, name)
+	if err != nil {
+		return configNode{}, err
+	} else if m == nil {
+		m, err = f.set(node, name, map[string]interface{}{})
+		if err != nil {
+			return configNode{}, err
+		}
+	} else if _, ok := m.value.Value.(*hujson.Object); !ok {
+		return configNode{}, fmt.Errorf("%s: JSON key %q does not contain an object", f.filename, name)
+	}
+	return *m, nil
+}
+
+// Return the array member, it is created empty if it does not exist
+func (f *configSetFile) array(node configNode, name string) (configNode, error) {
+	m, err := f.member(node, name)
+	if err != nil {
+		return configNode{}, err
+	} else if m == nil || m.value.Value.Kind() == 'n' {
+		m, err = f.set(node, name, []interface{}{})
+		if err != nil {
+			return configNode{}, err
+		}
+	} else if _, ok := m.value.Value.(*hujson.Array); !ok {
+		return configNode{}, fmt.Errorf("%s: JSON key %q does not contain an array", f.filename, name)
+	}
+	return *m, nil
+}
+
+// Remove the object member, returns false if it does not exist
+func (f *configSetFile) unset(node configNode, name string) (bool, error) {
+	obj, ok := node.value.Value.(*hujson.Object)
+	if !ok {
+		return false, fmt.Errorf("%s: expected a JSON object", f.filename)
+	}
+
+	for i := range obj.Members {
+		key, ok := obj.Members[i].Name.Value.(hujson.Literal)
+		if !ok || key.String() != name {
+			continue
+		}
+
+		removed := obj.Members[i]
+		obj.Members = slices.Delete(obj.Members, i, i+1)
+		if i < len(obj.Members) {
+			// Drop the comment on the line of the removed member
+			next := &obj.Members[i].Name
+			if j := bytes.IndexByte(next.BeforeExtra, '\n'); j != -1 {
+				next.BeforeExtra = next.BeforeExtra[j:]
+			}
+		} else {
+			if i > 0 {
+				obj.Members[i-1].Value.AfterExtra = removed.Value.AfterExtra
+			}
+			// Drop the comment on the line of the removed member
+			if j := bytes.IndexByte(obj.AfterExtra, '\n'); j != -1 {
+				obj.AfterExtra = obj.AfterExtra[j:]
+			}
+		}
+		if len(obj.Members) == 0 && !hasComment(obj.AfterExtra) {
+			obj.AfterExtra = nil
+		}
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// Return the array elements
+func (f *configSetFile) elements(node configNode) []configNode {
+	arr, ok := node.value.Value.(*hujson.Array)
+	if !ok {
+		return nil
+	}
+
+	var res []configNode
+	for i := range arr.Elements {
+		res = append(res, configNode{&arr.Elements[i], f.childIndent(node, arr.Elements[i].BeforeExtra)})
+	}
+	return res
+}
+
+// Append the value to the array
+func (f *configSetFile) push(node configNode, value interface{}) (configNode, error) {
+	arr, ok := node.value.Value.(*hujson.Array)
+	if !ok {
+		return configNode{}, fmt.Errorf("%s: expected a JSON array", f.filename)
+	}
+
+	v, err := parseValue(value)
+	if err != nil {
+		return configNode{}, err
+	}
+
+	var last *hujson.Value
+	if len(arr.Elements) > 0 {
+		last = &arr.Elements[len(arr.Elements)-1]
+		v.AfterExtra = last.AfterExtra
+	}
+	v.BeforeExtra = f.appendExtra(node, last, &arr.AfterExtra)
+	arr.Elements = append(arr.Elements, v)
+
+	elem := &arr.Elements[len(arr.Elements)-1]
+	return configNode{elem, f.childIndent(node, elem.BeforeExtra)}, nil
+}
@@ -0,0 +1,118 @@
+package service_public
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/mildred/conductor.go/src/deployment"
+	"github.com/mildred/conductor.go/src/deployment_util"
+
+	. "github.com/mildred/conductor.go/src/service"
+)
+
+type DeploymentDiff struct {
+	Deployment    string       `json:"deployment"`
+	Part          string       `json:"part"`
+	PartId        string       `json:"part_id"`
+	CurrentPartId string       `json:"current_part_id"`
+	Diff          []*DiffEntry `json:"diff"`
+}
+
+type DiffOpts struct {
+	Deployment string
+	PrintJson  bool
+}
+
+// Compare the service of the running deployments with the current service to
+// explain why part ids changed
+func PrintDiff(name string, opts DiffOpts) error {
+	var ctx = context.Background()
+
+	service, err := LoadServiceByName(name)
+	if err != nil {
+		return err
+	}
+
+	var deployments []*deployment.Deployment
+	if opts.Deployment != "" {
+		depl, err := deployment.ReadDeploymentByName(opts.Deployment, false)
+		if err != nil {
+			return err
+		}
+		if depl.ServiceDir != service.BasePath {
+			return fmt.Errorf("deployment %s does not belong to service %s", depl.DeploymentName, service.Name)
+		}
+		deployments = append(deployments, depl)
+	} else {
+		deployments, err = deployment_util.List(deployment_util.ListOpts{
+			FilterServiceDir: service.BasePath,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	var diffs []*DeploymentDiff
+	for _, depl := range deployments {
+		var current_part_id string
+		if service.FindPod(depl.PartName) != nil || service.FindFunction(depl.PartName) != nil {
+			current_part_id, err = service.PartId(ctx, depl.PartName)
+			if err != nil {
+				return err
+			}
+		}
+
+		// Compare the secrets as they were when the deployment was created
+		diff, err := depl.Service.WithSecretHashes(depl.SecretHashes).Diff(service, depl.PartName)
+		if err != nil {
+			return fmt.Errorf("while comparing deployment %s, %v", depl.DeploymentName, err)
+		}
+
+		diffs = append(diffs, &DeploymentDiff{
+			Deployment:    depl.DeploymentName,
+			Part:          depl.PartName,
+			PartId:        depl.PartId,
+			CurrentPartId: current_part_id,
+			Diff:          diff,
+		})
+	}
+
+	if opts.PrintJson {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(diffs)
+	}
+
+	for i, d := range diffs {
+		if i > 0 {
+			fmt.Println()
+		}
+
+		fmt.Printf("Deployment %s (part %s):\n", d.Deployment, d.Part)
+		if d.CurrentPartId == "" {
+			fmt.Printf("  part %s was removed from the service\n", d.Part)
+		} else if d.CurrentPartId == d.PartId {
+			fmt.Printf("  part id %s unchanged\n", d.PartId)
+		} else {
+			fmt.Printf("  part id changed: %s -> %s\n", d.PartId, d.CurrentPartId)
+		}
+
+		var ignored = 0
+		for _, entry := range d.Diff {
+			fmt.Printf("  %s\n", entry.String())
+			if entry.Ignored != "" {
+				ignored++
+			}
+		}
+
+		if len(d.Diff) == 0 {
+			fmt.Printf("  no difference\n")
+		} else if ignored == len(d.Diff) && d.CurrentPartId != d.PartId && d.CurrentPartId != "" {
+			fmt.Printf("  the part id changed because of the part_id_template output\n")
+		}
+	}
+
+	return nil
+}
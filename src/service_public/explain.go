@@ -0,0 +1,55 @@
+package service_public
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	. "github.com/mildred/conductor.go/src/service"
+)
+
+type ExplainOpts struct {
+	PrintJson bool
+}
+
+// Print the files that set the keys of the service (all keys or the keys
+// below key) and the values they override
+func Explain(name, key string, opts ExplainOpts) error {
+	service, err := LoadServiceByName(name)
+	if err != nil {
+		return err
+	}
+
+	provenances := service.Provenance.Find(key)
+	if len(provenances) == 0 && key != "" {
+		return fmt.Errorf("%s is not set in any file of service %s", key, service.Name)
+	}
+
+	if opts.PrintJson {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(provenances)
+	}
+
+	for _, p := range provenances {
+		fmt.Printf("%s = %s\n", p.Key, string(p.Value))
+		fmt.Printf("\tset in %s\n", p.String())
+		for _, o := range p.Overrides {
+			fmt.Printf("\toverrides %s from %s\n", string(o.Value), o.String())
+		}
+	}
+
+	return nil
+}
+
+// Print the fully merged service configuration with resolved paths
+func Render(name string) error {
+	service, err := LoadServiceByName(name)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(service)
+}
@@ -0,0 +1,99 @@
+package service_public
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/rodaine/table"
+
+	"github.com/mildred/conductor.go/src/history"
+
+	. "github.com/mildred/conductor.go/src/service"
+)
+
+func PrintHistory(name string) error {
+	service, err := LoadServiceByName(name)
+	if err != nil {
+		return err
+	}
+
+	revisions, err := history.List(service)
+	if err != nil {
+		return err
+	}
+
+	tbl := table.New("REV", "KEY", "SERVICE ID", "FIRST DEPLOYED", "LAST DEPLOYED", "DEPLOYMENTS", "STATUS").WithPrintHeaders(true)
+	for _, rev := range revisions {
+		var status []string
+		if rev.Current {
+			status = append(status, "current")
+		}
+		if rev.Pinned {
+			status = append(status, "pinned")
+		}
+		tbl.AddRow(
+			rev.Number,
+			rev.Key,
+			rev.ServiceId,
+			rev.FirstTime.Format(time.DateTime),
+			rev.LastTime.Format(time.DateTime),
+			len(rev.Deployments),
+			strings.Join(status, ", "))
+	}
+	tbl.Print()
+
+	return nil
+}
+
+type RollbackOpts struct {
+	Clear  bool
+	Reload ReloadOpts
+}
+
+// Pin the service to a previous revision (the one before the current revision
+// if rev is empty) and reload it. With Clear, remove the pin instead.
+func Rollback(name string, rev string, opts RollbackOpts) error {
+	l, err := LockServiceByName(name, "rollback")
+	if err != nil {
+		return err
+	}
+	defer func() { l.Unlock() }()
+
+	service, err := LoadServiceByName(name)
+	if err != nil {
+		return err
+	}
+
+	if opts.Clear {
+		if service.Pin == nil {
+			return fmt.Errorf("service %s is not pinned", service.Name)
+		}
+
+		log.Printf("rollback: Unpin service %s from revision %s", service.Name, service.Pin.ServiceId)
+		err = RemovePin(service.BasePath)
+		if err != nil {
+			return err
+		}
+	} else {
+		revision, err := history.Find(service, rev)
+		if err != nil {
+			return err
+		}
+
+		if revision.Current && service.Pin == nil {
+			return fmt.Errorf("revision %d is the current revision of service %s", revision.Number, service.Name)
+		}
+
+		log.Printf("rollback: Pin service %s to revision %d (%s)", service.Name, revision.Number, revision.ServiceId)
+		err = history.Pin(service, revision)
+		if err != nil {
+			return err
+		}
+	}
+
+	l.Unlock()
+	l = nil
+	return Reload(name, opts.Reload)
+}
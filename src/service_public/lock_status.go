@@ -0,0 +1,56 @@
+package service_public
+
+import (
+	"strings"
+	"time"
+
+	"github.com/rodaine/table"
+
+	"github.com/mildred/conductor.go/src/deployment_util"
+	"github.com/mildred/conductor.go/src/lock"
+
+	. "github.com/mildred/conductor.go/src/service"
+)
+
+// Print who holds the lock of the service and of its deployments
+func PrintLockStatus(name string) error {
+	dir, err := ServiceDirByName(name)
+	if err != nil {
+		return err
+	}
+
+	deployments, err := deployment_util.List(deployment_util.ListOpts{
+		FilterServiceDir: dir,
+	})
+	if err != nil {
+		return err
+	}
+
+	var lock_names = []string{lock.ServiceLockName(dir)}
+	var targets = []string{"service " + name}
+	for _, depl := range deployments {
+		lock_names = append(lock_names, lock.DeploymentLockName(depl.DeploymentName))
+		targets = append(targets, "deployment "+depl.DeploymentName)
+	}
+
+	tbl := table.New("LOCK", "STATE", "PID", "USER", "OPERATION", "SINCE", "COMMAND").WithPrintHeaders(true)
+	for i, lock_name := range lock_names {
+		holder, err := lock.Status(lock_name)
+		if err != nil {
+			return err
+		} else if holder == nil {
+			tbl.AddRow(targets[i], "free", "", "", "", "", "")
+			continue
+		}
+
+		var since string
+		if !holder.Since.IsZero() {
+			since = holder.Since.Local().Format(time.DateTime)
+		}
+
+		tbl.AddRow(targets[i], "locked", holder.Pid, holder.Who(), holder.Operation, since, strings.Join(holder.Command, " "))
+	}
+	tbl.Print()
+
+	return nil
+}
@@ -0,0 +1,262 @@
+package service_public
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/rodaine/table"
+
+	"github.com/mildred/conductor.go/src/deployment_util"
+	"github.com/mildred/conductor.go/src/utils"
+
+	. "github.com/mildred/conductor.go/src/service"
+)
+
+const (
+	PlanStart  = "start"
+	PlanStop   = "stop"
+	PlanKeep   = "keep"
+	PlanIgnore = "ignore"
+)
+
+type ReloadPlan struct {
+	Services []*ServicePlan `json:"services"`
+}
+
+type ServicePlan struct {
+	ServiceDir string           `json:"service_dir,omitempty"`
+	Unit       string           `json:"unit"`
+	Action     string           `json:"action"` // start, stop, keep or ignore
+	Reason     string           `json:"reason"`
+	Active     bool             `json:"active"`
+	Enabled    bool             `json:"enabled"` // The service should run
+	Redeploy   bool             `json:"redeploy"`
+	Parts      []*PartPlan      `json:"parts,omitempty"`
+	PartsError string           `json:"parts_error,omitempty"` // Part ids could not be computed
+	Conditions *ConditionResult `json:"conditions,omitempty"`
+}
+
+type PartPlan struct {
+	Part        string   `json:"part"`
+	PartId      string   `json:"part_id"`
+	Deployments []string `json:"deployments"`          // Deployments matching the part id
+	Obsolete    []string `json:"obsolete_deployments"` // Deployments with another part id
+	Redeploy    bool     `json:"redeploy"`
+}
+
+// Compute what ReloadServices would do, without side effects. The parts to
+// redeploy are only computed with parts set because it runs the part id
+// templates of every enabled service.
+func PlanReload(inclusive bool, verbose bool, parts bool) (*ReloadPlan, error) {
+	var ctx = context.Background()
+	sd, err := utils.NewSystemdClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	existing_units, err := sd.ListUnitsByPatternsContext(ctx, nil, []string{"conductor-service@*.service"})
+	if err != nil {
+		return nil, err
+	}
+
+	var active_units []string
+	for _, u := range existing_units {
+		if u.ActiveState == "active" || u.ActiveState == "activating" || u.ActiveState == "reloading" {
+			active_units = append(active_units, u.Name)
+		}
+	}
+
+	var plan = &ReloadPlan{}
+	var seen_service_dirs []string
+
+	for _, dir := range ServiceDirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		log_prefix := log.Prefix()
+
+		for _, ent := range entries {
+			service_dir := path.Join(dir, ent.Name())
+			log.SetPrefix(fmt.Sprintf("%s%s: ", log_prefix, service_dir))
+
+			_, err = os.Stat(path.Join(service_dir, ConfigName))
+			if err != nil && !os.IsNotExist(err) {
+				log.Printf("ignore service, error while querying service file: %v\n", err)
+				continue
+			} else if err != nil {
+				// ignore error, this is not a valid service dir
+				continue
+			}
+
+			service_dir, err = ServiceRealpath(service_dir)
+			if err != nil {
+				return nil, err
+			}
+
+			unit := ServiceUnit(service_dir)
+			service_plan := &ServicePlan{
+				ServiceDir: service_dir,
+				Unit:       unit,
+				Active:     slices.Contains(active_units, unit),
+			}
+
+			serv, err := LoadServiceDir(service_dir)
+			if err != nil {
+				log.Printf("ignore service, cannot load configuration: %v\n", err)
+				service_plan.Action = PlanIgnore
+				service_plan.Reason = fmt.Sprintf("cannot load configuration: %v", err)
+				plan.Services = append(plan.Services, service_plan)
+				continue
+			}
+
+			seen_service_dirs = append(seen_service_dirs, service_dir)
+
+			if verbose {
+				log.Printf("evaluate conditions...")
+			}
+			condition, disable, err := serv.EvaluateConditionTree(verbose)
+			if err != nil {
+				log.Printf("ignore service, cannot evaluate conditions: %v\n", err)
+				service_plan.Action = PlanIgnore
+				service_plan.Reason = fmt.Sprintf("cannot evaluate conditions: %v", err)
+				plan.Services = append(plan.Services, service_plan)
+				continue
+			}
+
+			service_plan.Conditions = condition
+			service_plan.Reason = ConditionReason(condition, disable)
+			service_plan.Enabled = !disable && condition.Result
+			if service_plan.Enabled && !service_plan.Active {
+				service_plan.Action = PlanStart
+			} else if !service_plan.Enabled && service_plan.Active {
+				service_plan.Action = PlanStop
+			} else {
+				service_plan.Action = PlanKeep
+			}
+
+			if verbose {
+				log.Printf("service action: %s (%s)", service_plan.Action, service_plan.Reason)
+			}
+
+			if parts && service_plan.Enabled {
+				err = planParts(ctx, serv, service_plan)
+				if err != nil {
+					log.Printf("cannot compute the parts to redeploy: %v\n", err)
+					service_plan.PartsError = err.Error()
+				}
+			}
+
+			plan.Services = append(plan.Services, service_plan)
+		}
+
+		log.SetPrefix(log_prefix)
+	}
+
+	if !inclusive {
+		for _, u := range existing_units {
+			service := ServiceDirFromUnit(u.Name)
+			if service == "" || slices.Contains(seen_service_dirs, service) {
+				continue
+			}
+
+			action := PlanStop
+			if !slices.Contains(active_units, u.Name) {
+				action = PlanKeep
+			}
+
+			plan.Services = append(plan.Services, &ServicePlan{
+				ServiceDir: service,
+				Unit:       u.Name,
+				Action:     action,
+				Active:     slices.Contains(active_units, u.Name),
+				Reason:     "service is not in a well-known directory",
+			})
+		}
+	}
+
+	return plan, nil
+}
+
+// Compare the part ids with the running deployments
+func planParts(ctx context.Context, serv *Service, service_plan *ServicePlan) error {
+	part_ids, err := serv.PartIds(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, part := range utils.SortedStringKeys(part_ids) {
+		part_plan := &PartPlan{
+			Part:   part,
+			PartId: part_ids[part],
+		}
+
+		deployments, err := deployment_util.List(deployment_util.ListOpts{
+			FilterServiceDir: serv.BasePath,
+			FilterPartName:   &part,
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, depl := range deployments {
+			if depl.PartId == part_plan.PartId {
+				part_plan.Deployments = append(part_plan.Deployments, depl.DeploymentName)
+			} else {
+				part_plan.Obsolete = append(part_plan.Obsolete, depl.DeploymentName)
+			}
+		}
+
+		part_plan.Redeploy = len(part_plan.Deployments) == 0
+		if part_plan.Redeploy {
+			service_plan.Redeploy = true
+		}
+
+		service_plan.Parts = append(service_plan.Parts, part_plan)
+	}
+
+	return nil
+}
+
+type PlanOpts struct {
+	Inclusive bool
+	Verbose   bool
+	PrintJson bool
+}
+
+func PrintPlan(opts PlanOpts) error {
+	plan, err := PlanReload(opts.Inclusive, opts.Verbose, true)
+	if err != nil {
+		return err
+	}
+
+	if opts.PrintJson {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(plan)
+	}
+
+	tbl := table.New("Unit", "Action", "Redeploy", "Reason").WithPrintHeaders(true)
+	for _, s := range plan.Services {
+		var redeploy []string
+		for _, part := range s.Parts {
+			if part.Redeploy {
+				redeploy = append(redeploy, part.Part)
+			}
+		}
+		if s.PartsError != "" {
+			redeploy = append(redeploy, "error: "+s.PartsError)
+		}
+		tbl.AddRow(s.Unit, s.Action, strings.Join(redeploy, ", "), s.Reason)
+	}
+	tbl.Print()
+
+	return nil
+}
@@ -2,113 +2,39 @@ package service_public
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
 	"os"
 	"os/exec"
-	"path"
-	"slices"
 	"strings"
 
+	"github.com/mildred/conductor.go/src/audit"
 	"github.com/mildred/conductor.go/src/deployment_util"
 	"github.com/mildred/conductor.go/src/dirs"
+	"github.com/mildred/conductor.go/src/lock"
 	"github.com/mildred/conductor.go/src/service_internal"
 	"github.com/mildred/conductor.go/src/utils"
+	"github.com/tailscale/hujson"
 
 	. "github.com/mildred/conductor.go/src/service"
 )
 
 func ReloadServices(inclusive bool, verbose bool) error {
-	var ctx = context.Background()
-	sd, err := utils.NewSystemdClient(ctx)
+	plan, err := PlanReload(inclusive, verbose, false)
 	if err != nil {
 		return err
 	}
 
-	//
-	// Reload services in well-known dirs
-	//
-
-	var seen_service_dirs []string
 	var start_list []string
 	var stop_list []string
 
-	for _, dir := range ServiceDirs {
-		entries, err := os.ReadDir(dir)
-		if err != nil && !os.IsNotExist(err) {
-			return err
-		}
-
-		log_prefix := log.Prefix()
-
-		for _, ent := range entries {
-			service_dir := path.Join(dir, ent.Name())
-			log.SetPrefix(fmt.Sprintf("%s%s: ", log_prefix, service_dir))
-
-			_, err = os.Stat(path.Join(service_dir, ConfigName))
-			if err != nil && !os.IsNotExist(err) {
-				log.Printf("ignore service, error while querying service file: %v\n", err)
-				continue
-			} else if err != nil {
-				// ignore error, this is not a valid service dir
-				continue
-			}
-
-			service_dir, err = ServiceRealpath(service_dir)
-			if err != nil {
-				return err
-			}
-
-			serv, err := LoadServiceDir(service_dir)
-			if err != nil {
-				log.Printf("ignore service, cannot load configuration: %v\n", err)
-				continue
-			}
-
-			seen_service_dirs = append(seen_service_dirs, service_dir)
-
-			if verbose {
-				log.Printf("evaluate conditions...")
-			}
-			condition, disable, err := serv.EvaluateCondition(verbose)
-			if err != nil {
-				log.Printf("ignore service, cannot evaluate conditions: %v\n", err)
-				continue
-			}
-
-			if disable || !condition {
-				stop_list = append(stop_list, ServiceUnit(service_dir))
-				if verbose && disable {
-					log.Printf("service is disabled explicitely")
-				} else if verbose && !condition {
-					log.Printf("service is disabled because conditions do not match")
-				}
-			} else {
-				start_list = append(start_list, ServiceUnit(service_dir))
-				if verbose {
-					log.Printf("service is enabled")
-				}
-			}
-		}
-
-		log.SetPrefix(log_prefix)
-	}
-
-	if !inclusive {
-		existing_units, err := sd.ListUnitsByPatternsContext(ctx, nil, []string{"conductor-service@*.service"})
-		if err != nil {
-			return err
-		}
-
-		for _, u := range existing_units {
-			service := ServiceDirFromUnit(u.Name)
-			if service == "" || slices.Contains(seen_service_dirs, service) {
-				continue
-			}
-
-			stop_list = append(stop_list, u.Name)
+	for _, s := range plan.Services {
+		if s.Action == PlanIgnore {
+			continue
+		} else if s.Enabled {
+			start_list = append(start_list, s.Unit)
+		} else {
+			stop_list = append(stop_list, s.Unit)
 		}
 	}
 
@@ -138,23 +64,38 @@ func ReloadServices(inclusive bool, verbose bool) error {
 }
 
 func setDisableConfig(definition_path string, disable bool) error {
+	action := audit.ActionEnable
+	if disable {
+		action = audit.ActionDisable
+	}
+
+	l, err := lock.Service(definition_path, action)
+	if err != nil {
+		return err
+	}
+	defer l.Unlock()
+
 	serv, err := LoadServiceDir(definition_path)
 	if err != nil {
 		return err
 	}
 
-	service, err := readConfigSetFile(serv.ConfigSetFile)
+	f, err := readConfigSetFile(serv.ConfigSetFile)
 	if err != nil {
 		return err
 	}
 
-	service["disable"] = disable
+	_, err = f.set(f.rootNode(), "disable", disable)
+	if err != nil {
+		return err
+	}
 
-	err = writeConfigSetFile(serv.ConfigSetFile, service)
+	err = f.write()
 	if err != nil {
 		return err
 	}
 
+	auditServiceChange(action, serv, serv.ConfigSetFile, "disable", serv.Disable, disable)
 	return nil
 }
 
@@ -458,70 +399,149 @@ func Reload(definition_path string, opts ReloadOpts) error {
 	return cmd.Run()
 }
 
-func readConfigSetFile(filename string) (map[string]interface{}, error) {
-	var service = map[string]interface{}{}
+func ServiceSetConfig(filename string, config map[string]*ConfigValue) error {
+	f, err := readConfigSetFile(filename)
+	if err != nil {
+		return err
+	}
+
+	service_config, err := f.object(f.rootNode(), "config")
+	if err != nil {
+		return err
+	}
+
+	for _, k := range utils.SortedStringKeys(config) {
+		_, err = f.set(service_config, k, config[k])
+		if err != nil {
+			return err
+		}
+	}
+
+	return f.write()
+}
+
+// Remove configuration variables from the file, returns the variables that
+// were not present in the file
+func ServiceUnsetConfig(filename string, vars []string) ([]string, error) {
+	f, err := readConfigSetFile(filename)
+	if err != nil {
+		return nil, err
+	}
 
-	f, err := os.Open(filename)
-	if err != nil && !os.IsNotExist(err) {
+	service_config, err := f.member(f.rootNode(), "config")
+	if err != nil {
 		return nil, err
-	} else if err == nil {
-		defer f.Close()
+	} else if service_config == nil {
+		return vars, nil
+	}
 
-		err = json.NewDecoder(f).Decode(&service)
+	var missing []string
+	for _, k := range vars {
+		found, err := f.unset(*service_config, k)
 		if err != nil {
 			return nil, err
+		} else if !found {
+			missing = append(missing, k)
 		}
+	}
 
-		return service, nil
-	} else {
-		return service, nil
+	if len(missing) == len(vars) {
+		return missing, nil
 	}
+
+	return missing, f.write()
 }
 
-func writeConfigSetFile(filename string, service map[string]interface{}) error {
-	f, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.ModePerm-0o111)
+// Change the number of replicas of a pod in the service configuration and
+// start or remove deployments to match it
+func Scale(name string, part string, replicas int, opts service_internal.StartOrReloadOpts) error {
+	if replicas < 1 {
+		return fmt.Errorf("replicas must be at least 1")
+	}
+
+	definition_path, err := ServiceDirByName(name)
 	if err != nil {
 		return err
 	}
 
-	defer f.Close()
+	l, err := lock.Service(definition_path, "scale")
+	if err != nil {
+		return err
+	}
+	defer l.Unlock()
 
-	err = json.NewEncoder(f).Encode(service)
+	serv, err := LoadServiceDir(definition_path)
 	if err != nil {
 		return err
 	}
 
-	return nil
-}
+	if serv.FindPod(part) == nil {
+		return fmt.Errorf("service %s has no pod %q", serv.Name, part)
+	}
+
+	f, err := readConfigSetFile(serv.ConfigSetFile)
+	if err != nil {
+		return err
+	}
 
-func ServiceSetConfig(filename string, config map[string]string) error {
-	//
-	// Read service file if it exists
-	//
+	pods, err := f.array(f.rootNode(), "pods")
+	if err != nil {
+		return err
+	}
 
-	service, err := readConfigSetFile(filename)
+	var found = false
+	for _, pod := range f.elements(pods) {
+		pod_name, err := f.member(pod, "name")
+		if err == nil && pod_name != nil && pod_name.value.Value.Kind() == '"' && pod_name.value.Value.(hujson.Literal).String() == part {
+			_, err = f.set(pod, "replicas", replicas)
+			if err != nil {
+				return err
+			}
+			found = true
+		}
+	}
+	if !found {
+		pod, err := f.push(pods, map[string]interface{}{})
+		if err != nil {
+			return err
+		}
+		if _, err = f.set(pod, "name", part); err != nil {
+			return err
+		}
+		if _, err = f.set(pod, "replicas", replicas); err != nil {
+			return err
+		}
+	}
+
+	err = f.write()
 	if err != nil {
 		return err
 	}
 
-	//
-	// Add to Config
-	//
+	key := fmt.Sprintf("pods[%s].replicas", part)
+	auditServiceChange(audit.ActionScale, serv, serv.ConfigSetFile, key, serv.PartReplicas(part), replicas)
 
-	service_config_if, ok := service["config"]
-	if !ok {
-		service_config_if = map[string]interface{}{}
-		service["config"] = service_config_if
+	return service_internal.Reconcile(definition_path, opts)
+}
+
+// Forget the deployment failures of the service so that it is no longer
+// degraded and new deployments can be created
+func ResetFailed(name string) error {
+	definition_path, err := ServiceDirByName(name)
+	if err != nil {
+		return err
 	}
 
-	service_config, ok := service_config_if.(map[string]interface{})
-	if !ok {
-		return fmt.Errorf("JSON key %q does not contain an object", "config")
+	l, err := lock.Service(definition_path, "reset-failed")
+	if err != nil {
+		return err
 	}
+	defer l.Unlock()
 
-	for k, v := range config {
-		service_config[k] = v
+	serv, err := LoadServiceDir(definition_path)
+	if err != nil {
+		return err
 	}
 
-	return writeConfigSetFile(filename, service)
+	return service_internal.ResetCrashLoop(serv)
 }
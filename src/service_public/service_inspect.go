@@ -14,11 +14,12 @@ import (
 )
 
 type InspectState struct {
-	UnitStatus dbus.UnitStatus `json:"unit_status"`
+	UnitStatus    dbus.UnitStatus `json:"unit_status"`
+	DegradedParts []string        `json:"degraded_parts,omitempty"`
 }
 
 func Inspect(ctx context.Context, service *Service, state *InspectState) (json.RawMessage, error) {
-	condition_matched, _, err := service.EvaluateCondition(false)
+	condition, _, err := service.EvaluateCondition(false)
 	if err != nil {
 		return nil, err
 	}
@@ -30,28 +31,30 @@ func Inspect(ctx context.Context, service *Service, state *InspectState) (json.R
 
 	exported := struct {
 		*Service
-		Inherit          []*InheritFile    `json:"inherit"`
-		State            *InspectState     `json:"_state,omitempty"`
-		BasePath         string            `json:"_base_path"`
-		FileName         string            `json:"_file_name"`
-		ConfigSetFile    string            `json:"_config_set_file"`
-		Name             string            `json:"_name"`
-		Id               string            `json:"_id"`
-		ProxyConfig      caddy.ConfigItems `json:"_proxy_config"`
-		ConditionMatched bool              `json:"_condition_matched"`
-		Vars             []string          `json:"_vars"`
+		Inherit            []*InheritFile    `json:"inherit"`
+		State              *InspectState     `json:"_state,omitempty"`
+		BasePath           string            `json:"_base_path"`
+		FileName           string            `json:"_file_name"`
+		ConfigSetFile      string            `json:"_config_set_file"`
+		Name               string            `json:"_name"`
+		Id                 string            `json:"_id"`
+		ProxyConfig        caddy.ConfigItems `json:"_proxy_config"`
+		ConditionMatched   bool              `json:"_condition_matched"`
+		ConditionEvaluated bool              `json:"_condition_evaluated"`
+		Vars               []string          `json:"_vars"`
 	}{
-		Service:          service,
-		State:            state,
-		Inherit:          service.Inherit.Inherit,
-		BasePath:         service.BasePath,
-		FileName:         service.FileName,
-		ConfigSetFile:    service.ConfigSetFile,
-		Name:             service.Name,
-		Id:               service.Id,
-		ProxyConfig:      proxy_config,
-		ConditionMatched: condition_matched,
-		Vars:             service.Vars(),
+		Service:            service,
+		State:              state,
+		Inherit:            service.Inherit.Inherit,
+		BasePath:           service.BasePath,
+		FileName:           service.FileName,
+		ConfigSetFile:      service.ConfigSetFile,
+		Name:               service.Name,
+		Id:                 service.Id,
+		ProxyConfig:        proxy_config,
+		ConditionMatched:   condition.Result,
+		ConditionEvaluated: condition.Evaluated(),
+		Vars:               service.MaskedVars(),
 	}
 
 	var buf bytes.Buffer
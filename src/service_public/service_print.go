@@ -49,7 +49,9 @@ func PrintService(name string, settings PrintSettings) error {
 	if err != nil {
 		return err
 	}
-	if condition {
+	if !condition.Evaluated() {
+		tbl.AddRow("Condition", "not evaluated")
+	} else if condition.Result {
 		tbl.AddRow("Condition", "allowing")
 	} else {
 		tbl.AddRow("Condition", "blocking")
@@ -16,6 +16,7 @@ import (
 	"github.com/coreos/go-systemd/v22/dbus"
 	"github.com/rodaine/table"
 
+	"github.com/mildred/conductor.go/src/service_internal"
 	"github.com/mildred/conductor.go/src/service_util"
 	"github.com/mildred/conductor.go/src/utils"
 
@@ -277,11 +278,17 @@ func PrintList(settings PrintListSettings) error {
 
 		var filtered_out = false
 		if !settings.All {
-			filtered_out = !condition && u.LoadState == "" && u.ActiveState == ""
+			filtered_out = !condition.Result && condition.Evaluated() && u.LoadState == "" && u.ActiveState == ""
+		}
+
+		degraded, err := service_internal.DegradedParts(ctx, service)
+		if err != nil {
+			errs = errors.Join(errs, fmt.Errorf("Error reading crash-loop state for %v-%v: %v", service.AppName, service.InstanceName, err))
 		}
 
 		msg, err := Inspect(ctx, service, &InspectState{
-			UnitStatus: u,
+			UnitStatus:    u,
+			DegradedParts: degraded,
 		})
 		if err != nil {
 			errs = errors.Join(errs, fmt.Errorf("Error inspecting %v-%v: %v", service.AppName, service.InstanceName, err))
@@ -363,7 +370,13 @@ func PrintList(settings PrintListSettings) error {
 					} else {
 						enabled_state = "disabled(" + enabled_state + ")"
 					}
-				} else if !condition {
+				} else if !condition.Evaluated() {
+					if enabled_state == "" {
+						enabled_state = "not evaluated"
+					} else {
+						enabled_state = "not evaluated(" + enabled_state + ")"
+					}
+				} else if !condition.Result {
 					if enabled_state == "" {
 						enabled_state = "blocked"
 					} else {
@@ -371,7 +384,16 @@ func PrintList(settings PrintListSettings) error {
 					}
 				}
 
-				row = []interface{}{name, service.AppName, service.InstanceName, enabled_state, u.ActiveState, u.SubState}
+				state := u.SubState
+				if len(degraded) > 0 {
+					if state == "" {
+						state = "degraded"
+					} else {
+						state = "degraded(" + state + ")"
+					}
+				}
+
+				row = []interface{}{name, service.AppName, service.InstanceName, enabled_state, u.ActiveState, state}
 				if settings.Unit {
 					row = append(row, u.Name)
 				}
@@ -0,0 +1,96 @@
+package service_public
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	. "github.com/mildred/conductor.go/src/service"
+)
+
+type ValidateOpts struct {
+	PrintJson bool
+}
+
+// Return the service file for a directory, a file or a service name
+func validateServiceFile(name string) (string, error) {
+	st, err := os.Stat(name)
+	if err == nil && st.IsDir() {
+		return filepath.Abs(filepath.Join(name, ConfigName))
+	} else if err == nil {
+		return filepath.Abs(name)
+	}
+
+	return ServiceFileByName(name)
+}
+
+// Validate the services (all services in the well-known directories if none
+// is given) and return an error if there is a problem
+func ValidateServices(names []string, opts ValidateOpts) error {
+	var ctx = context.Background()
+	var files []string
+
+	if len(names) == 0 {
+		for _, dir := range ServiceDirs {
+			entries, err := os.ReadDir(dir)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+
+			for _, ent := range entries {
+				fname := filepath.Join(dir, ent.Name(), ConfigName)
+				if _, err := os.Stat(fname); err == nil {
+					files = append(files, fname)
+				}
+			}
+		}
+	}
+
+	for _, name := range names {
+		fname, err := validateServiceFile(name)
+		if err != nil {
+			return err
+		}
+		files = append(files, fname)
+	}
+
+	var problems = []*ValidationProblem{}
+	for _, fname := range files {
+		p, err := Validate(ctx, fname)
+		if err != nil {
+			return fmt.Errorf("while validating %s, %v", fname, err)
+		}
+		problems = append(problems, p...)
+	}
+
+	if opts.PrintJson {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err := enc.Encode(problems)
+		if err != nil {
+			return err
+		}
+	} else {
+		for _, p := range problems {
+			fmt.Println(p.String())
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%d problem(s) found in %d service(s)", len(problems), len(files))
+	}
+
+	return nil
+}
+
+func PrintSchema() error {
+	schema, err := Schema()
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Println(string(schema))
+	return err
+}
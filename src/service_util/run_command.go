@@ -2,11 +2,13 @@ package service_util
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"os"
 	"os/exec"
 
 	"github.com/mildred/conductor.go/src/deployment"
+	"github.com/mildred/conductor.go/src/sandbox"
 	. "github.com/mildred/conductor.go/src/service"
 )
 
@@ -15,7 +17,7 @@ type ServiceCommandRunner struct {
 }
 
 func (s *ServiceCommandRunner) RunCommandGetValue(c *ServiceCommand, cmd_name string, args ...string) (string, error) {
-	cmd, err := PrepareCommand(c, s.BasePath, s.Vars(), cmd_name, args...)
+	cmd, err := PrepareCommand(c, s.Service, s.BasePath, s.Vars(), cmd_name, args...)
 	if err != nil {
 		return "", err
 	}
@@ -32,7 +34,7 @@ type DeploymentCommandRunner struct {
 }
 
 func (depl *DeploymentCommandRunner) RunCommandGetValue(c *ServiceCommand, cmd_name string, args ...string) (string, error) {
-	cmd, err := PrepareCommand(c, deployment.DeploymentDirByNameOnly(depl.DeploymentName), depl.Vars(), cmd_name, args...)
+	cmd, err := PrepareCommand(c, depl.Service, deployment.DeploymentDirByNameOnly(depl.DeploymentName), depl.Vars(), cmd_name, args...)
 	if err != nil {
 		return "", err
 	}
@@ -44,7 +46,7 @@ func (depl *DeploymentCommandRunner) RunCommandGetValue(c *ServiceCommand, cmd_n
 	return buf.String(), err
 }
 
-func PrepareCommand(command *ServiceCommand, cwd string, vars []string, cmd_name string, args ...string) (*exec.Cmd, error) {
+func PrepareCommand(command *ServiceCommand, service *Service, cwd string, vars []string, cmd_name string, args ...string) (*exec.Cmd, error) {
 	if command == nil {
 		return nil, fmt.Errorf("Command %q does not exists", cmd_name)
 	}
@@ -60,21 +62,37 @@ func PrepareCommand(command *ServiceCommand, cwd string, vars []string, cmd_name
 
 	args = append(command.Exec, args...)
 
-	cmd := exec.Command(args[0], args[1:]...)
-	cmd.Dir = cwd
+	vars = append([]string{
+		fmt.Sprintf("CONDUCTOR_COMMAND=%s", cmd_name),
+		fmt.Sprintf("CONDUCTOR_COMMAND_DIR=%s", wd),
+	}, vars...)
+
+	var cmd *exec.Cmd
+	if service != nil && service.Sandbox.Enabled(sandbox.KindCommand) {
+		cmd, err = service.Sandbox.Command(context.Background(), sandbox.Run{
+			Kind:       sandbox.KindCommand,
+			Dir:        cwd,
+			ServiceDir: service.BasePath,
+			Env:        vars,
+			Args:       args,
+		})
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		cmd = exec.Command(args[0], args[1:]...)
+		cmd.Dir = cwd
+		cmd.Env = append(os.Environ(), vars...)
+	}
 	cmd.Stdin = os.Stdin
 	cmd.Stderr = os.Stderr
 	cmd.Stdout = os.Stdout
-	cmd.Env = os.Environ()
-	cmd.Env = append(cmd.Env, fmt.Sprintf("CONDUCTOR_COMMAND=%s", cmd_name))
-	cmd.Env = append(cmd.Env, fmt.Sprintf("CONDUCTOR_COMMAND_DIR=%s", wd))
-	cmd.Env = append(cmd.Env, vars...)
 
 	return cmd, nil
 }
 
-func RunCommand(command *ServiceCommand, direct bool, cwd string, vars []string, cmd_name string, args ...string) error {
-	cmd, err := PrepareCommand(command, cwd, vars, cmd_name, args...)
+func RunCommand(command *ServiceCommand, service *Service, direct bool, cwd string, vars []string, cmd_name string, args ...string) error {
+	cmd, err := PrepareCommand(command, service, cwd, vars, cmd_name, args...)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,171 @@
+package tmpl
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"text/template"
+)
+
+// Templates with the .gotmpl extension are rendered in-process with
+// text/template instead of being executed. The variables are available as
+// .Vars (or with the env function) along with the structured data given by
+// the caller (.Service, .Deployment, .Pod, ...).
+
+const GoTemplateExt = ".gotmpl"
+
+func IsGoTemplate(fname string) bool {
+	return strings.HasSuffix(fname, GoTemplateExt)
+}
+
+func isEmpty(val interface{}) bool {
+	if val == nil {
+		return true
+	}
+	v := reflect.ValueOf(val)
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Pointer, reflect.Interface:
+		return v.IsNil()
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	}
+	return false
+}
+
+func indent(n int, s string) string {
+	pad := strings.Repeat(" ", n)
+	return pad + strings.ReplaceAll(s, "\n", "\n"+pad)
+}
+
+// Helpers named and ordered like their sprig counterparts so they can be
+// used in pipelines
+var Funcs = template.FuncMap{
+	"toJson": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	"toPrettyJson": func(v interface{}) (string, error) {
+		data, err := json.MarshalIndent(v, "", "  ")
+		return string(data), err
+	},
+	"quote": func(v interface{}) string {
+		return fmt.Sprintf("%q", fmt.Sprint(v))
+	},
+	"squote": func(v interface{}) string {
+		return "'" + fmt.Sprint(v) + "'"
+	},
+	"default": func(def interface{}, val ...interface{}) interface{} {
+		if len(val) == 0 || isEmpty(val[0]) {
+			return def
+		}
+		return val[0]
+	},
+	"empty": isEmpty,
+	"required": func(msg string, val interface{}) (interface{}, error) {
+		if isEmpty(val) {
+			return nil, fmt.Errorf("%s", msg)
+		}
+		return val, nil
+	},
+	"fail": func(msg string) (string, error) {
+		return "", fmt.Errorf("%s", msg)
+	},
+	"b64enc": func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	},
+	"b64dec": func(s string) (string, error) {
+		data, err := base64.StdEncoding.DecodeString(s)
+		return string(data), err
+	},
+	"upper":      strings.ToUpper,
+	"lower":      strings.ToLower,
+	"trim":       strings.TrimSpace,
+	"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+	"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+	"replace":    func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+	"contains":   func(substr, s string) bool { return strings.Contains(s, substr) },
+	"hasPrefix":  func(prefix, s string) bool { return strings.HasPrefix(s, prefix) },
+	"hasSuffix":  func(suffix, s string) bool { return strings.HasSuffix(s, suffix) },
+	"splitList":  func(sep, s string) []string { return strings.Split(s, sep) },
+	"join": func(sep string, list interface{}) string {
+		v := reflect.ValueOf(list)
+		if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+			return fmt.Sprint(list)
+		}
+		var items []string
+		for i := 0; i < v.Len(); i++ {
+			items = append(items, fmt.Sprint(v.Index(i).Interface()))
+		}
+		return strings.Join(items, sep)
+	},
+	"indent":  indent,
+	"nindent": func(n int, s string) string { return "\n" + indent(n, s) },
+	"list":    func(items ...interface{}) []interface{} { return items },
+	"dict": func(pairs ...interface{}) (map[string]interface{}, error) {
+		if len(pairs)%2 != 0 {
+			return nil, fmt.Errorf("dict needs an even number of arguments")
+		}
+		res := map[string]interface{}{}
+		for i := 0; i < len(pairs); i += 2 {
+			res[fmt.Sprint(pairs[i])] = pairs[i+1]
+		}
+		return res, nil
+	},
+}
+
+// Parse a Go template, errors refer to the file and line
+func ParseGoTemplate(fname string) (*template.Template, error) {
+	text, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+
+	// The env function is replaced when rendering
+	t := template.New(fname).Option("missingkey=zero").Funcs(Funcs).Funcs(template.FuncMap{
+		"env": func(name string) string { return "" },
+	})
+	return t.Parse(string(text))
+}
+
+func renderGoTemplate(fname string, vars []string, data map[string]interface{}) (string, error) {
+	t, err := ParseGoTemplate(fname)
+	if err != nil {
+		return "", err
+	}
+
+	var vars_map = map[string]string{}
+	for _, v := range vars {
+		k, val, _ := strings.Cut(v, "=")
+		vars_map[k] = val
+	}
+
+	var root = map[string]interface{}{}
+	for k, v := range data {
+		root[k] = v
+	}
+	root["Vars"] = vars_map
+
+	t.Funcs(template.FuncMap{
+		"env": func(name string) string { return vars_map[name] },
+	})
+
+	var buf bytes.Buffer
+	err = t.Execute(&buf, root)
+	if err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
@@ -7,22 +7,98 @@ import (
 	"log"
 	"os"
 	"os/exec"
+	"slices"
+	"strings"
 	"time"
+
+	"github.com/mildred/conductor.go/src/sandbox"
 )
 
 var DefaultTimeout time.Duration = 30 * time.Second
 
-func RunTemplate(ctx context.Context, fname string, vars []string) (string, error) {
+// Replaces the secret values in the template arguments
+const SecretMask = "********"
+
+type Options struct {
+	Data       map[string]interface{} // Structured data for Go templates
+	Timeout    time.Duration          // DefaultTimeout if zero
+	Sandbox    *sandbox.Profile
+	ServiceDir string
+	Secrets    []string // Variables only passed in the environment, masked in the arguments
+}
+
+func (opts *Options) timeout() time.Duration {
+	if opts == nil || opts.Timeout <= 0 {
+		return DefaultTimeout
+	}
+	return opts.Timeout
+}
+
+func (opts *Options) data() map[string]interface{} {
+	if opts == nil {
+		return nil
+	}
+	return opts.Data
+}
+
+// Return the variables passed as arguments, secrets are masked because the
+// arguments can be read by any local user
+func (opts *Options) args(vars []string) []string {
+	if opts == nil || len(opts.Secrets) == 0 {
+		return vars
+	}
+
+	var args []string
+	for _, v := range vars {
+		name, _, _ := strings.Cut(v, "=")
+		if slices.Contains(opts.Secrets, name) {
+			v = name + "=" + SecretMask
+		}
+		args = append(args, v)
+	}
+	return args
+}
+
+func command(ctx context.Context, fname string, vars []string, opts *Options) (*exec.Cmd, error) {
+	if opts != nil && opts.Sandbox.Enabled(sandbox.KindTemplate) {
+		wd, _ := os.Getwd()
+		return opts.Sandbox.Command(ctx, sandbox.Run{
+			Kind:       sandbox.KindTemplate,
+			Dir:        wd,
+			ServiceDir: opts.ServiceDir,
+			Env:        vars,
+			Timeout:    opts.timeout(),
+			Args:       append([]string{fname}, opts.args(vars)...),
+		})
+	}
+
+	cmd := exec.CommandContext(ctx, fname, opts.args(vars)...)
+	cmd.Env = append(cmd.Environ(), vars...)
+	return cmd, nil
+}
+
+// Run the template with the variables, Go templates also get the structured
+// data
+func RunTemplate(ctx context.Context, fname string, vars []string, opts *Options) (string, error) {
 	if fname == "" {
 		return "", nil
+	} else if IsGoTemplate(fname) {
+		log.Printf("templating: render %s\n", fname)
+		res, err := renderGoTemplate(fname, vars, opts.data())
+		if err != nil {
+			return "", fmt.Errorf("while rendering template, %v", err)
+		}
+		return res, nil
 	}
 
-	ctx, cancel := context.WithTimeout(ctx, DefaultTimeout)
+	ctx, cancel := context.WithTimeout(ctx, opts.timeout())
 	defer cancel()
 
 	log.Printf("templating: execute %s\n", fname)
-	cmd := exec.CommandContext(ctx, fname, vars...)
-	cmd.Env = append(cmd.Environ(), vars...)
+	cmd, err := command(ctx, fname, vars, opts)
+	if err != nil {
+		return "", err
+	}
 	cmd.Stderr = os.Stderr
 	res, err := cmd.Output()
 	if err != nil {
@@ -32,29 +108,38 @@ func RunTemplate(ctx context.Context, fname string, vars []string) (string, erro
 	return string(res), nil
 }
 
-func RunTemplateStdout(ctx context.Context, fname string, vars []string) error {
+func RunTemplateStdout(ctx context.Context, fname string, vars []string, opts *Options) error {
 	if fname == "" {
 		return nil
+	} else if IsGoTemplate(fname) {
+		res, err := renderGoTemplate(fname, vars, opts.data())
+		if err != nil {
+			return fmt.Errorf("while rendering template, %v", err)
+		}
+		_, err = os.Stdout.WriteString(res)
+		return err
 	}
 
-	ctx, cancel := context.WithTimeout(ctx, DefaultTimeout)
+	ctx, cancel := context.WithTimeout(ctx, opts.timeout())
 	defer cancel()
 
-	cmd := exec.CommandContext(ctx, fname, vars...)
-	cmd.Env = append(cmd.Environ(), vars...)
+	cmd, err := command(ctx, fname, vars, opts)
+	if err != nil {
+		return err
+	}
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	defer cancel()
 	return cmd.Run()
 }
 
-func RunTemplateJSON(ctx context.Context, fname string, vars []string, res interface{}) error {
-	data, err := RunTemplate(ctx, fname, vars)
+func RunTemplateJSON(ctx context.Context, fname string, vars []string, opts *Options, res interface{}) error {
+	output, err := RunTemplate(ctx, fname, vars, opts)
 	if err != nil {
 		return err
 	}
 
-	err = json.Unmarshal([]byte(data), res)
+	err = json.Unmarshal([]byte(output), res)
 	if err != nil {
 		return fmt.Errorf("while decoding JSON from template %+v, %v", fname, err)
 	}